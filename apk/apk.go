@@ -0,0 +1,289 @@
+package apk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/DataDog/nikos/extract"
+	"github.com/DataDog/nikos/types"
+)
+
+// DefaultCDNURL is the Alpine CDN, used when the repositories of the host lack the package
+const DefaultCDNURL = "https://dl-cdn.alpinelinux.org/alpine"
+
+type Backend struct {
+	target       *types.Target
+	logger       types.Logger
+	repositories []string
+	keysDirs     []string
+	arch         string
+	branch       string
+	cdnURL       string
+	httpClient   *http.Client
+}
+
+// kernelPackage returns the name and version of the package providing the headers of
+// the kernel, e.g. linux-lts-dev 6.6.31-r0 for 6.6.31-0-lts
+func kernelPackage(kernel string) (string, string, error) {
+	verRel, flavour, found := cutLast(kernel, "-")
+	if !found {
+		return "", "", fmt.Errorf("failed to parse kernel release %s", kernel)
+	}
+	ver, rel, found := cutLast(verRel, "-")
+	if !found {
+		return "", "", fmt.Errorf("failed to parse kernel release %s", kernel)
+	}
+	return "linux-" + flavour + "-dev", ver + "-r" + rel, nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func (b *Backend) GetKernelHeaders(directory string) error {
+	pkgName, pkgVersion, err := kernelPackage(b.target.Uname.Kernel)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	data, err := b.fetchPackage(ctx, pkgName, pkgVersion)
+	if err != nil {
+		return fmt.Errorf("failed to fetch `%s` package: %w", pkgName, err)
+	}
+
+	if err := extract.ExtractTarball(bytes.NewReader(data), pkgName+".tar.gz", directory, b.logger); err != nil {
+		return fmt.Errorf("failed to extract kernel headers: %w", err)
+	}
+	return nil
+}
+
+// fetchPackage looks for the package in the indexes of the repositories of the host,
+// then of the CDN. Older versions are removed from the indexes, so the package is
+// finally downloaded from the CDN by name, relying on its signature only.
+func (b *Backend) fetchPackage(ctx context.Context, pkgName, pkgVersion string) ([]byte, error) {
+	var mErr error
+
+	repositories := b.repositories
+	cdnRepositories := b.cdnRepositories()
+	for _, cdnRepository := range cdnRepositories {
+		if !containsRepository(repositories, cdnRepository) {
+			repositories = append(repositories, cdnRepository)
+		}
+	}
+
+	for _, repository := range repositories {
+		entry, err := b.findPackage(ctx, repository, pkgName, pkgVersion)
+		if err != nil {
+			mErr = multierror.Append(mErr, err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+
+		b.logger.Infof("Downloading %s-%s from %s", pkgName, pkgVersion, repository)
+		data, err := b.downloadPackage(ctx, repository, pkgName, pkgVersion, entry.checksum)
+		if err != nil {
+			mErr = multierror.Append(mErr, err)
+			continue
+		}
+		return data, nil
+	}
+
+	for _, repository := range cdnRepositories {
+		b.logger.Debugf("Trying %s-%s in %s", pkgName, pkgVersion, repository)
+		data, err := b.downloadPackage(ctx, repository, pkgName, pkgVersion, "")
+		if err != nil {
+			mErr = multierror.Append(mErr, err)
+			continue
+		}
+		return data, nil
+	}
+
+	if mErr == nil {
+		mErr = errors.New("package not found")
+	}
+	return nil, mErr
+}
+
+func containsRepository(repositories []string, repository string) bool {
+	for _, r := range repositories {
+		if strings.TrimSuffix(r, "/") == repository {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Backend) cdnRepositories() []string {
+	if b.cdnURL == "" {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("%s/%s/main", b.cdnURL, b.branch),
+		fmt.Sprintf("%s/%s/community", b.cdnURL, b.branch),
+	}
+}
+
+// findPackage returns the entry of the package in the index of the repository, or nil
+func (b *Backend) findPackage(ctx context.Context, repository, pkgName, pkgVersion string) (*indexEntry, error) {
+	indexURL := repositoryURL(repository, b.arch, "APKINDEX.tar.gz")
+	data, err := b.fetch(ctx, indexURL)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := readIndex(data, b.keysDirs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", indexURL, err)
+	}
+
+	for _, entry := range entries {
+		if entry.name == pkgName && entry.version == pkgVersion {
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// downloadPackage downloads and verifies a package, returning its data stream
+func (b *Backend) downloadPackage(ctx context.Context, repository, pkgName, pkgVersion, checksum string) ([]byte, error) {
+	pkgURL := repositoryURL(repository, b.arch, fmt.Sprintf("%s-%s.apk", pkgName, pkgVersion))
+	data, err := b.fetch(ctx, pkgURL)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := readPackage(data, checksum, b.keysDirs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify %s: %w", pkgURL, err)
+	}
+	return content, nil
+}
+
+func repositoryURL(repository, arch, name string) string {
+	return strings.TrimSuffix(repository, "/") + "/" + arch + "/" + name
+}
+
+// fetch downloads a URL, or reads a local repository of the host
+func (b *Backend) fetch(ctx context.Context, url string) ([]byte, error) {
+	if strings.HasPrefix(url, "/") {
+		return os.ReadFile(types.HostRoot(url))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status for `%s`: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (b *Backend) Close() {}
+
+// SetCDNURL changes the CDN used as a fallback, an empty URL disables the fallback
+func (b *Backend) SetCDNURL(cdnURL string) {
+	b.cdnURL = strings.TrimSuffix(cdnURL, "/")
+}
+
+// readRepositories reads the repositories of /etc/apk/repositories, skipping
+// the tagged ones, which are only used for the packages pinned to them
+func readRepositories(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var repositories []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		repositories = append(repositories, line)
+	}
+	return repositories, scanner.Err()
+}
+
+// apkArches maps the machine names of uname to the architectures of apk
+var apkArches = map[string]string{
+	"i686":   "x86",
+	"i586":   "x86",
+	"armv7l": "armv7",
+	"armv6l": "armhf",
+}
+
+func detectArch(target *types.Target) string {
+	if content, err := os.ReadFile(types.HostEtc("apk", "arch")); err == nil {
+		if arch := strings.TrimSpace(string(content)); arch != "" {
+			return arch
+		}
+	}
+	if arch, ok := apkArches[target.Uname.Machine]; ok {
+		return arch
+	}
+	return target.Uname.Machine
+}
+
+var alpineReleasePattern = regexp.MustCompile(`^(\d+\.\d+)\.\d+$`)
+
+// releaseBranch returns the branch of the release, e.g. v3.20 for 3.20.1, or edge
+// for development snapshots such as 3.21.0_alpha20240807
+func releaseBranch(release string) string {
+	if submatches := alpineReleasePattern.FindStringSubmatch(release); submatches != nil {
+		return "v" + submatches[1]
+	}
+	return "edge"
+}
+
+func NewBackend(target *types.Target, logger types.Logger) (*Backend, error) {
+	repositories, err := readRepositories(types.HostEtc("apk", "repositories"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apk repositories: %w", err)
+	}
+
+	release := target.Distro.Release
+	if release == "" {
+		release = target.OSRelease["VERSION_ID"]
+	}
+
+	arch := detectArch(target)
+	return &Backend{
+		target:       target,
+		logger:       logger,
+		repositories: repositories,
+		keysDirs:     []string{types.HostEtc("apk", "keys"), types.HostRoot("usr", "share", "apk", "keys", arch)},
+		arch:         arch,
+		branch:       releaseBranch(release),
+		cdnURL:       DefaultCDNURL,
+		httpClient:   &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
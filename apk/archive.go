@@ -0,0 +1,229 @@
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitGzipStreams splits an archive made of concatenated gzip streams, as the
+// index and the packages are. Each stream is kept compressed, as signatures and
+// checksums are computed on the compressed bytes.
+func splitGzipStreams(data []byte) ([][]byte, error) {
+	var streams [][]byte
+	for offset := 0; offset < len(data); {
+		// bytes.Reader is an io.ByteReader, so the decompressor does not read past the stream
+		reader := bytes.NewReader(data[offset:])
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream %d: %w", len(streams), err)
+		}
+		gzipReader.Multistream(false)
+		if _, err := io.Copy(io.Discard, gzipReader); err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream %d: %w", len(streams), err)
+		}
+
+		end := len(data) - reader.Len()
+		streams = append(streams, data[offset:end])
+		offset = end
+	}
+	return streams, nil
+}
+
+// readTarFile returns the content of the first entry of a compressed tar stream
+// accepted by match. The signature streams have no end of archive marker, so the
+// entries following the match are not read.
+func readTarFile(stream []byte, match func(name string) bool) (string, []byte, error) {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return "", nil, err
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		hdr, err := tarReader.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if !match(hdr.Name) {
+			continue
+		}
+
+		content, err := io.ReadAll(tarReader)
+		return hdr.Name, content, err
+	}
+}
+
+// signatureHashes maps the prefixes of the signature files to the hash they use
+var signatureHashes = map[string]crypto.Hash{
+	".SIGN.RSA.":    crypto.SHA1,
+	".SIGN.RSA256.": crypto.SHA256,
+	".SIGN.RSA512.": crypto.SHA512,
+}
+
+// verifySignature checks the signature stream against the signed data, with the key
+// named by the signature file and found in one of the keys directories
+func verifySignature(signatureStream, signed []byte, keysDirs []string) error {
+	name, signature, err := readTarFile(signatureStream, func(name string) bool {
+		return strings.HasPrefix(name, ".SIGN.")
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+
+	var hash crypto.Hash
+	var keyName string
+	for prefix, prefixHash := range signatureHashes {
+		if strings.HasPrefix(name, prefix) {
+			hash, keyName = prefixHash, strings.TrimPrefix(name, prefix)
+		}
+	}
+	if keyName == "" || strings.Contains(keyName, "/") {
+		return fmt.Errorf("unsupported signature %s", name)
+	}
+
+	key, err := readPublicKey(keyName, keysDirs)
+	if err != nil {
+		return err
+	}
+
+	var digest []byte
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum(signed)
+		digest = sum[:]
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+		return fmt.Errorf("invalid signature with key %s: %w", keyName, err)
+	}
+	return nil
+}
+
+func readPublicKey(keyName string, keysDirs []string) (*rsa.PublicKey, error) {
+	for _, keysDir := range keysDirs {
+		content, err := os.ReadFile(filepath.Join(keysDir, keyName))
+		if err != nil {
+			continue
+		}
+
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("failed to decode key %s", keyName)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", keyName, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("key %s is not a RSA key", keyName)
+		}
+		return rsaKey, nil
+	}
+	return nil, fmt.Errorf("key %s not found in %s", keyName, strings.Join(keysDirs, ", "))
+}
+
+// readIndex verifies a signed APKINDEX.tar.gz and returns its packages
+func readIndex(data []byte, keysDirs []string) ([]indexEntry, error) {
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) < 2 {
+		return nil, errors.New("unsigned index")
+	}
+
+	signed := data[len(streams[0]):]
+	if err := verifySignature(streams[0], signed, keysDirs); err != nil {
+		return nil, err
+	}
+
+	_, index, err := readTarFile(signed, func(name string) bool { return name == "APKINDEX" })
+	if err != nil {
+		return nil, fmt.Errorf("failed to read APKINDEX: %w", err)
+	}
+	return parseIndex(index)
+}
+
+// readPackage verifies a package and returns its data stream. The control stream
+// must be signed, match the checksum of the index when known, and its datahash
+// must match the data stream.
+func readPackage(data []byte, checksum string, keysDirs []string) ([]byte, error) {
+	streams, err := splitGzipStreams(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) != 3 {
+		return nil, fmt.Errorf("expected signature, control and data streams, found %d streams", len(streams))
+	}
+	signature, control, content := streams[0], streams[1], streams[2]
+
+	if checksum != "" {
+		if err := verifyControlChecksum(control, checksum); err != nil {
+			return nil, err
+		}
+	}
+	if err := verifySignature(signature, control, keysDirs); err != nil {
+		return nil, err
+	}
+
+	_, pkgInfo, err := readTarFile(control, func(name string) bool { return name == ".PKGINFO" })
+	if err != nil {
+		return nil, fmt.Errorf("failed to read .PKGINFO: %w", err)
+	}
+
+	dataHash := pkgInfoField(pkgInfo, "datahash")
+	sum := sha256.Sum256(content)
+	if dataHash == "" || dataHash != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("data checksum mismatch")
+	}
+	return content, nil
+}
+
+// verifyControlChecksum checks the `C:` field of the index, the base64 encoded
+// SHA1 of the control stream prefixed with Q1
+func verifyControlChecksum(control []byte, checksum string) error {
+	encoded, found := strings.CutPrefix(checksum, "Q1")
+	if !found {
+		return fmt.Errorf("unsupported checksum %s", checksum)
+	}
+
+	sum := sha1.Sum(control)
+	if base64.StdEncoding.EncodeToString(sum[:]) != encoded {
+		return errors.New("control checksum mismatch")
+	}
+	return nil
+}
+
+// pkgInfoField returns a `key = value` field of .PKGINFO
+func pkgInfoField(pkgInfo []byte, key string) string {
+	for _, line := range strings.Split(string(pkgInfo), "\n") {
+		name, value, found := strings.Cut(line, "=")
+		if found && strings.TrimSpace(name) == key {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package apk
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tarFile struct {
+	name    string
+	content string
+}
+
+// gzipTar compresses a tar stream, without end of archive marker for the signatures and control streams
+func gzipTar(t *testing.T, files []tarFile, terminate bool) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, file := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}))
+		_, err := tarWriter.Write([]byte(file.content))
+		require.NoError(t, err)
+	}
+	if terminate {
+		require.NoError(t, tarWriter.Close())
+	} else {
+		require.NoError(t, tarWriter.Flush())
+	}
+	require.NoError(t, gzipWriter.Close())
+	return buf.Bytes()
+}
+
+// signStream returns the signature stream of the signed data
+func signStream(t *testing.T, key *rsa.PrivateKey, prefix string, hash crypto.Hash, signed []byte) []byte {
+	h := hash.New()
+	h.Write(signed)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+	require.NoError(t, err)
+	return gzipTar(t, []tarFile{{prefix + "test.rsa.pub", string(signature)}}, false)
+}
+
+func writeKey(t *testing.T, key *rsa.PrivateKey) string {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	keysDir := t.TempDir()
+	content := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(keysDir, "test.rsa.pub"), content, 0644))
+	return keysDir
+}
+
+func TestReadIndex(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keysDirs := []string{t.TempDir(), writeKey(t, key)}
+
+	content := gzipTar(t, []tarFile{
+		{"DESCRIPTION", "v3.20.1"},
+		{"APKINDEX", "C:Q1aaaa\nP:linux-lts-dev\nV:6.6.31-r0\nA:x86_64\nS:1\n\nC:Q1bbbb\nP:linux-virt-dev\nV:6.6.31-r0\nA:x86_64\n"},
+	}, true)
+	index := append(signStream(t, key, ".SIGN.RSA256.", crypto.SHA256, content), content...)
+
+	entries, err := readIndex(index, keysDirs)
+	require.NoError(t, err)
+	assert.Equal(t, []indexEntry{
+		{name: "linux-lts-dev", version: "6.6.31-r0", arch: "x86_64", checksum: "Q1aaaa"},
+		{name: "linux-virt-dev", version: "6.6.31-r0", arch: "x86_64", checksum: "Q1bbbb"},
+	}, entries)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = readIndex(append(signStream(t, otherKey, ".SIGN.RSA256.", crypto.SHA256, content), content...), keysDirs)
+	assert.Error(t, err)
+
+	_, err = readIndex(content, keysDirs)
+	assert.Error(t, err)
+}
+
+func TestReadPackage(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keysDirs := []string{writeKey(t, key)}
+
+	data := gzipTar(t, []tarFile{{"usr/src/linux-headers-6.6.31-0-lts/Makefile", "VERSION = 6"}}, true)
+	dataSum := sha256.Sum256(data)
+	control := gzipTar(t, []tarFile{{".PKGINFO", "pkgname = linux-lts-dev\npkgver = 6.6.31-r0\ndatahash = " + hex.EncodeToString(dataSum[:]) + "\n"}}, false)
+	controlSum := sha1.Sum(control)
+	checksum := "Q1" + base64.StdEncoding.EncodeToString(controlSum[:])
+	signature := signStream(t, key, ".SIGN.RSA.", crypto.SHA1, control)
+
+	pkg := bytes.Join([][]byte{signature, control, data}, nil)
+	otherData := gzipTar(t, []tarFile{{"usr/src/linux-headers-6.6.31-0-lts/Makefile", "VERSION = 7"}}, true)
+
+	testEntries := []struct {
+		name      string
+		pkg       []byte
+		checksum  string
+		expectErr bool
+	}{
+		{name: "with checksum", pkg: pkg, checksum: checksum},
+		{name: "without checksum", pkg: pkg},
+		{name: "checksum mismatch", pkg: pkg, checksum: "Q1" + base64.StdEncoding.EncodeToString(make([]byte, 20)), expectErr: true},
+		{name: "data mismatch", pkg: bytes.Join([][]byte{signature, control, otherData}, nil), expectErr: true},
+		{name: "unsigned", pkg: bytes.Join([][]byte{control, data}, nil), expectErr: true},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			content, err := readPackage(entry.pkg, entry.checksum, keysDirs)
+			if entry.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, data, content)
+		})
+	}
+}
+
+func TestKernelPackage(t *testing.T) {
+	name, version, err := kernelPackage("6.6.31-0-lts")
+	require.NoError(t, err)
+	assert.Equal(t, "linux-lts-dev", name)
+	assert.Equal(t, "6.6.31-r0", version)
+
+	_, _, err = kernelPackage("6.6.31")
+	assert.Error(t, err)
+}
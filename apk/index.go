@@ -0,0 +1,53 @@
+package apk
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// indexEntry is a package of APKINDEX
+type indexEntry struct {
+	name     string
+	version  string
+	arch     string
+	checksum string
+}
+
+// parseIndex parses the records of APKINDEX, one `X:value` field per line and
+// records separated by empty lines
+func parseIndex(index []byte) ([]indexEntry, error) {
+	var entries []indexEntry
+	var current indexEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(index))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if current.name != "" {
+				entries = append(entries, current)
+			}
+			current = indexEntry{}
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		switch value := line[2:]; line[0] {
+		case 'P':
+			current.name = value
+		case 'V':
+			current.version = value
+		case 'A':
+			current.arch = value
+		case 'C':
+			current.checksum = value
+		}
+	}
+	if current.name != "" {
+		entries = append(entries, current)
+	}
+
+	return entries, scanner.Err()
+}
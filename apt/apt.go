@@ -5,14 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/DataDog/aptly/aptly"
 	"github.com/DataDog/aptly/deb"
-	"github.com/DataDog/aptly/http"
 	"github.com/DataDog/aptly/pgp"
 	"github.com/xor-gate/ar"
 
@@ -25,9 +25,30 @@ type Backend struct {
 	logger         types.Logger
 	repoCollection []remoteRepo
 	debArch        string
+	keyringDir     string
+	// prefetched maps the URLs of the packages downloaded while resolving
+	// dependencies to their location in prefetchDir
+	prefetched  map[string]string
+	prefetchDir string
+	preferences []pinPreference
+	aptConf     aptConfig
+
+	archiveFallbacks *ArchiveFallbacks
+
+	dependencyFilter *regexp.Regexp
 }
 
+// DefaultDependencyFilter matches the header packages chained by the flavoured
+// header packages, and the kbuild packages providing the `scripts/` directory
+const DefaultDependencyFilter = `^linux-(.+-)?(headers|kbuild)-`
+
 func (b *Backend) Close() {
+	if b.keyringDir != "" {
+		os.RemoveAll(b.keyringDir)
+	}
+	if b.prefetchDir != "" {
+		os.RemoveAll(b.prefetchDir)
+	}
 }
 
 func (b *Backend) extractPackage(pkg, directory string) error {
@@ -55,157 +76,232 @@ func (b *Backend) extractPackage(pkg, directory string) error {
 	return errors.New("failed to decompress deb")
 }
 
-func (b *Backend) downloadPackage(downloader aptly.Downloader, verifier pgp.Verifier, query *deb.FieldQuery, directory string) (*deb.PackageDependencies, error) {
-	var packageURL *url.URL
-	var packageDeps *deb.PackageDependencies
+// indexedRepo is a remote repository along with the packages of its indexes
+// that are relevant for the kernel headers lookup
+type indexedRepo struct {
+	repo     *deb.RemoteRepo
+	packages *deb.PackageList
+	// load, if set, adds the packages matching a dependency on demand, for
+	// repositories without indexes
+	load func(dep deb.Dependency)
+}
 
-	stanza := make(deb.Stanza, 32)
+// fetchRepositories fetches the indexes of the configured repositories. A repository
+// failing to be fetched is skipped, so that a broken third-party repository does not
+// prevent the headers from being found in the others.
+func (b *Backend) fetchRepositories(downloader aptly.Downloader, keyrings *globalKeyrings, keep func(*deb.Package) bool) ([]indexedRepo, error) {
+	var repos []indexedRepo
+	var lastErr error
 
 	for _, repoInfo := range b.repoCollection {
-		repo, err := deb.NewRemoteRepo(repoInfo.repoID, repoInfo.uri, repoInfo.distribution, repoInfo.components, []string{b.debArch}, false, false, false)
+		ir, err := b.fetchRemoteRepo(repoInfo, downloader, keyrings, keep)
 		if err != nil {
-			b.logger.Errorf("Failed to create remote repo: %s", err)
+			b.logger.Warnf("Skipping repository %s %s: %s", repoInfo.uri, repoInfo.distribution, err)
+			lastErr = err
 			continue
 		}
+		repos = append(repos, ir)
+	}
 
-		b.logger.Debugf("Fetching repository: name=%s, distribution=%s, components=%v, arch=%v", repo.Name, repo.Distribution, repo.Components, repo.Architectures)
-		repo.SkipComponentCheck = true
-
-		stanza.Clear()
-		if err := repo.FetchBuffered(stanza, downloader, verifier); err != nil {
-			b.logger.Debugf("Error fetching repo: %s", err)
-			return nil, err
+	if len(repos) == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("no repository could be fetched: %w", lastErr)
 		}
+		return nil, errors.New("no repository configured")
+	}
+	return repos, nil
+}
 
-		b.logger.Debug("Downloading package indexes")
-		// factory is not used by DownloadPackageIndexes so we can use nil here
-		var factory *deb.CollectionFactory
-		if err := repo.DownloadPackageIndexes(nil, downloader, nil, factory, false); err != nil {
-			b.logger.Debugf("Failed to download package indexes: %s", err)
-			return nil, err
+func (b *Backend) fetchRemoteRepo(repoInfo remoteRepo, downloader aptly.Downloader, keyrings *globalKeyrings, keep func(*deb.Package) bool) (indexedRepo, error) {
+	repoVerifier, err := b.repoVerifier(repoInfo, keyrings)
+	if err != nil {
+		return indexedRepo{}, err
+	}
+
+	uris, err := b.resolveMirrors(downloader, repoInfo.uri)
+	if err != nil {
+		return indexedRepo{}, err
+	}
+
+	return b.fetchFromMirrors(repoInfo, uris, downloader, repoVerifier, keep)
+}
+
+// fetchFromMirrors fetches the repository from the first base URL that works
+func (b *Backend) fetchFromMirrors(repoInfo remoteRepo, uris []string, downloader aptly.Downloader, verifier pgp.Verifier, keep func(*deb.Package) bool) (indexedRepo, error) {
+	var lastErr error
+	for _, uri := range uris {
+		repo, err := deb.NewRemoteRepo(repoInfo.repoID, uri, repoInfo.distribution, repoInfo.components, []string{b.debArch}, false, false, false)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to create remote repo: %w", err)
+			continue
 		}
 
-		_, _, err = repo.ApplyFilter(-1, query, nil)
+		ir, err := b.fetchRepository(repo, downloader, verifier, keep)
 		if err != nil {
-			b.logger.Debugf("Failed to apply filter: %s", err)
-			return nil, err
+			if len(uris) > 1 {
+				b.logger.Warnf("Failed to fetch repository from mirror %s: %s", uri, err)
+			}
+			lastErr = err
+			continue
 		}
+		return ir, nil
+	}
+	return indexedRepo{}, lastErr
+}
 
-		/*
-			// For some reason, this overrides the `downloadPath` field of package so we don't
-			// have the full remote path of the package. As a workaround, aptly was patched to
-			// expose the repository package list using RemoteRepo.PackageList()
+func (b *Backend) fetchRepository(repo *deb.RemoteRepo, downloader aptly.Downloader, verifier pgp.Verifier, keep func(*deb.Package) bool) (indexedRepo, error) {
+	b.logger.Debugf("Fetching repository: name=%s, distribution=%s, components=%v, arch=%v", repo.Name, repo.Distribution, repo.Components, repo.Architectures)
+	repo.SkipComponentCheck = true
 
-			if err := repo.FinalizeDownload(collectionFactory, progress); err != nil {
-				return errors.Wrap(err, "failed to finalize download")
-			}
+	stanza := make(deb.Stanza, 32)
+	if err := repo.FetchBuffered(stanza, downloader, verifier); err != nil {
+		b.logger.Debugf("Error fetching repo: %s", err)
+		return indexedRepo{}, err
+	}
 
-			refList := repo.RefList()
-			packageList, err := deb.NewPackageListFromRefList(refList, collectionFactory.PackageCollection(), progress)
-			if err != nil {
-				return err
-			}
-		*/
+	b.logger.Debug("Downloading package indexes")
+	// factory is not used by DownloadPackageIndexes so we can use nil here
+	var factory *deb.CollectionFactory
+	if err := repo.DownloadPackageIndexes(nil, downloader, nil, factory, false); err != nil {
+		b.logger.Debugf("Failed to download package indexes: %s", err)
+		return indexedRepo{}, err
+	}
 
-		packageList := repo.PackageList()
-		packageList.ForEach(func(pkg *deb.Package) error {
-			b.logger.Infof("Found package %s with version %s", pkg.Name, pkg.Version)
+	/*
+		// For some reason, this overrides the `downloadPath` field of package so we don't
+		// have the full remote path of the package. As a workaround, aptly was patched to
+		// expose the repository package list using RemoteRepo.PackageList()
 
-			packageFiles := pkg.Files()
-			if len(packageFiles) == 0 {
-				return errors.New("No package file for " + pkg.Name)
-			}
+		if err := repo.FinalizeDownload(collectionFactory, progress); err != nil {
+			return errors.Wrap(err, "failed to finalize download")
+		}
 
-			packageURL = repo.PackageURL(packageFiles[0].DownloadURL())
-			packageDeps = pkg.Deps()
-			b.logger.Infof("Package URL: %s", packageURL)
-			return nil
-		})
+		refList := repo.RefList()
+		packageList, err := deb.NewPackageListFromRefList(refList, collectionFactory.PackageCollection(), progress)
+		if err != nil {
+			return err
+		}
+	*/
 
-		// if we set packageURL we can exit the loop
-		if packageURL != nil {
-			break
+	// only keep the packages we may need, full indexes are too large to be kept around
+	packages := deb.NewPackageList()
+	repo.PackageList().ForEach(func(pkg *deb.Package) error {
+		if keep(pkg) {
+			return packages.Add(pkg)
 		}
-	}
+		return nil
+	})
+	packages.PrepareIndex()
 
-	if packageURL == nil {
-		return nil, errors.New("failed to find package " + query.Value)
+	b.logger.Debugf("Kept %d packages from repository %s", packages.Len(), repo.Name)
+	return indexedRepo{repo: repo, packages: packages}, nil
+}
+
+func (b *Backend) downloadPackage(downloader aptly.Downloader, repo *deb.RemoteRepo, pkg *deb.Package, directory string) error {
+	packageFiles := pkg.Files()
+	if len(packageFiles) == 0 {
+		return errors.New("No package file for " + pkg.Name)
 	}
 
-	b.logger.Info("Downloading package")
+	packageURL := repo.PackageURL(packageFiles[0].DownloadURL())
+	b.logger.Infof("Package URL: %s", packageURL)
+
 	url := packageURL.String()
+	if prefetched, ok := b.prefetched[url]; ok {
+		b.logger.Infof("Using package %s downloaded while resolving dependencies", pkg.Name)
+		return b.extractPackage(prefetched, directory)
+	}
+
+	b.logger.Infof("Downloading package %s", pkg.Name)
 	outputFile := filepath.Join(directory, filepath.Base(url))
 	if err := downloader.Download(context.Background(), url, outputFile); err != nil {
-		return nil, fmt.Errorf("failed to download %s to %s: %w", url, directory, err)
+		return fmt.Errorf("failed to download %s to %s: %w", url, directory, err)
 	}
 	// defer os.Remove(outputFile)
 
-	return packageDeps, b.extractPackage(outputFile, directory)
+	return b.extractPackage(outputFile, directory)
 }
 
-func (b *Backend) createGpgVerifier() (*pgp.GoVerifier, error) {
-	gpgVerifier := &pgp.GoVerifier{}
-
-	for _, searchPattern := range []string{types.HostEtc("apt", "trusted.gpg"), types.HostEtc("apt", "trusted.gpg.d", "*.gpg"), "/usr/share/keyrings/*.gpg"} {
-		keyrings, err := filepath.Glob(searchPattern)
-		if err != nil {
-			return nil, fmt.Errorf("failed to find valid apt keyrings: %w", err)
-		}
-		for _, keyring := range keyrings {
-			b.logger.Infof("Adding keyring from: %s", keyring)
-			gpgVerifier.AddKeyring(keyring)
-		}
+func (b *Backend) GetKernelHeaders(directory string) error {
+	result, err := b.GetKernelHeadersWithResult(directory)
+	if err != nil {
+		return err
 	}
 
-	if err := gpgVerifier.InitKeyring(); err != nil {
-		return nil, err
+	for _, missing := range result.MissingDependencies {
+		b.logger.Warnf("Missing dependency %s", missing)
 	}
-	return gpgVerifier, nil
+	return nil
 }
 
-func (b *Backend) GetKernelHeaders(directory string) error {
-	downloader := http.NewDownloader(0, 1, nil)
+// GetKernelHeadersWithResult downloads the kernel headers package along with the
+// dependencies matching the dependency filter, and reports what was downloaded
+func (b *Backend) GetKernelHeadersWithResult(directory string) (*HeadersResult, error) {
+	downloader := newDownloader(b.aptConf, b.logger)
 
-	gpgVerifier, err := b.createGpgVerifier()
+	keyrings, err := b.loadGlobalKeyrings()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	kernelRelease := b.target.Uname.Kernel
-	query := &deb.FieldQuery{
-		Field:    "Name",
-		Relation: deb.VersionPatternMatch,
-		Value:    fmt.Sprintf("linux-headers-%s", kernelRelease),
+	root := deb.Dependency{
+		Pkg:      fmt.Sprintf("linux-headers-%s", kernelRelease),
+		Relation: deb.VersionDontCare,
+	}
+	b.logger.Infof("Looking for %s", root.Pkg)
+
+	keep := func(pkg *deb.Package) bool {
+		return pkg.Name == root.Pkg || b.dependencyFilter.MatchString(pkg.Name)
 	}
-	b.logger.Infof("Looking for %s", query.Value)
 
-	dependencies, err := b.downloadPackage(downloader, gpgVerifier, query, directory)
+	repos, err := b.fetchRepositories(downloader, keyrings, keep)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Sometimes, the header package depends on other header packages
-	// If this is the case, download the dependency in addition
-	if dependencies != nil {
-		for _, dep := range dependencies.Depends {
-			if strings.Contains(dep, "linux") && strings.Contains(dep, "headers") {
-
-				depName := strings.Split(dep, " ")[0]
-				b.logger.Infof("Looking for dependency %s", dep)
-				query = &deb.FieldQuery{
-					Field:    "Name",
-					Relation: deb.VersionPatternMatch,
-					Value:    depName,
-				}
-
-				_, err = b.downloadPackage(downloader, gpgVerifier, query, directory)
-				if err != nil {
-					b.logger.Warnf("Failed to download dependent package %s", depName)
-				}
+	resolver := newDependencyResolver(repos, b.debArch, b.dependencyFilter, b.preferences, b.logger)
+	resolved, err := resolver.resolve(root)
+	if err != nil && b.archiveFallbacks != nil {
+		b.logger.Infof("%s, looking into archives", err)
+
+		repos = append(repos, b.fetchArchiveRepositories(downloader, keyrings.scoped(true), root.Pkg, keep)...)
+		resolver = newDependencyResolver(repos, b.debArch, b.dependencyFilter, b.preferences, b.logger)
+		resolved, err = resolver.resolve(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &HeadersResult{
+		MissingDependencies: resolver.missing,
+	}
+	for _, rp := range resolved {
+		if err := b.downloadPackage(downloader, rp.repo, rp.pkg, directory); err != nil {
+			// the requested package is mandatory, its dependencies are not
+			if rp.pkg.Name == root.Pkg {
+				return nil, err
 			}
+
+			b.logger.Warnf("Failed to download dependent package %s: %s", rp.pkg.Name, err)
+			result.MissingDependencies = append(result.MissingDependencies, rp.pkg.Name)
+			continue
 		}
+		result.Packages = append(result.Packages, rp.pkg.Name+"_"+rp.pkg.Version)
 	}
 
+	return result, nil
+}
+
+// SetDependencyFilter sets the regular expression that the dependencies of the
+// headers package must match to be downloaded along with it
+func (b *Backend) SetDependencyFilter(pattern string) error {
+	filter, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid dependency filter: %w", err)
+	}
+
+	b.dependencyFilter = filter
 	return nil
 }
 
@@ -214,6 +310,9 @@ type remoteRepo struct {
 	uri          string
 	distribution string
 	components   []string
+	signedByKey  string
+	keyrings     []string
+	trusted      bool
 }
 
 func NewBackend(target *types.Target, aptConfigDir string, logger types.Logger) (*Backend, error) {
@@ -237,13 +336,31 @@ func NewBackend(target *types.Target, aptConfigDir string, logger types.Logger)
 		return nil, fmt.Errorf("unsupported architecture '%s'", target.Uname.Machine)
 	}
 
+	aptConf, err := parseAPTConf(aptConfigDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APT configuration: %w", err)
+	}
+
+	if arch := aptConf.get("apt::architecture", ""); arch != "" {
+		logger.Debugf("Using architecture %s from APT configuration", arch)
+		debArch = arch
+	}
+
+	preferences, err := parsePreferences(aptConfigDir, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APT preferences: %w", err)
+	}
+
 	backend := &Backend{
-		target:  target,
-		logger:  logger,
-		debArch: debArch,
+		target:           target,
+		logger:           logger,
+		debArch:          debArch,
+		preferences:      preferences,
+		aptConf:          aptConf,
+		dependencyFilter: regexp.MustCompile(DefaultDependencyFilter),
 	}
 
-	repoList, err := parseAPTConfigFolder(aptConfigDir)
+	repoList, err := parseAPTSources(aptConf.sourcesPaths(aptConfigDir))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse APT folder: %w", err)
 	}
@@ -253,9 +370,19 @@ func NewBackend(target *types.Target, aptConfigDir string, logger types.Logger)
 			continue
 		}
 
-		if isSignedByUnreachableKey(repo) {
+		if len(repo.Architectures) != 0 && !slices.Contains(repo.Architectures, debArch) {
+			backend.logger.Debugf("Skipping repository %s %s, not available for %s", repo.URI, repo.Distribution, debArch)
+			continue
+		}
+
+		keyrings, fingerprints, err := resolveSignedBy(repo)
+		if err != nil {
+			backend.logger.Warnf("Skipping repository %s %s: %s", repo.URI, repo.Distribution, err)
 			continue
 		}
+		for _, fingerprint := range fingerprints {
+			backend.logger.Infof("Ignoring fingerprint %s in signed-by of repository %s %s, fingerprints are not supported", fingerprint, repo.URI, repo.Distribution)
+		}
 
 		prefix := target.Distro.Display
 		repoID := fmt.Sprintf("%s-%d", prefix, i)
@@ -270,6 +397,9 @@ func NewBackend(target *types.Target, aptConfigDir string, logger types.Logger)
 			uri:          repo.URI,
 			distribution: repo.Distribution,
 			components:   components,
+			signedByKey:  repo.SignedByKey,
+			keyrings:     keyrings,
+			trusted:      repo.Trusted,
 		}
 
 		backend.repoCollection = append(backend.repoCollection, rr)
@@ -280,25 +410,31 @@ func NewBackend(target *types.Target, aptConfigDir string, logger types.Logger)
 	return backend, nil
 }
 
-func isSignedByUnreachableKey(repo *Repository) bool {
-	if repo.Options == "" {
-		return false
+// hostPath resolves a path of the host filesystem, which may be mounted elsewhere
+// when running in a container
+func hostPath(path string) string {
+	if rel, found := strings.CutPrefix(path, "/etc/"); found {
+		return types.HostEtc(rel)
 	}
+	return types.HostRoot(path)
+}
 
-	options := strings.Split(repo.Options, " ")
-	for _, opt := range options {
-		optName, optValue, found := strings.Cut(opt, "=")
-		if !found {
+// resolveSignedBy returns the keyrings a repository is restricted to, and the key
+// fingerprints listed along with them. Fingerprints are not supported: only the
+// keyrings restrict the repository, the global keyrings being used when there are none.
+func resolveSignedBy(repo *Repository) ([]string, []string, error) {
+	var keyrings, fingerprints []string
+	for _, signedBy := range repo.SignedBy {
+		if !strings.HasPrefix(signedBy, "/") {
+			fingerprints = append(fingerprints, signedBy)
 			continue
 		}
 
-		if strings.ToLower(optName) == "signed-by" {
-			// if the key is not in `/etc/*` then we cannot reach it
-			if !strings.HasPrefix(optValue, "/etc") {
-				return true
-			}
+		keyring := hostPath(signedBy)
+		if _, err := os.Stat(keyring); err != nil {
+			return nil, nil, fmt.Errorf("keyring %s is not reachable: %w", signedBy, err)
 		}
+		keyrings = append(keyrings, keyring)
 	}
-
-	return false
+	return keyrings, fingerprints, nil
 }
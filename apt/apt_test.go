@@ -0,0 +1,137 @@
+package apt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/types"
+)
+
+type signedByTestEntry struct {
+	name         string
+	signedBy     []string
+	keyrings     []string
+	fingerprints []string
+	err          bool
+}
+
+func TestResolveSignedBy(t *testing.T) {
+	hostRoot := t.TempDir()
+	t.Setenv("HOST_ROOT", hostRoot)
+	require.NoError(t, os.MkdirAll(filepath.Join(hostRoot, "usr", "share", "keyrings"), 0755))
+	for _, name := range []string{"a.gpg", "b.gpg"} {
+		require.NoError(t, os.WriteFile(filepath.Join(hostRoot, "usr", "share", "keyrings", name), nil, 0644))
+	}
+
+	testEntries := []signedByTestEntry{
+		{
+			name: "none",
+		},
+		{
+			name:     "keyrings",
+			signedBy: []string{"/usr/share/keyrings/a.gpg", "/usr/share/keyrings/b.gpg"},
+			keyrings: []string{filepath.Join(hostRoot, "usr/share/keyrings/a.gpg"), filepath.Join(hostRoot, "usr/share/keyrings/b.gpg")},
+		},
+		{
+			name:         "fingerprints",
+			signedBy:     []string{"0xDEADBEEF", "F6ECB3762474EDA9D21B7022871920D1991BC93C"},
+			fingerprints: []string{"0xDEADBEEF", "F6ECB3762474EDA9D21B7022871920D1991BC93C"},
+		},
+		{
+			name:         "keyrings and fingerprints",
+			signedBy:     []string{"F6ECB3762474EDA9D21B7022871920D1991BC93C", "/usr/share/keyrings/b.gpg"},
+			keyrings:     []string{filepath.Join(hostRoot, "usr/share/keyrings/b.gpg")},
+			fingerprints: []string{"F6ECB3762474EDA9D21B7022871920D1991BC93C"},
+		},
+		{
+			name:     "missing keyring",
+			signedBy: []string{"/usr/share/keyrings/a.gpg", "/usr/share/keyrings/missing.gpg"},
+			err:      true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			keyrings, fingerprints, err := resolveSignedBy(&Repository{SignedBy: testEntry.signedBy})
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.keyrings, keyrings)
+			assert.Equal(t, testEntry.fingerprints, fingerprints)
+		})
+	}
+}
+
+// serveTestRepository serves a repository with a single package, under the stable
+// distribution and main component
+func serveTestRepository(t *testing.T, mux *nethttp.ServeMux, prefix, pkgName, version string) {
+	content := testDeb(t, "Package: "+pkgName+"\nVersion: "+version+"\nArchitecture: amd64\n")
+	filename := "pool/main/" + pkgName + "_" + version + "_amd64.deb"
+	debSum := sha256.Sum256(content)
+	packages := fmt.Sprintf("Package: %s\nVersion: %s\nArchitecture: amd64\nFilename: %s\nSize: %d\nSHA256: %x\n\n", pkgName, version, filename, len(content), debSum)
+	packagesSum := sha256.Sum256([]byte(packages))
+	release := fmt.Sprintf("Suite: stable\nArchitectures: amd64\nComponents: main\nSHA256:\n %x %d main/binary-amd64/Packages\n", packagesSum, len(packages))
+
+	for path, data := range map[string][]byte{
+		"/dists/stable/Release":                    []byte(release),
+		"/dists/stable/main/binary-amd64/Packages": []byte(packages),
+		"/" + filename:                             content,
+	} {
+		data := data
+		mux.HandleFunc(prefix+path, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			w.Write(data)
+		})
+	}
+}
+
+func TestGetKernelHeadersSkipsFailingRepositories(t *testing.T) {
+	t.Setenv("HOST_ETC", t.TempDir())
+	t.Setenv("HOST_ROOT", t.TempDir())
+
+	const kernelRelease = "6.1.0-18-amd64"
+	pkgName := "linux-headers-" + kernelRelease
+
+	mux := nethttp.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serveTestRepository(t, mux, "/good", pkgName, "6.1.76-1")
+
+	b := &Backend{
+		target:           &types.Target{Uname: types.Utsname{Kernel: kernelRelease}},
+		logger:           logrus.New(),
+		debArch:          "amd64",
+		dependencyFilter: regexp.MustCompile(DefaultDependencyFilter),
+		repoCollection: []remoteRepo{
+			// the Release file is missing
+			{repoID: "broken", uri: server.URL + "/broken/", distribution: "stable", components: []string{"main"}, trusted: true},
+			// the keyring is missing
+			{repoID: "vendor", uri: server.URL + "/good/", distribution: "stable", components: []string{"main"}, keyrings: []string{"/nonexistent/vendor.gpg"}},
+			// the mirror list is missing
+			{repoID: "mirrors", uri: "mirror+file:/nonexistent/mirrors.txt", distribution: "stable", components: []string{"main"}, trusted: true},
+			{repoID: "good", uri: server.URL + "/good/", distribution: "stable", components: []string{"main"}, trusted: true},
+		},
+	}
+	defer b.Close()
+
+	directory := t.TempDir()
+	result, err := b.GetKernelHeadersWithResult(directory)
+	require.NoError(t, err)
+	assert.Equal(t, []string{pkgName + "_6.1.76-1"}, result.Packages)
+	assert.FileExists(t, filepath.Join(directory, "Makefile"))
+
+	b.repoCollection = b.repoCollection[:3]
+	_, err = b.GetKernelHeadersWithResult(t.TempDir())
+	assert.ErrorContains(t, err, "no repository could be fetched")
+}
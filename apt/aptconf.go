@@ -0,0 +1,300 @@
+package apt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/nikos/types"
+)
+
+// aptConfig holds the options of apt.conf(5) files. Keys are the full
+// `::` separated option names, lowercased as APT matches them case-insensitively.
+type aptConfig map[string]string
+
+// apt ignores the files of apt.conf.d whose name contains other characters
+var aptConfPartName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// parseAPTConf reads `apt.conf.d/*` in alphanumeric order, then `apt.conf`,
+// from the APT config folder. Files that cannot be parsed are skipped.
+func parseAPTConf(folderPath string, logger types.Logger) (aptConfig, error) {
+	var files []string
+
+	partsFolder := filepath.Join(folderPath, "apt.conf.d")
+	if list, err := os.ReadDir(partsFolder); err == nil {
+		for _, l := range list {
+			ext := filepath.Ext(l.Name())
+			if !l.IsDir() && aptConfPartName.MatchString(l.Name()) && (ext == "" || ext == ".conf") {
+				files = append(files, filepath.Join(partsFolder, l.Name()))
+			}
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(folderPath, "apt.conf")); err == nil {
+		files = append(files, filepath.Join(folderPath, "apt.conf"))
+	}
+
+	conf := make(aptConfig)
+	for _, file := range files {
+		// a file is only applied if it is parsed entirely
+		fileConf := conf.copy()
+		if err := fileConf.parseFile(file); err != nil {
+			logger.Warnf("Skipping APT configuration file: %s", err)
+			continue
+		}
+		conf = fileConf
+	}
+	return conf, nil
+}
+
+func (c aptConfig) copy() aptConfig {
+	res := make(aptConfig, len(c))
+	for key, value := range c {
+		res[key] = value
+	}
+	return res
+}
+
+func (c aptConfig) parseFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Reading %s: %s", path, err)
+	}
+
+	p := &aptConfParser{conf: c, path: path, data: string(data)}
+	if err := p.parse(); err != nil {
+		return fmt.Errorf("Parsing %s: %s", path, err)
+	}
+	return nil
+}
+
+type aptConfParser struct {
+	conf aptConfig
+	path string
+	data string
+	pos  int
+}
+
+const (
+	tokenEOF = iota
+	tokenWord
+	tokenString
+	tokenPunct
+)
+
+// next returns the next token, skipping comments and handling the
+// `#include` and `#clear` directives
+func (p *aptConfParser) next() (int, string, error) {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.pos++
+		case strings.HasPrefix(p.data[p.pos:], "//"):
+			p.skipLine()
+		case strings.HasPrefix(p.data[p.pos:], "/*"):
+			end := strings.Index(p.data[p.pos+2:], "*/")
+			if end < 0 {
+				return tokenEOF, "", fmt.Errorf("unterminated comment")
+			}
+			p.pos += end + 4
+		case c == '#':
+			start := p.pos
+			p.skipLine()
+			if err := p.directive(p.data[start:p.pos]); err != nil {
+				return tokenEOF, "", err
+			}
+		case c == '{' || c == '}' || c == ';':
+			p.pos++
+			return tokenPunct, string(c), nil
+		case c == '"':
+			end := strings.IndexByte(p.data[p.pos+1:], '"')
+			if end < 0 {
+				return tokenEOF, "", fmt.Errorf("unterminated string")
+			}
+			value := p.data[p.pos+1 : p.pos+1+end]
+			p.pos += end + 2
+			return tokenString, value, nil
+		default:
+			start := p.pos
+			for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n{};\"", rune(p.data[p.pos])) {
+				p.pos++
+			}
+			return tokenWord, p.data[start:p.pos], nil
+		}
+	}
+	return tokenEOF, "", nil
+}
+
+func (p *aptConfParser) skipLine() {
+	if end := strings.IndexByte(p.data[p.pos:], '\n'); end >= 0 {
+		p.pos += end + 1
+	} else {
+		p.pos = len(p.data)
+	}
+}
+
+func (p *aptConfParser) directive(line string) error {
+	fields := strings.Fields(strings.TrimRight(strings.TrimSpace(line), ";"))
+	if len(fields) < 2 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "#include":
+		include := strings.Trim(fields[1], "\"")
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(p.path), include)
+		}
+		return p.conf.parseFile(include)
+	case "#clear":
+		for _, name := range fields[1:] {
+			p.conf.clear(strings.Trim(name, "\""))
+		}
+	}
+	return nil
+}
+
+// parse reads the statements of a file: `Key "value";`, `Key value;`, `Key { ... };`,
+// and the anonymous `"value";` list items in blocks
+func (p *aptConfParser) parse() error {
+	// scopes holds the full keys of the enclosing blocks
+	var scopes []string
+	prefix := func() string {
+		if len(scopes) == 0 {
+			return ""
+		}
+		return scopes[len(scopes)-1]
+	}
+	fullKey := func(name string) string {
+		name = strings.ToLower(name)
+		if len(scopes) == 0 {
+			return name
+		}
+		return prefix() + "::" + name
+	}
+
+	for {
+		tok, value, err := p.next()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case tokenEOF:
+			if len(scopes) != 0 {
+				return fmt.Errorf("unterminated block %s", prefix())
+			}
+			return nil
+		case tokenPunct:
+			switch value {
+			case "}":
+				if len(scopes) == 0 {
+					return fmt.Errorf("unexpected `}`")
+				}
+				scopes = scopes[:len(scopes)-1]
+			case "{":
+				return fmt.Errorf("unexpected `{`")
+			}
+		case tokenString:
+			// list item, only the last one is kept
+			p.conf[prefix()] = value
+		case tokenWord:
+			key := fullKey(value)
+
+			tok, value, err = p.next()
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case tok == tokenString || tok == tokenWord:
+				p.conf[key] = value
+			case tok == tokenPunct && value == "{":
+				scopes = append(scopes, key)
+			case tok == tokenPunct && value == ";":
+				p.conf[key] = ""
+			default:
+				return fmt.Errorf("expected a value for %s", key)
+			}
+		}
+	}
+}
+
+// clear removes an option and all its sub-options
+func (c aptConfig) clear(name string) {
+	name = strings.ToLower(name)
+	for key := range c {
+		if key == name || strings.HasPrefix(key, name+"::") {
+			delete(c, key)
+		}
+	}
+}
+
+func (c aptConfig) get(key, dfault string) string {
+	if value, ok := c[strings.ToLower(key)]; ok {
+		return value
+	}
+	return dfault
+}
+
+func parseBool(value string, dfault bool) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true", "with", "on", "enable", "1":
+		return true
+	case "no", "false", "without", "off", "disable", "0":
+		return false
+	default:
+		return dfault
+	}
+}
+
+func (c aptConfig) integer(key string, dfault int) int {
+	if value, err := strconv.Atoi(c.get(key, "")); err == nil {
+		return value
+	}
+	return dfault
+}
+
+// hostOption returns the value of an Acquire option for a host, which takes
+// precedence over the option of the protocol, e.g. `Acquire::https::<host>::Verify-Peer`
+func (c aptConfig) hostOption(scheme, host, option, dfault string) string {
+	return c.get("acquire::"+scheme+"::"+host+"::"+option, c.get("acquire::"+scheme+"::"+option, dfault))
+}
+
+// sourcesPaths returns the locations of the sources list file and parts folder,
+// set by `Dir::Etc::sourcelist` and `Dir::Etc::sourceparts`, relative to `Dir::Etc`
+func (c aptConfig) sourcesPaths(aptConfigDir string) (string, string) {
+	etcDir := aptConfigDir
+	if dir := c.get("dir::etc", ""); dir != "" {
+		etcDir = hostPath(filepath.Join("/", c.get("dir", "/"), dir))
+	}
+
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return hostPath(path)
+		}
+		return filepath.Join(etcDir, path)
+	}
+
+	return resolve(c.get("dir::etc::sourcelist", "sources.list")), resolve(c.get("dir::etc::sourceparts", "sources.list.d"))
+}
+
+// timeout returns `Acquire::<scheme>::Timeout`, in seconds
+func (c aptConfig) timeout(scheme, host string) time.Duration {
+	value := c.hostOption(scheme, host, "timeout", "")
+	if value == "" && scheme == "https" {
+		// the https method falls back to the http options
+		value = c.hostOption("http", host, "timeout", "")
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return defaultAcquireTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
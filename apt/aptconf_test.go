@@ -0,0 +1,156 @@
+package apt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type aptConfTestEntry struct {
+	name string
+	// files maps the paths relative to the APT config folder to their content
+	files    map[string]string
+	expected aptConfig
+}
+
+func TestParseAPTConf(t *testing.T) {
+	testEntries := []aptConfTestEntry{
+		{
+			name: "quoted",
+			files: map[string]string{
+				"apt.conf.d/00arch": `APT::Architecture "arm64";`,
+			},
+			expected: aptConfig{"apt::architecture": "arm64"},
+		},
+		{
+			name: "unquoted",
+			files: map[string]string{
+				"apt.conf.d/00recommends": "APT::Install-Recommends false;\nAcquire::Retries 3;\n",
+			},
+			expected: aptConfig{"apt::install-recommends": "false", "acquire::retries": "3"},
+		},
+		{
+			name: "case insensitive keys",
+			files: map[string]string{
+				"apt.conf.d/00proxy": `acquire::HTTP::Proxy "http://Proxy:3128";`,
+			},
+			expected: aptConfig{"acquire::http::proxy": "http://Proxy:3128"},
+		},
+		{
+			name: "scoped blocks",
+			files: map[string]string{
+				"apt.conf.d/00acquire": `Acquire {
+	http {
+		Proxy "http://proxy:3128";
+		Timeout 10;
+		deb.example.com::Proxy "DIRECT";
+	};
+	https::Verify-Peer "false";
+};`,
+			},
+			expected: aptConfig{
+				"acquire::http::proxy":                  "http://proxy:3128",
+				"acquire::http::timeout":                "10",
+				"acquire::http::deb.example.com::proxy": "DIRECT",
+				"acquire::https::verify-peer":           "false",
+			},
+		},
+		{
+			name: "list items",
+			files: map[string]string{
+				"apt.conf.d/00hooks": `DPkg::Pre-Invoke { "echo one"; "echo two"; };
+APT::NeverAutoRemove { "^linux-image-.*"; };`,
+			},
+			expected: aptConfig{"dpkg::pre-invoke": "echo two", "apt::neverautoremove": "^linux-image-.*"},
+		},
+		{
+			name: "empty value",
+			files: map[string]string{
+				"apt.conf.d/00proxy": `Acquire::http::Proxy "";
+Acquire::ftp::Proxy;`,
+			},
+			expected: aptConfig{"acquire::http::proxy": "", "acquire::ftp::proxy": ""},
+		},
+		{
+			name: "comments",
+			files: map[string]string{
+				"apt.conf.d/00comments": `// APT::Architecture "i386";
+/* Acquire::Retries "1";
+   Acquire::http::Proxy "http://proxy:3128"; */
+# a comment
+APT::Architecture "amd64"; // trailing comment
+Acquire::Retries /* inline */ 2;`,
+			},
+			expected: aptConfig{"apt::architecture": "amd64", "acquire::retries": "2"},
+		},
+		{
+			name: "clear",
+			files: map[string]string{
+				"apt.conf.d/00proxy": `Acquire::http::Proxy "http://proxy:3128";
+Acquire::http::Timeout "10";
+Acquire::https::Proxy "http://proxy:3128";`,
+				"apt.conf.d/10noproxy": "#clear Acquire::http;\n",
+			},
+			expected: aptConfig{"acquire::https::proxy": "http://proxy:3128"},
+		},
+		{
+			name: "include",
+			files: map[string]string{
+				"apt.conf.d/00include": `#include "../extra/proxy";
+Acquire::Retries "3";`,
+				"extra/proxy": `Acquire::http::Proxy "http://proxy:3128";`,
+			},
+			expected: aptConfig{"acquire::http::proxy": "http://proxy:3128", "acquire::retries": "3"},
+		},
+		{
+			name: "order",
+			files: map[string]string{
+				"apt.conf.d/20retries": `Acquire::Retries "2";`,
+				"apt.conf.d/10retries": `Acquire::Retries "1";`,
+				"apt.conf":             `APT::Architecture "amd64";`,
+				"apt.conf.d/99arch":    `APT::Architecture "arm64";`,
+			},
+			expected: aptConfig{"acquire::retries": "2", "apt::architecture": "amd64"},
+		},
+		{
+			name: "ignored files",
+			files: map[string]string{
+				"apt.conf.d/00proxy.disabled": `Acquire::http::Proxy "http://proxy:3128";`,
+				"apt.conf.d/00proxy~":         `Acquire::http::Proxy "http://proxy:3128";`,
+				"apt.conf.d/10retries.conf":   `Acquire::Retries "3";`,
+			},
+			expected: aptConfig{"acquire::retries": "3"},
+		},
+		{
+			name: "invalid files",
+			files: map[string]string{
+				"apt.conf.d/00unterminated": `Acquire::Retries "5";
+APT {
+	Architecture "arm64";`,
+				"apt.conf.d/10string":  `Acquire::http::Proxy "http://proxy:3128;`,
+				"apt.conf.d/20include": `#include "missing";`,
+				"apt.conf.d/30valid":   `Acquire::Retries "3";`,
+			},
+			expected: aptConfig{"acquire::retries": "3"},
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range testEntry.files {
+				path := filepath.Join(dir, name)
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+			}
+
+			conf, err := parseAPTConf(dir, logrus.New())
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, conf)
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package apt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/DataDog/aptly/aptly"
+	"github.com/DataDog/aptly/deb"
+	"github.com/DataDog/aptly/http"
+	"github.com/DataDog/aptly/pgp"
+	"github.com/DataDog/aptly/utils"
+)
+
+const (
+	DefaultUbuntuOldReleasesURL = "http://old-releases.ubuntu.com/ubuntu/"
+	DefaultDebianSnapshotURL    = "https://snapshot.debian.org/"
+	DefaultLaunchpadURL         = "https://launchpad.net/"
+	DefaultLaunchpadAPIURL      = "https://api.launchpad.net/1.0/"
+)
+
+// ArchiveFallbacks holds the base URLs of the archives used when the headers
+// package has been removed from the configured mirrors, which is common for
+// older kernels and EOL releases. They can point at internal mirrors.
+type ArchiveFallbacks struct {
+	// UbuntuOldReleasesURL is the archive of EOL Ubuntu releases
+	UbuntuOldReleasesURL string
+	// DebianSnapshotURL is the root of snapshot.debian.org, providing both
+	// the `mr` lookup API and the timestamped archives
+	DebianSnapshotURL string
+	// LaunchpadURL serves the `+files/` librarian URLs of Ubuntu packages
+	LaunchpadURL string
+	// LaunchpadAPIURL is used to find the published versions of Ubuntu packages
+	// and their checksums
+	LaunchpadAPIURL string
+	// AllowUnverifiedLaunchpad accepts the Launchpad packages whose checksum
+	// cannot be retrieved from the API. Those packages are skipped otherwise.
+	AllowUnverifiedLaunchpad bool
+}
+
+// DefaultArchiveFallbacks returns the public archives
+func DefaultArchiveFallbacks() ArchiveFallbacks {
+	return ArchiveFallbacks{
+		UbuntuOldReleasesURL: DefaultUbuntuOldReleasesURL,
+		DebianSnapshotURL:    DefaultDebianSnapshotURL,
+		LaunchpadURL:         DefaultLaunchpadURL,
+		LaunchpadAPIURL:      DefaultLaunchpadAPIURL,
+	}
+}
+
+// EnableArchiveFallbacks makes the backend look into the archives when the
+// headers package cannot be found in the configured repositories
+func (b *Backend) EnableArchiveFallbacks(fallbacks ArchiveFallbacks) {
+	for _, u := range []*string{&fallbacks.UbuntuOldReleasesURL, &fallbacks.DebianSnapshotURL, &fallbacks.LaunchpadURL, &fallbacks.LaunchpadAPIURL} {
+		if !strings.HasSuffix(*u, "/") {
+			*u += "/"
+		}
+	}
+	b.archiveFallbacks = &fallbacks
+}
+
+// fetchArchiveRepositories returns the archive repositories that may contain the package.
+// Archives are best effort, those failing to be fetched are skipped.
+func (b *Backend) fetchArchiveRepositories(downloader aptly.Downloader, verifier pgp.Verifier, pkgName string, keep func(*deb.Package) bool) []indexedRepo {
+	codename := b.target.OSRelease["VERSION_CODENAME"]
+	if codename == "" {
+		b.logger.Warnf("No VERSION_CODENAME in os-release, archive fallbacks are not available")
+		return nil
+	}
+
+	var archiveRepos []remoteRepo
+	switch b.target.Distro.Display {
+	case "ubuntu":
+		archiveRepos = b.ubuntuOldReleasesRepos(codename)
+	case "debian":
+		snapshotRepos, err := b.debianSnapshotRepos(downloader, pkgName, codename)
+		if err != nil {
+			b.logger.Warnf("Failed to look up %s on snapshot.debian.org: %s", pkgName, err)
+		}
+		archiveRepos = snapshotRepos
+	default:
+		b.logger.Warnf("No archive fallback for distribution %s", b.target.Distro.Display)
+		return nil
+	}
+
+	var repos []indexedRepo
+	for _, repoInfo := range archiveRepos {
+		repo, err := deb.NewRemoteRepo(repoInfo.repoID, repoInfo.uri, repoInfo.distribution, repoInfo.components, []string{b.debArch}, false, false, false)
+		if err != nil {
+			b.logger.Errorf("Failed to create remote repo: %s", err)
+			continue
+		}
+
+		ir, err := b.fetchRepository(repo, downloader, verifier, keep)
+		if err != nil {
+			b.logger.Infof("Skipping archive repository %s %s: %s", repoInfo.uri, repoInfo.distribution, err)
+			continue
+		}
+		repos = append(repos, ir)
+	}
+
+	if b.target.Distro.Display == "ubuntu" {
+		if lp, err := b.launchpadRepo(downloader, codename); err != nil {
+			b.logger.Warnf("Failed to set up Launchpad fallback: %s", err)
+		} else {
+			repos = append(repos, lp)
+		}
+	}
+
+	return repos
+}
+
+func (b *Backend) ubuntuOldReleasesRepos(codename string) []remoteRepo {
+	var repos []remoteRepo
+	for _, suite := range []string{codename, codename + "-updates", codename + "-security"} {
+		repos = append(repos, remoteRepo{
+			repoID:       "old-releases-" + suite,
+			uri:          b.archiveFallbacks.UbuntuOldReleasesURL,
+			distribution: suite,
+			components:   []string{"main", "restricted", "universe", "multiverse"},
+		})
+	}
+	return repos
+}
+
+type snapshotBinaryVersions struct {
+	Result []struct {
+		BinaryVersion string `json:"binary_version"`
+	} `json:"result"`
+}
+
+type snapshotBinFiles struct {
+	Result []struct {
+		Architecture string `json:"architecture"`
+		Hash         string `json:"hash"`
+	} `json:"result"`
+	FileInfo map[string][]struct {
+		ArchiveName string `json:"archive_name"`
+		FirstSeen   string `json:"first_seen"`
+	} `json:"fileinfo"`
+}
+
+// debianSnapshotRepos looks up when the package was first published, and returns
+// the snapshot.debian.org repositories frozen at that time
+func (b *Backend) debianSnapshotRepos(downloader aptly.Downloader, pkgName, codename string) ([]remoteRepo, error) {
+	snapshotURL := b.archiveFallbacks.DebianSnapshotURL
+
+	var versions snapshotBinaryVersions
+	if err := getJSON(downloader, fmt.Sprintf("%smr/binary/%s/", snapshotURL, url.PathEscape(pkgName)), &versions); err != nil {
+		return nil, err
+	}
+	if len(versions.Result) == 0 {
+		return nil, fmt.Errorf("no version of %s found", pkgName)
+	}
+
+	sort.Slice(versions.Result, func(i, j int) bool {
+		return deb.CompareVersions(versions.Result[i].BinaryVersion, versions.Result[j].BinaryVersion) > 0
+	})
+	version := versions.Result[0].BinaryVersion
+
+	var binFiles snapshotBinFiles
+	binFilesURL := fmt.Sprintf("%smr/binary/%s/%s/binfiles?fileinfo=1", snapshotURL, url.PathEscape(pkgName), url.PathEscape(version))
+	if err := getJSON(downloader, binFilesURL, &binFiles); err != nil {
+		return nil, err
+	}
+
+	var repos []remoteRepo
+	seen := make(map[string]bool)
+	for _, file := range binFiles.Result {
+		if file.Architecture != b.debArch && file.Architecture != "all" {
+			continue
+		}
+
+		for _, info := range binFiles.FileInfo[file.Hash] {
+			var suites []string
+			switch info.ArchiveName {
+			case "debian":
+				suites = []string{codename, codename + "-updates", codename + "-proposed-updates"}
+			case "debian-security":
+				suites = []string{debianSecuritySuite(codename)}
+			default:
+				continue
+			}
+
+			uri := fmt.Sprintf("%sarchive/%s/%s/", snapshotURL, info.ArchiveName, info.FirstSeen)
+			if seen[uri] {
+				continue
+			}
+			seen[uri] = true
+
+			b.logger.Infof("Found %s %s in snapshot %s", pkgName, version, uri)
+			for _, suite := range suites {
+				repos = append(repos, remoteRepo{
+					repoID:       fmt.Sprintf("snapshot-%s-%s-%s", info.ArchiveName, info.FirstSeen, suite),
+					uri:          uri,
+					distribution: suite,
+					components:   []string{"main"},
+				})
+			}
+		}
+	}
+
+	return repos, nil
+}
+
+// debianSecuritySuite returns the security suite name, which changed with bullseye
+func debianSecuritySuite(codename string) string {
+	switch codename {
+	case "jessie", "stretch", "buster":
+		return codename + "/updates"
+	default:
+		return codename + "-security"
+	}
+}
+
+type launchpadBinaries struct {
+	Entries []struct {
+		BinaryPackageName    string `json:"binary_package_name"`
+		BinaryPackageVersion string `json:"binary_package_version"`
+		ArchitectureSpecific bool   `json:"architecture_specific"`
+		SelfLink             string `json:"self_link"`
+	} `json:"entries"`
+}
+
+// launchpadFile is an entry of the `binaryFileUrls` API with `include_meta`
+type launchpadFile struct {
+	URL    string `json:"url"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// launchpadRepo returns a repository without indexes, whose packages are looked
+// up on demand with the Launchpad API and downloaded from the librarian
+func (b *Backend) launchpadRepo(downloader aptly.Downloader, codename string) (indexedRepo, error) {
+	repo, err := deb.NewRemoteRepo("launchpad", b.archiveFallbacks.LaunchpadURL, codename, nil, []string{b.debArch}, false, false, false)
+	if err != nil {
+		return indexedRepo{}, err
+	}
+
+	packages := deb.NewPackageList()
+	packages.PrepareIndex()
+
+	queried := make(map[string]bool)
+	load := func(dep deb.Dependency) {
+		if queried[dep.Pkg] {
+			return
+		}
+		queried[dep.Pkg] = true
+
+		pkg, err := b.fetchLaunchpadPackage(downloader, codename, dep)
+		if err != nil {
+			b.logger.Debugf("Failed to find %s on Launchpad: %s", dep.Pkg, err)
+			return
+		}
+		packages.Add(pkg)
+	}
+
+	return indexedRepo{repo: repo, packages: packages, load: load}, nil
+}
+
+func (b *Backend) fetchLaunchpadPackage(downloader aptly.Downloader, codename string, dep deb.Dependency) (*deb.Package, error) {
+	apiURL := b.archiveFallbacks.LaunchpadAPIURL
+	query := url.Values{}
+	query.Set("ws.op", "getPublishedBinaries")
+	query.Set("binary_name", dep.Pkg)
+	query.Set("exact_match", "true")
+	query.Set("distro_arch_series", fmt.Sprintf("%subuntu/%s/%s", apiURL, codename, b.debArch))
+
+	var binaries launchpadBinaries
+	if err := getJSON(downloader, fmt.Sprintf("%subuntu/+archive/primary?%s", apiURL, query.Encode()), &binaries); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(binaries.Entries, func(i, j int) bool {
+		return deb.CompareVersions(binaries.Entries[i].BinaryPackageVersion, binaries.Entries[j].BinaryPackageVersion) > 0
+	})
+
+	for _, entry := range binaries.Entries {
+		arch := "all"
+		if entry.ArchitectureSpecific {
+			arch = b.debArch
+		}
+
+		// check the version before downloading anything
+		candidate := &deb.Package{Name: entry.BinaryPackageName, Version: entry.BinaryPackageVersion, Architecture: arch}
+		if !candidate.MatchesDependency(dep) {
+			continue
+		}
+
+		// the file name does not contain the epoch
+		_, fileVersion, found := strings.Cut(entry.BinaryPackageVersion, ":")
+		if !found {
+			fileVersion = entry.BinaryPackageVersion
+		}
+		filename := fmt.Sprintf("ubuntu/+archive/primary/+files/%s_%s_%s.deb", entry.BinaryPackageName, fileVersion, arch)
+
+		checksums, err := b.launchpadChecksums(downloader, entry.SelfLink, path.Base(filename))
+		if err != nil {
+			if !b.archiveFallbacks.AllowUnverifiedLaunchpad {
+				b.logger.Infof("Skipping %s from Launchpad, its checksum is not available: %s", filename, err)
+				continue
+			}
+			b.logger.Warnf("Using %s from Launchpad without checksum verification: %s", filename, err)
+		}
+
+		stanza, err := b.prefetchPackage(downloader, b.archiveFallbacks.LaunchpadURL+filename, checksums)
+		if err != nil {
+			b.logger.Debugf("Failed to fetch %s from Launchpad: %s", filename, err)
+			continue
+		}
+		stanza["Filename"] = filename
+		if checksums != nil {
+			stanza["Size"] = fmt.Sprint(checksums.Size)
+			stanza["SHA256"] = checksums.SHA256
+		}
+
+		return deb.NewPackageFromControlFile(stanza), nil
+	}
+
+	return nil, fmt.Errorf("no published version matches %s", dep.String())
+}
+
+// launchpadChecksums returns the size and SHA256 of a file of a published binary
+func (b *Backend) launchpadChecksums(downloader aptly.Downloader, selfLink, filename string) (*utils.ChecksumInfo, error) {
+	if selfLink == "" {
+		return nil, fmt.Errorf("no link to the publication of %s", filename)
+	}
+
+	// the links returned by the API point at the public instance
+	if rel, found := strings.CutPrefix(selfLink, DefaultLaunchpadAPIURL); found {
+		selfLink = b.archiveFallbacks.LaunchpadAPIURL + rel
+	}
+
+	var files []launchpadFile
+	if err := getJSON(downloader, selfLink+"?ws.op=binaryFileUrls&include_meta=true", &files); err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if path.Base(file.URL) == filename && file.SHA256 != "" {
+			return &utils.ChecksumInfo{Size: file.Size, SHA256: file.SHA256}, nil
+		}
+	}
+	return nil, fmt.Errorf("no SHA256 published for %s", filename)
+}
+
+// prefetchPackage downloads a package to read its control file, the only way to know
+// the dependencies of a package outside of a repository index. The package is kept
+// for downloadPackage.
+func (b *Backend) prefetchPackage(downloader aptly.Downloader, packageURL string, checksums *utils.ChecksumInfo) (deb.Stanza, error) {
+	if b.prefetchDir == "" {
+		var err error
+		if b.prefetchDir, err = os.MkdirTemp("", "nikos-apt-packages"); err != nil {
+			return nil, err
+		}
+	}
+
+	packagePath := filepath.Join(b.prefetchDir, path.Base(packageURL))
+	if err := downloader.DownloadWithChecksum(context.Background(), packageURL, packagePath, checksums, false); err != nil {
+		return nil, err
+	}
+
+	stanza, err := deb.GetControlFileFromDeb(packagePath)
+	if err != nil {
+		os.Remove(packagePath)
+		return nil, err
+	}
+
+	if b.prefetched == nil {
+		b.prefetched = make(map[string]string)
+	}
+	b.prefetched[packageURL] = packagePath
+	return stanza, nil
+}
+
+func getJSON(downloader aptly.Downloader, url string, v interface{}) error {
+	f, err := http.DownloadTemp(context.Background(), downloader, url)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(v)
+}
@@ -0,0 +1,168 @@
+package apt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/aptly/deb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xor-gate/ar"
+
+	"github.com/DataDog/nikos/types"
+)
+
+func tarGz(t *testing.T, name, content string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tarWriter.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzipWriter.Close())
+	return buf.Bytes()
+}
+
+// testDeb returns a .deb package with the given control file and a single data file
+func testDeb(t *testing.T, control string) []byte {
+	var buf bytes.Buffer
+	w := ar.NewWriter(&buf)
+	require.NoError(t, w.WriteGlobalHeader())
+	for _, member := range []struct {
+		name    string
+		content []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", tarGz(t, "./control", control)},
+		{"data.tar.gz", tarGz(t, "Makefile", "all:\n")},
+	} {
+		require.NoError(t, w.WriteHeader(&ar.Header{Name: member.name, Mode: 0644, Size: int64(len(member.content))}))
+		_, err := w.Write(member.content)
+		require.NoError(t, err)
+	}
+	return buf.Bytes()
+}
+
+type launchpadTestEntry struct {
+	name            string
+	sha256          string
+	allowUnverified bool
+	found           bool
+	downloads       int
+}
+
+func TestLaunchpadPackage(t *testing.T) {
+	const (
+		pkgName  = "linux-headers-5.15.0-25-generic"
+		version  = "5.15.0-25.25"
+		filename = pkgName + "_" + version + "_amd64.deb"
+	)
+	content := testDeb(t, "Package: "+pkgName+"\nVersion: "+version+"\nArchitecture: amd64\nDepends: linux-headers-5.15.0-25\n")
+	sum := sha256.Sum256(content)
+
+	testEntries := []launchpadTestEntry{
+		{
+			name:      "verified",
+			sha256:    hex.EncodeToString(sum[:]),
+			found:     true,
+			downloads: 1,
+		},
+		{
+			name:      "checksum mismatch",
+			sha256:    hex.EncodeToString(make([]byte, sha256.Size)),
+			found:     false,
+			downloads: 1,
+		},
+		{
+			name:      "no checksum",
+			found:     false,
+			downloads: 0,
+		},
+		{
+			name:            "no checksum allowed",
+			allowUnverified: true,
+			found:           true,
+			downloads:       1,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			downloads := 0
+			mux := nethttp.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			mux.HandleFunc("/api/ubuntu/+archive/primary", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				assert.Equal(t, "getPublishedBinaries", r.URL.Query().Get("ws.op"))
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"entries": []map[string]interface{}{{
+						"binary_package_name":    pkgName,
+						"binary_package_version": version,
+						"architecture_specific":  true,
+						"self_link":              server.URL + "/api/ubuntu/+archive/primary/+binarypub/1",
+					}},
+				})
+			})
+			mux.HandleFunc("/api/ubuntu/+archive/primary/+binarypub/1", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				assert.Equal(t, "binaryFileUrls", r.URL.Query().Get("ws.op"))
+				file := map[string]interface{}{"url": server.URL + "/ubuntu/+archive/primary/+files/" + filename, "size": len(content)}
+				if testEntry.sha256 != "" {
+					file["sha256"] = testEntry.sha256
+				}
+				json.NewEncoder(w).Encode([]interface{}{file})
+			})
+			mux.HandleFunc("/lp/ubuntu/+archive/primary/+files/"+filename, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+				downloads++
+				w.Write(content)
+			})
+
+			b := &Backend{
+				target:  &types.Target{},
+				logger:  logrus.New(),
+				debArch: "amd64",
+			}
+			defer b.Close()
+			b.EnableArchiveFallbacks(ArchiveFallbacks{
+				LaunchpadURL:             server.URL + "/lp",
+				LaunchpadAPIURL:          server.URL + "/api",
+				AllowUnverifiedLaunchpad: testEntry.allowUnverified,
+			})
+
+			downloader := newDownloader(aptConfig{}, b.logger)
+			lp, err := b.launchpadRepo(downloader, "jammy")
+			require.NoError(t, err)
+
+			resolver := newDependencyResolver([]indexedRepo{lp}, "amd64", nil, nil, b.logger)
+			found := resolver.find(deb.Dependency{Pkg: pkgName, Relation: deb.VersionDontCare})
+			if !testEntry.found {
+				assert.Nil(t, found)
+				assert.Equal(t, testEntry.downloads, downloads)
+				return
+			}
+			require.NotNil(t, found)
+			assert.Equal(t, version, found.pkg.Version)
+			assert.Equal(t, "linux-headers-5.15.0-25", found.pkg.Stanza()["Depends"])
+
+			directory := t.TempDir()
+			require.NoError(t, b.downloadPackage(downloader, found.repo, found.pkg, directory))
+			assert.Equal(t, testEntry.downloads, downloads)
+			assert.FileExists(t, filepath.Join(directory, "Makefile"))
+
+			b.Close()
+			_, err = os.Stat(b.prefetchDir)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
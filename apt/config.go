@@ -4,6 +4,8 @@
 // Fixes:
 // - fix option parsing when no component is provided
 // - remove io/ioutil usage
+// - support deb822 ".sources" files
+// - support custom sources list locations
 
 package apt
 
@@ -29,10 +31,37 @@ type Repository struct {
 	Distribution string
 	Components   string
 	Comment      string
+	// SignedByKey holds an inline armored key from a deb822 `Signed-By` field
+	SignedByKey string
+
+	// Parsed from Options
+	Architectures []string
+	Trusted       bool
+	SignedBy      []string
 
 	configFile string
 }
 
+// parseOptions parses the `[ key=value1,value2 ... ]` options of a repository
+func (r *Repository) parseOptions() {
+	for _, opt := range strings.Fields(r.Options) {
+		name, value, found := strings.Cut(opt, "=")
+		if !found {
+			continue
+		}
+
+		values := strings.Split(value, ",")
+		switch strings.ToLower(name) {
+		case "arch", "architectures":
+			r.Architectures = values
+		case "trusted":
+			r.Trusted = strings.ToLower(value) == "yes"
+		case "signed-by":
+			r.SignedBy = values
+		}
+	}
+}
+
 var aptConfigLineRegexp = regexp.MustCompile(`^(# )?(deb|deb-src)(?: \[(.*)\])? ([^ \[]+) ([^ ]+)(?: ([^#\n]+))?(?: +# *(.*))?$`)
 
 func parseAPTConfigLine(line string) *Repository {
@@ -41,7 +70,7 @@ func parseAPTConfigLine(line string) *Repository {
 		return nil
 	}
 	fields := match[0]
-	return &Repository{
+	repo := &Repository{
 		Enabled:      fields[1] != "# ",
 		SourceRepo:   fields[2] == "deb-src",
 		Options:      fields[3],
@@ -50,6 +79,8 @@ func parseAPTConfigLine(line string) *Repository {
 		Components:   fields[6],
 		Comment:      fields[7],
 	}
+	repo.parseOptions()
+	return repo
 }
 
 func parseAPTConfigFile(configPath string) (RepositoryList, error) {
@@ -71,26 +102,36 @@ func parseAPTConfigFile(configPath string) (RepositoryList, error) {
 	return res, nil
 }
 
-// parseAPTConfigFolder scans an APT config folder (usually /etc/apt) to
-// get information about all configured repositories, it scans also
-// "source.list.d" subfolder to find all the "*.list" files.
-func parseAPTConfigFolder(folderPath string) (RepositoryList, error) {
-	sources := []string{filepath.Join(folderPath, "sources.list")}
+// parseAPTSources gets information about all configured repositories from the
+// sources list file (usually /etc/apt/sources.list), it scans also the sources
+// parts folder (usually /etc/apt/sources.list.d) to find all the "*.list" and
+// deb822 "*.sources" files.
+func parseAPTSources(sourcesList, sourcesFolder string) (RepositoryList, error) {
+	var sources []string
+
+	// recent Debian and Ubuntu releases only ship deb822 sources
+	if _, err := os.Stat(sourcesList); err == nil {
+		sources = append(sources, sourcesList)
+	}
 
-	sourcesFolder := filepath.Join(folderPath, "sources.list.d")
 	list, err := os.ReadDir(sourcesFolder)
 	if err != nil {
 		return nil, fmt.Errorf("Reading %s folder: %s", sourcesFolder, err)
 	}
 	for _, l := range list {
-		if strings.HasSuffix(l.Name(), ".list") {
+		if strings.HasSuffix(l.Name(), ".list") || strings.HasSuffix(l.Name(), ".sources") {
 			sources = append(sources, filepath.Join(sourcesFolder, l.Name()))
 		}
 	}
 
 	res := RepositoryList{}
 	for _, source := range sources {
-		repos, err := parseAPTConfigFile(source)
+		parse := parseAPTConfigFile
+		if strings.HasSuffix(source, ".sources") {
+			parse = parseDeb822ConfigFile
+		}
+
+		repos, err := parse(source)
 		if err != nil {
 			return nil, fmt.Errorf("Parsing %s: %s", source, err)
 		}
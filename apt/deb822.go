@@ -0,0 +1,162 @@
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// deb822Stanza is a single paragraph of a deb822 file, with field names lowercased
+type deb822Stanza map[string]string
+
+// parseDeb822 splits a deb822 document into stanzas. Multi-line field values are joined
+// with '\n', and a continuation line containing only " ." is turned into an empty line,
+// as used by inline armored keys in `Signed-By`.
+func parseDeb822(data []byte) ([]deb822Stanza, error) {
+	var (
+		stanzas   []deb822Stanza
+		current   deb822Stanza
+		lastField string
+	)
+
+	flush := func() {
+		if len(current) != 0 {
+			stanzas = append(stanzas, current)
+		}
+		current = nil
+		lastField = ""
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastField == "" {
+				return nil, fmt.Errorf("line %d: continuation line without a field", lineNo)
+			}
+
+			value := strings.TrimSpace(line)
+			if value == "." {
+				value = ""
+			}
+			current[lastField] += "\n" + value
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected `Field: value`", lineNo)
+		}
+
+		if current == nil {
+			current = make(deb822Stanza)
+		}
+		lastField = strings.ToLower(strings.TrimSpace(name))
+		current[lastField] = strings.TrimSpace(value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	flush()
+	return stanzas, nil
+}
+
+func (s deb822Stanza) list(field string) []string {
+	return strings.Fields(s[field])
+}
+
+func (s deb822Stanza) boolean(field string, dfault bool) bool {
+	switch strings.ToLower(strings.TrimSpace(s[field])) {
+	case "yes", "true", "1":
+		return true
+	case "no", "false", "0":
+		return false
+	default:
+		return dfault
+	}
+}
+
+// repositories expands a deb822 stanza into one Repository per type, URI and suite.
+// Options are serialized the same way as in the one-line format so that both formats
+// can be handled identically afterwards.
+func (s deb822Stanza) repositories() RepositoryList {
+	var options []string
+	if archs := s.list("architectures"); len(archs) != 0 {
+		options = append(options, "arch="+strings.Join(archs, ","))
+	}
+	if trusted, ok := s["trusted"]; ok {
+		options = append(options, "trusted="+strings.ToLower(trusted))
+	}
+
+	var signedByKey string
+	if signedBy := s["signed-by"]; signedBy != "" {
+		if strings.Contains(signedBy, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+			signedByKey = strings.TrimSpace(signedBy)
+		} else {
+			options = append(options, "signed-by="+strings.Join(strings.Fields(signedBy), ","))
+		}
+	}
+
+	enabled := s.boolean("enabled", true)
+	components := strings.Join(s.list("components"), " ")
+
+	res := RepositoryList{}
+	for _, repoType := range s.list("types") {
+		if repoType != "deb" && repoType != "deb-src" {
+			continue
+		}
+
+		for _, uri := range s.list("uris") {
+			for _, suite := range s.list("suites") {
+				repo := &Repository{
+					Enabled:      enabled,
+					SourceRepo:   repoType == "deb-src",
+					Options:      strings.Join(options, " "),
+					URI:          uri,
+					Distribution: suite,
+					Components:   components,
+					SignedByKey:  signedByKey,
+				}
+				repo.parseOptions()
+				res = append(res, repo)
+			}
+		}
+	}
+	return res
+}
+
+// parseDeb822ConfigFile parses a deb822 style `.sources` file
+func parseDeb822ConfigFile(configPath string) (RepositoryList, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %s", configPath, err)
+	}
+
+	stanzas, err := parseDeb822(data)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing %s: %s", configPath, err)
+	}
+
+	res := RepositoryList{}
+	for _, stanza := range stanzas {
+		for _, repo := range stanza.repositories() {
+			repo.configFile = configPath
+			res = append(res, repo)
+		}
+	}
+	return res, nil
+}
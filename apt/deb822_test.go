@@ -0,0 +1,206 @@
+package apt
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deb822TestEntry struct {
+	name     string
+	input    string
+	expected []deb822Stanza
+	err      bool
+}
+
+func TestParseDeb822(t *testing.T) {
+	testEntries := []deb822TestEntry{
+		{
+			name:  "single stanza",
+			input: "Types: deb\nURIs: http://archive.ubuntu.com/ubuntu\nSuites: noble noble-updates\n",
+			expected: []deb822Stanza{
+				{"types": "deb", "uris": "http://archive.ubuntu.com/ubuntu", "suites": "noble noble-updates"},
+			},
+		},
+		{
+			name:  "multiple stanzas",
+			input: "Types: deb\nSuites: noble\n\n\nTypes: deb-src\nSuites: noble\n",
+			expected: []deb822Stanza{
+				{"types": "deb", "suites": "noble"},
+				{"types": "deb-src", "suites": "noble"},
+			},
+		},
+		{
+			name:  "comments",
+			input: "# Ubuntu sources\nTypes: deb\n# Suites: jammy\nSuites: noble\n",
+			expected: []deb822Stanza{
+				{"types": "deb", "suites": "noble"},
+			},
+		},
+		{
+			name:  "case insensitive field names",
+			input: "TYPES: deb\nsuites: noble\nSigned-BY: /usr/share/keyrings/ubuntu-archive-keyring.gpg\n",
+			expected: []deb822Stanza{
+				{"types": "deb", "suites": "noble", "signed-by": "/usr/share/keyrings/ubuntu-archive-keyring.gpg"},
+			},
+		},
+		{
+			name:  "continuation lines",
+			input: "Types: deb\nSuites: noble\n noble-updates\n\tnoble-security\nComponents:\n main\n .\n universe\n",
+			expected: []deb822Stanza{
+				{"types": "deb", "suites": "noble\nnoble-updates\nnoble-security", "components": "\nmain\n\nuniverse"},
+			},
+		},
+		{
+			name:     "empty",
+			input:    "\n# nothing\n\n",
+			expected: nil,
+		},
+		{
+			name:  "continuation without field",
+			input: " deb\nTypes: deb\n",
+			err:   true,
+		},
+		{
+			name:  "missing colon",
+			input: "Types deb\n",
+			err:   true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			stanzas, err := parseDeb822([]byte(testEntry.input))
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, stanzas)
+		})
+	}
+}
+
+type deb822RepositoriesTestEntry struct {
+	name     string
+	stanza   deb822Stanza
+	expected []Repository
+}
+
+func TestDeb822Repositories(t *testing.T) {
+	testEntries := []deb822RepositoriesTestEntry{
+		{
+			name: "types, uris and suites",
+			stanza: deb822Stanza{
+				"types":      "deb deb-src",
+				"uris":       "http://archive.ubuntu.com/ubuntu",
+				"suites":     "noble noble-updates",
+				"components": "main\nuniverse",
+			},
+			expected: []Repository{
+				{Enabled: true, URI: "http://archive.ubuntu.com/ubuntu", Distribution: "noble", Components: "main universe"},
+				{Enabled: true, URI: "http://archive.ubuntu.com/ubuntu", Distribution: "noble-updates", Components: "main universe"},
+				{Enabled: true, SourceRepo: true, URI: "http://archive.ubuntu.com/ubuntu", Distribution: "noble", Components: "main universe"},
+				{Enabled: true, SourceRepo: true, URI: "http://archive.ubuntu.com/ubuntu", Distribution: "noble-updates", Components: "main universe"},
+			},
+		},
+		{
+			name: "options",
+			stanza: deb822Stanza{
+				"types":         "deb",
+				"uris":          "https://example.com/debian",
+				"suites":        "stable",
+				"components":    "main",
+				"enabled":       "no",
+				"architectures": "amd64 arm64",
+				"trusted":       "Yes",
+				"signed-by":     "/etc/apt/keyrings/a.gpg\n/etc/apt/keyrings/b.gpg",
+			},
+			expected: []Repository{
+				{
+					Options:       "arch=amd64,arm64 trusted=yes signed-by=/etc/apt/keyrings/a.gpg,/etc/apt/keyrings/b.gpg",
+					URI:           "https://example.com/debian",
+					Distribution:  "stable",
+					Components:    "main",
+					Architectures: []string{"amd64", "arm64"},
+					Trusted:       true,
+					SignedBy:      []string{"/etc/apt/keyrings/a.gpg", "/etc/apt/keyrings/b.gpg"},
+				},
+			},
+		},
+		{
+			name: "unknown type",
+			stanza: deb822Stanza{
+				"types":  "rpm",
+				"uris":   "https://example.com/debian",
+				"suites": "stable",
+			},
+			expected: nil,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			var repos []Repository
+			for _, repo := range testEntry.stanza.repositories() {
+				repos = append(repos, *repo)
+			}
+			assert.Equal(t, testEntry.expected, repos)
+		})
+	}
+}
+
+// armoredPublicKey returns a new public key in the armored format, and its fingerprint
+func armoredPublicKey(t *testing.T) (string, []byte) {
+	entity, err := openpgp.NewEntity("nikos", "test", "nikos@example.com", nil)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(w))
+	require.NoError(t, w.Close())
+	return buf.String(), entity.PrimaryKey.Fingerprint
+}
+
+func TestDeb822InlineSignedBy(t *testing.T) {
+	armored, fingerprint := armoredPublicKey(t)
+
+	// the key is embedded in the field, with " ." for its empty lines
+	var signedBy strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(armored), "\n") {
+		if line == "" {
+			line = "."
+		}
+		signedBy.WriteString(" " + line + "\n")
+	}
+	content := "Types: deb\nURIs: https://example.com/debian\nSuites: stable\nComponents: main\nSigned-By:\n" + signedBy.String()
+
+	stanzas, err := parseDeb822([]byte(content))
+	require.NoError(t, err)
+	require.Len(t, stanzas, 1)
+
+	repos := stanzas[0].repositories()
+	require.Len(t, repos, 1)
+	assert.Empty(t, repos[0].SignedBy)
+	assert.Equal(t, strings.TrimSpace(armored), repos[0].SignedByKey)
+
+	b := &Backend{keyringDir: t.TempDir()}
+	keyring, err := b.dearmorKeyring("inline", strings.NewReader(repos[0].SignedByKey))
+	require.NoError(t, err)
+
+	f, err := os.Open(keyring)
+	require.NoError(t, err)
+	defer f.Close()
+
+	entities, err := openpgp.ReadKeyRing(f)
+	require.NoError(t, err)
+	require.Len(t, entities, 1)
+	assert.Equal(t, fingerprint, entities[0].PrimaryKey.Fingerprint)
+}
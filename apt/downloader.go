@@ -0,0 +1,342 @@
+package apt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/aptly/aptly"
+	"github.com/DataDog/aptly/http"
+	"github.com/DataDog/aptly/utils"
+
+	"github.com/DataDog/nikos/types"
+)
+
+const (
+	defaultAcquireTimeout = 30 * time.Second
+	maxRetryDelay         = 30 * time.Second
+)
+
+var _ aptly.Downloader = (*downloader)(nil)
+
+// downloader is an aptly.Downloader honoring the Acquire options of apt.conf:
+// retries, timeouts and TLS settings, which can be set per host
+type downloader struct {
+	conf     aptConfig
+	logger   types.Logger
+	maxTries int
+
+	lock    sync.Mutex
+	clients map[string]*nethttp.Client
+}
+
+func newDownloader(conf aptConfig, logger types.Logger) *downloader {
+	return &downloader{
+		conf:     conf,
+		logger:   logger,
+		maxTries: conf.integer("acquire::retries", 0) + 1,
+		clients:  make(map[string]*nethttp.Client),
+	}
+}
+
+// client returns the HTTP client for a host, created on first use
+func (d *downloader) client(u *url.URL) (*nethttp.Client, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := u.Scheme + "://" + u.Host
+	if client, found := d.clients[key]; found {
+		return client, nil
+	}
+
+	host := u.Hostname()
+	timeout := d.conf.timeout(u.Scheme, host)
+
+	transport := &nethttp.Transport{
+		Proxy: nethttp.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableCompression:    true,
+	}
+
+	if u.Scheme == "https" {
+		tlsConfig, err := d.tlsConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	client := &nethttp.Client{Transport: transport}
+	d.clients[key] = client
+	return client, nil
+}
+
+// tlsConfig builds the TLS configuration from the `Acquire::https` options
+func (d *downloader) tlsConfig(host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if !parseBool(d.conf.hostOption("https", host, "verify-peer", ""), true) {
+		d.logger.Warnf("Peer verification disabled for %s", host)
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if caInfo := d.conf.hostOption("https", host, "cainfo", ""); caInfo != "" {
+		pem, err := os.ReadFile(hostPath(caInfo))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file for %s: %w", host, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caInfo)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	sslCert := d.conf.hostOption("https", host, "sslcert", "")
+	sslKey := d.conf.hostOption("https", host, "sslkey", "")
+	if sslCert != "" && sslKey != "" {
+		cert, err := tls.LoadX509KeyPair(hostPath(sslCert), hostPath(sslKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate for %s: %w", host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// GetProgress returns nil, progress is not reported
+func (d *downloader) GetProgress() aptly.Progress {
+	return nil
+}
+
+// GetLength returns the size of the file at the given URL
+func (d *downloader) GetLength(ctx context.Context, url string) (int64, error) {
+	if isLocalURI(url) {
+		f, err := openLocal(url)
+		if err != nil {
+			return -1, err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return -1, err
+		}
+		return info.Size(), nil
+	}
+
+	client, req, err := d.newRequest(ctx, "HEAD", url)
+	if err != nil {
+		return -1, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1, fmt.Errorf("%s: %w", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return -1, &http.Error{Code: resp.StatusCode, URL: url}
+	}
+	if resp.ContentLength < 0 {
+		return -1, fmt.Errorf("could not determine length of %s", url)
+	}
+	return resp.ContentLength, nil
+}
+
+// Download downloads the file at the given URL to destination
+func (d *downloader) Download(ctx context.Context, url string, destination string) error {
+	return d.DownloadWithChecksum(ctx, url, destination, nil, false)
+}
+
+// DownloadWithChecksum downloads the file at the given URL to destination and checks
+// its checksums, retrying `Acquire::Retries` times with an exponential backoff
+func (d *downloader) DownloadWithChecksum(ctx context.Context, url string, destination string, expected *utils.ChecksumInfo, ignoreMismatch bool) error {
+	var (
+		temppath string
+		err      error
+	)
+
+	delay := time.Second
+	for try := 1; try <= d.maxTries; try++ {
+		if try > 1 {
+			d.logger.Debugf("Retrying %s in %s (%d/%d): %s", url, delay, try, d.maxTries, err)
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+
+		if temppath, err = d.download(ctx, url, destination, expected, ignoreMismatch); err == nil || !retryable(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(temppath, destination); err != nil {
+		os.Remove(temppath)
+		return fmt.Errorf("%s: %w", url, err)
+	}
+	return nil
+}
+
+// retryable reports whether a download may succeed when retried, client errors
+// such as 404 are not
+func retryable(err error) bool {
+	var httpErr *http.Error
+	if errors.As(err, &httpErr) {
+		return httpErr.Code >= 500 || httpErr.Code == nethttp.StatusTooManyRequests
+	}
+	return true
+}
+
+func (d *downloader) newRequest(ctx context.Context, method, rawURL string) (*nethttp.Client, *nethttp.Request, error) {
+	req, err := nethttp.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+
+	client, err := d.client(req.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// like aptly, escape '+' as some mirrors backed by object storages decode it as a space
+	if proxyURL, _ := nethttp.ProxyFromEnvironment(req); proxyURL == nil {
+		req.URL.Opaque = strings.ReplaceAll(req.URL.RequestURI(), "+", "%2b")
+		req.URL.RawQuery = ""
+	}
+
+	return client, req, nil
+}
+
+// open returns the content at the given URL
+func (d *downloader) open(ctx context.Context, url string) (io.ReadCloser, error) {
+	if isLocalURI(url) {
+		return openLocal(url)
+	}
+
+	client, req, err := d.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &http.Error{Code: resp.StatusCode, URL: url}
+	}
+	return resp.Body, nil
+}
+
+// isLocalURI reports whether the URI points at the host filesystem, `copy:` behaves
+// like `file:` in apt except for the files being copied into the cache
+func isLocalURI(uri string) bool {
+	return strings.HasPrefix(uri, "file:") || strings.HasPrefix(uri, "copy:")
+}
+
+// openLocal opens a `file:` URL of the host filesystem. Missing files are reported
+// as HTTP 404 errors, so that aptly falls back to other index compressions.
+func openLocal(rawURL string) (*os.File, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+
+	f, err := os.Open(hostPath(u.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &http.Error{Code: nethttp.StatusNotFound, URL: rawURL}
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", rawURL, err)
+	}
+	return f, nil
+}
+
+func (d *downloader) download(ctx context.Context, url, destination string, expected *utils.ChecksumInfo, ignoreMismatch bool) (string, error) {
+	body, err := d.open(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0777); err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+
+	temppath := destination + ".down"
+	outfile, err := os.Create(temppath)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+	defer outfile.Close()
+
+	checksummer := utils.NewChecksumWriter()
+	if _, err := io.Copy(io.MultiWriter(outfile, checksummer), body); err != nil {
+		os.Remove(temppath)
+		return "", fmt.Errorf("%s: %w", url, err)
+	}
+
+	if expected != nil {
+		actual := checksummer.Sum()
+
+		if err := checkChecksum(url, actual, *expected); err != nil {
+			if !ignoreMismatch {
+				os.Remove(temppath)
+				return "", err
+			}
+			d.logger.Warnf("%s", err)
+		} else {
+			// as aptly, update the checksums so that they contain exactly the expected set
+			*expected = actual
+		}
+	}
+
+	return temppath, nil
+}
+
+func checkChecksum(url string, actual, expected utils.ChecksumInfo) error {
+	switch {
+	case actual.Size != expected.Size:
+		return fmt.Errorf("%s: size check mismatch %d != %d", url, actual.Size, expected.Size)
+	case expected.MD5 != "" && actual.MD5 != expected.MD5:
+		return fmt.Errorf("%s: md5 hash mismatch %q != %q", url, actual.MD5, expected.MD5)
+	case expected.SHA1 != "" && actual.SHA1 != expected.SHA1:
+		return fmt.Errorf("%s: sha1 hash mismatch %q != %q", url, actual.SHA1, expected.SHA1)
+	case expected.SHA256 != "" && actual.SHA256 != expected.SHA256:
+		return fmt.Errorf("%s: sha256 hash mismatch %q != %q", url, actual.SHA256, expected.SHA256)
+	case expected.SHA512 != "" && actual.SHA512 != expected.SHA512:
+		return fmt.Errorf("%s: sha512 hash mismatch %q != %q", url, actual.SHA512, expected.SHA512)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/DataDog/aptly/pgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"github.com/DataDog/nikos/types"
+)
+
+// globalKeyrings holds the keyrings used by the repositories without `signed-by`.
+// Keyrings shipped by the distribution only vouch for the distribution archives,
+// and the other keyrings only vouch for third-party repositories. A verifier is
+// nil when no keyring of its kind is installed.
+type globalKeyrings struct {
+	archive    *pgp.GoVerifier
+	thirdParty *pgp.GoVerifier
+}
+
+// archiveKeyringName matches the keyrings installed by the `ubuntu-keyring`,
+// `ubuntu-pro-client` and `debian-archive-keyring` packages for the distribution
+// archives, e.g. `ubuntu-keyring-2018-archive.gpg` or `debian-archive-bookworm-stable.gpg`.
+// Other keyrings of these packages, such as `debian-archive-removed-keys.gpg`, are excluded.
+var archiveKeyringName = regexp.MustCompile(`^(ubuntu-archive-keyring|ubuntu-keyring-\d{4}-archive|ubuntu-(pro|advantage)-[a-z0-9-]+|debian-archive-keyring|debian-archive-[a-z]+-(stable|automatic|security-automatic))\.(gpg|asc)$`)
+
+func isArchiveKeyring(keyring string) bool {
+	return archiveKeyringName.MatchString(filepath.Base(keyring))
+}
+
+func (b *Backend) loadGlobalKeyrings() (*globalKeyrings, error) {
+	var archiveKeyrings, thirdPartyKeyrings []string
+
+	// the legacy trusted.gpg keyring is global by definition, it may contain both the
+	// distribution keys and keys added with `apt-key`
+	legacyKeyring := types.HostEtc("apt", "trusted.gpg")
+	if _, err := os.Stat(legacyKeyring); err == nil {
+		b.logger.Infof("Adding keyring from: %s", legacyKeyring)
+		archiveKeyrings = append(archiveKeyrings, legacyKeyring)
+		thirdPartyKeyrings = append(thirdPartyKeyrings, legacyKeyring)
+	}
+
+	searchPatterns := []string{
+		types.HostEtc("apt", "trusted.gpg.d", "*.gpg"),
+		types.HostEtc("apt", "trusted.gpg.d", "*.asc"),
+		types.HostEtc("apt", "keyrings", "*.gpg"),
+		types.HostEtc("apt", "keyrings", "*.asc"),
+		types.HostRoot("usr", "share", "keyrings", "*.gpg"),
+	}
+	for _, searchPattern := range searchPatterns {
+		matches, err := filepath.Glob(searchPattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find valid apt keyrings: %w", err)
+		}
+		for _, match := range matches {
+			keyring, err := b.loadKeyring(match)
+			if err != nil {
+				b.logger.Warnf("Skipping keyring %s: %s", match, err)
+				continue
+			}
+
+			b.logger.Infof("Adding keyring from: %s", match)
+			if isArchiveKeyring(match) {
+				archiveKeyrings = append(archiveKeyrings, keyring)
+			} else {
+				thirdPartyKeyrings = append(thirdPartyKeyrings, keyring)
+			}
+		}
+	}
+
+	var (
+		keyrings = &globalKeyrings{}
+		err      error
+	)
+	if keyrings.archive, err = newKeyringVerifier(archiveKeyrings); err != nil {
+		return nil, err
+	}
+	if keyrings.thirdParty, err = newKeyringVerifier(thirdPartyKeyrings); err != nil {
+		return nil, err
+	}
+	return keyrings, nil
+}
+
+// newKeyringVerifier returns a verifier using the keyrings, or nil if there are none,
+// as the aptly verifier falls back to the keyring of the user otherwise
+func newKeyringVerifier(keyrings []string) (*pgp.GoVerifier, error) {
+	if len(keyrings) == 0 {
+		return nil, nil
+	}
+
+	verifier := &pgp.GoVerifier{}
+	for _, keyring := range keyrings {
+		verifier.AddKeyring(keyring)
+	}
+	if err := verifier.InitKeyring(); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// scoped returns the verifier of a repository using the global keyrings
+func (k *globalKeyrings) scoped(official bool) pgp.Verifier {
+	v := &scopedVerifier{official: official}
+	// avoid storing typed nil pointers in the interfaces
+	if k.archive != nil {
+		v.archive = k.archive
+	}
+	if k.thirdParty != nil {
+		v.thirdParty = k.thirdParty
+	}
+	return v
+}
+
+// officialHosts are the domains of the distribution archives
+var officialHosts = []string{"ubuntu.com", "debian.org"}
+
+func isOfficialArchive(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+
+	host := u.Hostname()
+	for _, official := range officialHosts {
+		if host == official || strings.HasSuffix(host, "."+official) {
+			return true
+		}
+	}
+	return false
+}
+
+// repoVerifier returns the verifier of a repository: none for trusted repositories,
+// one restricted to its `signed-by` keyrings if any, the scoped global one otherwise
+func (b *Backend) repoVerifier(repo remoteRepo, global *globalKeyrings) (pgp.Verifier, error) {
+	if repo.trusted {
+		b.logger.Infof("Repository %s is trusted, skipping signature verification", repo.repoID)
+		return nil, nil
+	}
+
+	var keyrings []string
+	for _, path := range repo.keyrings {
+		keyring, err := b.loadKeyring(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load keyring %s for repository %s: %w", path, repo.repoID, err)
+		}
+		keyrings = append(keyrings, keyring)
+	}
+
+	if repo.signedByKey != "" {
+		keyring, err := b.dearmorKeyring(repo.repoID, strings.NewReader(repo.signedByKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load inline key for repository %s: %w", repo.repoID, err)
+		}
+		keyrings = append(keyrings, keyring)
+	}
+
+	if len(keyrings) == 0 {
+		return global.scoped(isOfficialArchive(repo.uri)), nil
+	}
+
+	verifier := &pgp.GoVerifier{}
+	for _, keyring := range keyrings {
+		b.logger.Infof("Adding keyring from %s for repository %s", keyring, repo.repoID)
+		verifier.AddKeyring(keyring)
+	}
+	if err := verifier.InitKeyring(); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// loadKeyring returns the path of a binary version of the keyring, which is the
+// only format supported by the aptly verifier
+func (b *Backend) loadKeyring(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header, _ := reader.Peek(len("-----BEGIN"))
+	if filepath.Ext(path) != ".asc" && !bytes.Equal(header, []byte("-----BEGIN")) {
+		return path, nil
+	}
+
+	return b.dearmorKeyring(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), reader)
+}
+
+// dearmorKeyring converts an armored key into a binary keyring file
+func (b *Backend) dearmorKeyring(name string, armoredKey io.Reader) (string, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(armoredKey)
+	if err != nil {
+		return "", err
+	}
+
+	if b.keyringDir == "" {
+		if b.keyringDir, err = os.MkdirTemp("", "nikos-apt-keyrings"); err != nil {
+			return "", err
+		}
+	}
+
+	f, err := os.CreateTemp(b.keyringDir, name+"-*.gpg")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, entity := range entities {
+		if err := entity.Serialize(f); err != nil {
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+var officialOrigins = []string{"Ubuntu", "Debian"}
+
+// releaseOrigin returns the `Origin` field of a Release or InRelease file
+func releaseOrigin(release []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(release))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "-----BEGIN PGP SIGNATURE") {
+			break
+		}
+		if origin, found := strings.CutPrefix(line, "Origin:"); found {
+			return strings.TrimSpace(origin)
+		}
+	}
+	return ""
+}
+
+// scopedVerifier verifies the official archives, and any repository claiming to be one,
+// with the distribution keyrings only. Other repositories are verified with the
+// third-party keyrings only.
+type scopedVerifier struct {
+	archive    pgp.Verifier
+	thirdParty pgp.Verifier
+	official   bool
+}
+
+func (v *scopedVerifier) pick(release []byte) (pgp.Verifier, error) {
+	official := v.official
+	origin := releaseOrigin(release)
+	for _, officialOrigin := range officialOrigins {
+		if origin == officialOrigin {
+			official = true
+		}
+	}
+
+	switch {
+	case official && v.archive == nil:
+		return nil, fmt.Errorf("no distribution keyring to verify release of origin `%s`", origin)
+	case official:
+		return v.archive, nil
+	case v.thirdParty == nil:
+		return nil, fmt.Errorf("no third-party keyring to verify release of origin `%s`", origin)
+	default:
+		return v.thirdParty, nil
+	}
+}
+
+func (v *scopedVerifier) InitKeyring() error {
+	return nil
+}
+
+// AddKeyring does nothing, the global keyrings are loaded by loadGlobalKeyrings
+func (v *scopedVerifier) AddKeyring(keyring string) {
+}
+
+func (v *scopedVerifier) VerifyDetachedSignature(signature, cleartext io.Reader, showKeyTip bool) error {
+	release, err := io.ReadAll(cleartext)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := v.pick(release)
+	if err != nil {
+		return err
+	}
+	return verifier.VerifyDetachedSignature(signature, bytes.NewReader(release), showKeyTip)
+}
+
+// IsClearSigned does not depend on any keyring
+func (v *scopedVerifier) IsClearSigned(clearsigned io.Reader) (bool, error) {
+	return (&pgp.GoVerifier{}).IsClearSigned(clearsigned)
+}
+
+func (v *scopedVerifier) VerifyClearsigned(clearsigned io.Reader, showKeyTip bool) (*pgp.KeyInfo, error) {
+	release, err := io.ReadAll(clearsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := v.pick(release)
+	if err != nil {
+		return nil, err
+	}
+	return verifier.VerifyClearsigned(bytes.NewReader(release), showKeyTip)
+}
+
+// ExtractClearsigned does not verify the signature, and does not depend on any keyring
+func (v *scopedVerifier) ExtractClearsigned(clearsigned io.Reader) (*os.File, error) {
+	return (&pgp.GoVerifier{}).ExtractClearsigned(clearsigned)
+}
@@ -0,0 +1,186 @@
+package apt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/aptly/pgp"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsArchiveKeyring(t *testing.T) {
+	testEntries := map[string]bool{
+		"/usr/share/keyrings/ubuntu-archive-keyring.gpg":                        true,
+		"/etc/apt/trusted.gpg.d/ubuntu-keyring-2012-archive.gpg":                true,
+		"/etc/apt/trusted.gpg.d/ubuntu-keyring-2018-archive.gpg":                true,
+		"/usr/share/keyrings/ubuntu-pro-esm-apps.gpg":                           true,
+		"/etc/apt/trusted.gpg.d/ubuntu-advantage-esm-infra-trusty.gpg":          true,
+		"/usr/share/keyrings/debian-archive-keyring.gpg":                        true,
+		"/etc/apt/trusted.gpg.d/debian-archive-bookworm-stable.asc":             true,
+		"/etc/apt/trusted.gpg.d/debian-archive-bookworm-automatic.gpg":          true,
+		"/etc/apt/trusted.gpg.d/debian-archive-bullseye-security-automatic.gpg": true,
+		"/usr/share/keyrings/debian-archive-removed-keys.gpg":                   false,
+		"/usr/share/keyrings/ubuntu-archive-removed-keys.gpg":                   false,
+		"/usr/share/keyrings/ubuntu-cloudimage-keyring.gpg":                     false,
+		"/etc/apt/trusted.gpg.d/ubuntu-keyring-2012-cdimage.gpg":                false,
+		"/etc/apt/keyrings/debian-multimedia.gpg":                               false,
+		"/etc/apt/keyrings/docker.asc":                                          false,
+		"/usr/share/keyrings/ubuntu-fake-archive.gpg":                           false,
+	}
+
+	for keyring, expected := range testEntries {
+		t.Run(filepath.Base(keyring), func(t *testing.T) {
+			assert.Equal(t, expected, isArchiveKeyring(keyring))
+		})
+	}
+}
+
+// testKeyring returns a new signing key, and a verifier trusting it
+func testKeyring(t *testing.T, name string) (*openpgp.Entity, *pgp.GoVerifier) {
+	entity, err := openpgp.NewEntity(name, "test", name+"@example.com", nil)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), name+".gpg")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, entity.Serialize(f))
+	require.NoError(t, f.Close())
+
+	verifier, err := newKeyringVerifier([]string{path})
+	require.NoError(t, err)
+	return entity, verifier
+}
+
+func clearsignRelease(t *testing.T, signer *openpgp.Entity, release string) []byte {
+	var buf bytes.Buffer
+	w, err := clearsign.Encode(&buf, signer.PrivateKey, nil)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(release))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func detachSignRelease(t *testing.T, signer *openpgp.Entity, release string) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, openpgp.ArmoredDetachSign(&buf, signer, strings.NewReader(release), nil))
+	return buf.Bytes()
+}
+
+type scopedVerifierTestEntry struct {
+	name          string
+	origin        string
+	official      bool
+	signer        *openpgp.Entity
+	noThirdParty  bool
+	expectedValid bool
+}
+
+func TestScopedVerifier(t *testing.T) {
+	archiveKey, archiveVerifier := testKeyring(t, "archive")
+	thirdPartyKey, thirdPartyVerifier := testKeyring(t, "third-party")
+
+	testEntries := []scopedVerifierTestEntry{
+		{
+			name:          "official origin signed by the archive key",
+			origin:        "Ubuntu",
+			signer:        archiveKey,
+			expectedValid: true,
+		},
+		{
+			name:          "official origin signed by a third-party key",
+			origin:        "Debian",
+			signer:        thirdPartyKey,
+			expectedValid: false,
+		},
+		{
+			name:          "third-party origin signed by a third-party key",
+			origin:        "Docker",
+			signer:        thirdPartyKey,
+			expectedValid: true,
+		},
+		{
+			name:          "third-party origin signed by the archive key",
+			origin:        "Docker",
+			signer:        archiveKey,
+			expectedValid: false,
+		},
+		{
+			name:          "official host signed by a third-party key",
+			origin:        "Docker",
+			official:      true,
+			signer:        thirdPartyKey,
+			expectedValid: false,
+		},
+		{
+			name:          "official host signed by the archive key",
+			origin:        "UbuntuESM",
+			official:      true,
+			signer:        archiveKey,
+			expectedValid: true,
+		},
+		{
+			name:          "no third-party keyring",
+			origin:        "Docker",
+			signer:        thirdPartyKey,
+			noThirdParty:  true,
+			expectedValid: false,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			keyrings := &globalKeyrings{archive: archiveVerifier, thirdParty: thirdPartyVerifier}
+			if testEntry.noThirdParty {
+				keyrings.thirdParty = nil
+			}
+			verifier := keyrings.scoped(testEntry.official)
+			release := "Origin: " + testEntry.origin + "\nSuite: stable\n"
+
+			clearsigned := clearsignRelease(t, testEntry.signer, release)
+			isClearSigned, err := verifier.IsClearSigned(bytes.NewReader(clearsigned))
+			require.NoError(t, err)
+			assert.True(t, isClearSigned)
+
+			_, err = verifier.VerifyClearsigned(bytes.NewReader(clearsigned), false)
+			assert.Equal(t, testEntry.expectedValid, err == nil, "clearsigned: %v", err)
+
+			signature := detachSignRelease(t, testEntry.signer, release)
+			err = verifier.VerifyDetachedSignature(bytes.NewReader(signature), strings.NewReader(release), false)
+			assert.Equal(t, testEntry.expectedValid, err == nil, "detached: %v", err)
+		})
+	}
+}
+
+func TestLoadGlobalKeyrings(t *testing.T) {
+	hostRoot := t.TempDir()
+	t.Setenv("HOST_ETC", t.TempDir())
+	t.Setenv("HOST_ROOT", hostRoot)
+
+	archiveKey, _ := testKeyring(t, "archive")
+	keyringsDir := filepath.Join(hostRoot, "usr", "share", "keyrings")
+	require.NoError(t, os.MkdirAll(keyringsDir, 0755))
+	f, err := os.Create(filepath.Join(keyringsDir, "debian-archive-keyring.gpg"))
+	require.NoError(t, err)
+	require.NoError(t, archiveKey.Serialize(f))
+	require.NoError(t, f.Close())
+
+	b := &Backend{logger: logrus.New()}
+	defer b.Close()
+	keyrings, err := b.loadGlobalKeyrings()
+	require.NoError(t, err)
+	assert.NotNil(t, keyrings.archive)
+	assert.Nil(t, keyrings.thirdParty)
+
+	verifier := keyrings.scoped(false)
+	release := "Origin: Docker\nSuite: stable\n"
+	_, err = verifier.VerifyClearsigned(bytes.NewReader(clearsignRelease(t, archiveKey, release)), false)
+	assert.ErrorContains(t, err, "no third-party keyring")
+}
@@ -0,0 +1,190 @@
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/aptly/aptly"
+	"github.com/DataDog/aptly/http"
+)
+
+// mirrorEntry is a line of a mirror list, as used by the apt mirror method:
+// a base URL followed by optional tab separated `key:value` attributes
+type mirrorEntry struct {
+	uri      string
+	priority int
+	weight   int
+	archs    []string
+}
+
+func isMirrorURI(uri string) bool {
+	return strings.HasPrefix(uri, "mirror:") || strings.HasPrefix(uri, "mirror+")
+}
+
+// mirrorListLocation returns where the mirror list of a `mirror://`, `mirror+http(s)://`
+// or `mirror+file:` URI is read from, and whether it is a local file
+func mirrorListLocation(uri string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(uri, "mirror://"):
+		return "http://" + strings.TrimPrefix(uri, "mirror://"), false, nil
+	case strings.HasPrefix(uri, "mirror+file:"):
+		path := strings.TrimPrefix(uri, "mirror+file:")
+		if rest, found := strings.CutPrefix(path, "//"); found {
+			path = rest
+		}
+		return path, true, nil
+	case strings.HasPrefix(uri, "mirror+http://"), strings.HasPrefix(uri, "mirror+https://"):
+		return strings.TrimPrefix(uri, "mirror+"), false, nil
+	default:
+		return "", false, fmt.Errorf("unsupported mirror URI %s", uri)
+	}
+}
+
+// resolveMirrors returns the base URLs to try in order for a repository URI.
+// Mirror URIs are expanded from their mirror list, other URIs are returned as is.
+func (b *Backend) resolveMirrors(downloader aptly.Downloader, uri string) ([]string, error) {
+	if !isMirrorURI(uri) {
+		return []string{uri}, nil
+	}
+
+	location, local, err := mirrorListLocation(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if local {
+		data, err = os.ReadFile(hostPath(location))
+	} else {
+		data, err = downloadMirrorList(downloader, location)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mirror list %s: %w", location, err)
+	}
+
+	entries, err := parseMirrorList(data, b.debArch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mirror list %s: %w", location, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no usable mirror in %s", location)
+	}
+
+	uris := orderMirrors(entries)
+	b.logger.Debugf("Resolved %s to mirrors %v", uri, uris)
+	return uris, nil
+}
+
+func downloadMirrorList(downloader aptly.Downloader, url string) ([]byte, error) {
+	f, err := http.DownloadTemp(context.Background(), downloader, url)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// parseMirrorList reads the entries of a mirror list, skipping those restricted
+// to other architectures. Entries without priority come last.
+func parseMirrorList(data []byte, debArch string) ([]mirrorEntry, error) {
+	var entries []mirrorEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := mirrorEntry{
+			uri:      fields[0],
+			priority: math.MaxInt,
+			weight:   1,
+		}
+
+		for _, attr := range fields[1:] {
+			key, value, _ := strings.Cut(attr, ":")
+			key = strings.ToLower(key)
+			switch key {
+			case "priority", "weight":
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("line %d: invalid %s `%s`", lineNo, key, value)
+				}
+				if key == "priority" {
+					entry.priority = n
+				} else {
+					entry.weight = n
+				}
+			case "arch":
+				entry.archs = append(entry.archs, strings.Split(value, ",")...)
+			}
+		}
+
+		if len(entry.archs) != 0 && !slices.Contains(entry.archs, debArch) {
+			continue
+		}
+		if !strings.HasSuffix(entry.uri, "/") {
+			entry.uri += "/"
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// orderMirrors sorts the mirrors by ascending priority. Mirrors with the same priority
+// are shuffled according to their weight, to spread the load as apt does.
+func orderMirrors(entries []mirrorEntry) []string {
+	groups := make(map[int][]mirrorEntry)
+	var priorities []int
+	for _, entry := range entries {
+		if _, found := groups[entry.priority]; !found {
+			priorities = append(priorities, entry.priority)
+		}
+		groups[entry.priority] = append(groups[entry.priority], entry)
+	}
+	sort.Ints(priorities)
+
+	var uris []string
+	for _, priority := range priorities {
+		group := groups[priority]
+		for len(group) != 0 {
+			i := pickWeighted(group)
+			uris = append(uris, group[i].uri)
+			group = append(group[:i], group[i+1:]...)
+		}
+	}
+	return uris
+}
+
+func pickWeighted(entries []mirrorEntry) int {
+	total := 0
+	for _, entry := range entries {
+		total += entry.weight
+	}
+	if total == 0 {
+		return 0
+	}
+
+	n := rand.IntN(total)
+	for i, entry := range entries {
+		if n < entry.weight {
+			return i
+		}
+		n -= entry.weight
+	}
+	return len(entries) - 1
+}
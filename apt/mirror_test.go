@@ -0,0 +1,138 @@
+package apt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mirrorListTestEntry struct {
+	name     string
+	input    string
+	expected []mirrorEntry
+	err      bool
+}
+
+func TestParseMirrorList(t *testing.T) {
+	testEntries := []mirrorListTestEntry{
+		{
+			name:  "plain",
+			input: "http://archive.ubuntu.com/ubuntu\nhttp://mirror.example.com/ubuntu/\n",
+			expected: []mirrorEntry{
+				{uri: "http://archive.ubuntu.com/ubuntu/", priority: math.MaxInt, weight: 1},
+				{uri: "http://mirror.example.com/ubuntu/", priority: math.MaxInt, weight: 1},
+			},
+		},
+		{
+			name:  "comments and blank lines",
+			input: "# mirrors\n\n  \nhttp://archive.ubuntu.com/ubuntu/\n",
+			expected: []mirrorEntry{
+				{uri: "http://archive.ubuntu.com/ubuntu/", priority: math.MaxInt, weight: 1},
+			},
+		},
+		{
+			name:  "attributes",
+			input: "http://a.example.com/ubuntu/\tpriority:1\tweight:5\nhttp://b.example.com/ubuntu/\tPriority:2\tunknown:x\n",
+			expected: []mirrorEntry{
+				{uri: "http://a.example.com/ubuntu/", priority: 1, weight: 5},
+				{uri: "http://b.example.com/ubuntu/", priority: 2, weight: 1},
+			},
+		},
+		{
+			name:  "architectures",
+			input: "http://a.example.com/ubuntu/\tarch:amd64\nhttp://ports.example.com/ubuntu-ports/\tarch:arm64,armhf\nhttp://b.example.com/ubuntu/\tarch:i386\tarch:amd64\n",
+			expected: []mirrorEntry{
+				{uri: "http://a.example.com/ubuntu/", priority: math.MaxInt, weight: 1, archs: []string{"amd64"}},
+				{uri: "http://b.example.com/ubuntu/", priority: math.MaxInt, weight: 1, archs: []string{"i386", "amd64"}},
+			},
+		},
+		{
+			name:  "invalid priority",
+			input: "http://a.example.com/ubuntu/\tpriority:high\n",
+			err:   true,
+		},
+		{
+			name:  "negative weight",
+			input: "http://a.example.com/ubuntu/\tweight:-1\n",
+			err:   true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			entries, err := parseMirrorList([]byte(testEntry.input), "amd64")
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, entries)
+		})
+	}
+}
+
+func TestOrderMirrors(t *testing.T) {
+	entries := []mirrorEntry{
+		{uri: "http://unprioritized.example.com/", priority: math.MaxInt, weight: 1},
+		{uri: "http://c.example.com/", priority: 2, weight: 1},
+		{uri: "http://a.example.com/", priority: 1, weight: 1},
+		{uri: "http://b.example.com/", priority: 1, weight: 1},
+		{uri: "http://never-first.example.com/", priority: 1, weight: 0},
+	}
+
+	for i := 0; i < 20; i++ {
+		uris := orderMirrors(entries)
+		require.Len(t, uris, len(entries))
+		assert.ElementsMatch(t, []string{"http://a.example.com/", "http://b.example.com/"}, uris[:2])
+		assert.Equal(t, []string{"http://never-first.example.com/", "http://c.example.com/", "http://unprioritized.example.com/"}, uris[2:])
+	}
+}
+
+func TestOrderMirrorsWeight(t *testing.T) {
+	entries := []mirrorEntry{
+		{uri: "http://light.example.com/", priority: 1, weight: 1},
+		{uri: "http://heavy.example.com/", priority: 1, weight: 99},
+	}
+
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		if orderMirrors(entries)[0] == "http://heavy.example.com/" {
+			heavyFirst++
+		}
+	}
+	// the expected count is 990, the threshold leaves a large margin for randomness
+	assert.Greater(t, heavyFirst, 900)
+}
+
+type mirrorListLocationTestEntry struct {
+	uri      string
+	location string
+	local    bool
+	err      bool
+}
+
+func TestMirrorListLocation(t *testing.T) {
+	testEntries := []mirrorListLocationTestEntry{
+		{uri: "mirror://mirrors.ubuntu.com/mirrors.txt", location: "http://mirrors.ubuntu.com/mirrors.txt"},
+		{uri: "mirror+http://mirrors.example.com/list", location: "http://mirrors.example.com/list"},
+		{uri: "mirror+https://mirrors.example.com/list", location: "https://mirrors.example.com/list"},
+		{uri: "mirror+file:/etc/apt/mirrors.txt", location: "/etc/apt/mirrors.txt", local: true},
+		{uri: "mirror+file:///etc/apt/mirrors.txt", location: "/etc/apt/mirrors.txt", local: true},
+		{uri: "mirror+ftp://mirrors.example.com/list", err: true},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.uri, func(t *testing.T) {
+			location, local, err := mirrorListLocation(testEntry.uri)
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.location, location)
+			assert.Equal(t, testEntry.local, local)
+		})
+	}
+}
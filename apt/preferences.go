@@ -0,0 +1,219 @@
+package apt
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/aptly/deb"
+
+	"github.com/DataDog/nikos/types"
+)
+
+const (
+	defaultPinPriority        = 500
+	notAutomaticPinPriority   = 1
+	automaticUpgradesPriority = 100
+)
+
+// pinPreference is a single entry of an apt_preferences(5) file
+type pinPreference struct {
+	packages []string
+	pinType  string
+	pinArgs  string
+	priority int
+}
+
+// parsePreferences reads `preferences` and `preferences.d/*` from the APT config folder.
+// Stanzas that cannot be modelled are skipped, as APT does with invalid records, and
+// so are the files that cannot be read or parsed.
+// The pins for specific packages are returned before the general `Package: *` ones,
+// since APT only uses the general pins when no specific pin matches.
+func parsePreferences(folderPath string, logger types.Logger) ([]pinPreference, error) {
+	var files []string
+	if _, err := os.Stat(filepath.Join(folderPath, "preferences")); err == nil {
+		files = append(files, filepath.Join(folderPath, "preferences"))
+	}
+
+	preferencesFolder := filepath.Join(folderPath, "preferences.d")
+	if list, err := os.ReadDir(preferencesFolder); err == nil {
+		for _, l := range list {
+			// apt ignores files with other extensions, except those without any
+			if ext := filepath.Ext(l.Name()); !l.IsDir() && (ext == "" || ext == ".pref") {
+				files = append(files, filepath.Join(preferencesFolder, l.Name()))
+			}
+		}
+	}
+
+	var res []pinPreference
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warnf("Skipping preferences file %s: %s", file, err)
+			continue
+		}
+
+		stanzas, err := parseDeb822(data)
+		if err != nil {
+			logger.Warnf("Skipping preferences file %s: %s", file, err)
+			continue
+		}
+
+		for _, stanza := range stanzas {
+			pref, err := newPinPreference(stanza)
+			if err != nil {
+				logger.Warnf("Skipping preference in %s: %s", file, err)
+				continue
+			}
+			res = append(res, pref)
+		}
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return !res[i].general() && res[j].general()
+	})
+	return res, nil
+}
+
+func newPinPreference(stanza deb822Stanza) (pinPreference, error) {
+	packages := stanza.list("package")
+	if len(packages) == 0 {
+		return pinPreference{}, fmt.Errorf("no Package field")
+	}
+
+	pinType, pinArgs, _ := strings.Cut(stanza["pin"], " ")
+	priority, err := strconv.Atoi(stanza["pin-priority"])
+	if err != nil || priority == 0 {
+		return pinPreference{}, fmt.Errorf("invalid Pin-Priority `%s`", stanza["pin-priority"])
+	}
+
+	switch pinType {
+	case "release", "origin", "version":
+	default:
+		return pinPreference{}, fmt.Errorf("unsupported Pin `%s`", stanza["pin"])
+	}
+
+	return pinPreference{
+		packages: packages,
+		pinType:  pinType,
+		pinArgs:  strings.TrimSpace(pinArgs),
+		priority: priority,
+	}, nil
+}
+
+// general reports whether the preference is a `Package: *` pin
+func (p *pinPreference) general() bool {
+	for _, pattern := range p.packages {
+		if pattern != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern matches a value against an apt pattern: a glob, or a regular expression between slashes
+func matchPattern(pattern, value string) bool {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		return err == nil && re.MatchString(value)
+	}
+
+	matched, err := filepath.Match(pattern, value)
+	return err == nil && matched
+}
+
+func (p *pinPreference) matchesPackage(pkg *deb.Package) bool {
+	for _, pattern := range p.packages {
+		if matchPattern(pattern, pkg.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *pinPreference) matchesRelease(repo *deb.RemoteRepo) bool {
+	args := strings.Trim(p.pinArgs, "\"")
+	if !strings.Contains(args, "=") {
+		// a bare release name is matched against the archive or codename
+		return matchPattern(args, repo.Meta["Suite"]) || matchPattern(args, repo.Meta["Codename"])
+	}
+
+	for _, arg := range strings.Split(args, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(arg), "=")
+		value = strings.Trim(value, "\"")
+
+		var field []string
+		switch key {
+		case "a", "archive":
+			field = []string{repo.Meta["Suite"]}
+		case "n", "codename":
+			field = []string{repo.Meta["Codename"]}
+		case "v", "version":
+			field = []string{repo.Meta["Version"]}
+		case "o", "origin":
+			field = []string{repo.Meta["Origin"]}
+		case "l", "label":
+			field = []string{repo.Meta["Label"]}
+		case "c", "component":
+			field = repo.Components
+		case "b", "arch":
+			field = repo.Architectures
+		default:
+			return false
+		}
+
+		matched := false
+		for _, f := range field {
+			if matchPattern(value, f) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pinPreference) matches(pkg *deb.Package, repo *deb.RemoteRepo) bool {
+	if !p.matchesPackage(pkg) {
+		return false
+	}
+
+	switch p.pinType {
+	case "release":
+		return p.matchesRelease(repo)
+	case "origin":
+		u, err := url.Parse(repo.ArchiveRoot)
+		return err == nil && matchPattern(strings.Trim(p.pinArgs, "\""), u.Hostname())
+	case "version":
+		return matchPattern(p.pinArgs, pkg.Version)
+	}
+	return false
+}
+
+// pinPriority computes the APT priority of a package version coming from a repository.
+// The first matching preference wins, as in APT, specific pins being ordered before
+// the general ones by parsePreferences. Repositories flagged as `NotAutomatic`
+// (e.g. experimental or backports) get a lower default priority.
+func pinPriority(preferences []pinPreference, pkg *deb.Package, repo *deb.RemoteRepo) int {
+	for i := range preferences {
+		if preferences[i].matches(pkg, repo) {
+			return preferences[i].priority
+		}
+	}
+
+	if strings.EqualFold(repo.Meta["NotAutomatic"], "yes") {
+		if strings.EqualFold(repo.Meta["ButAutomaticUpgrades"], "yes") {
+			return automaticUpgradesPriority
+		}
+		return notAutomaticPinPriority
+	}
+	return defaultPinPriority
+}
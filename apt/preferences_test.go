@@ -0,0 +1,240 @@
+package apt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/aptly/deb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreferences(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "preferences.d"), 0755))
+
+	files := map[string]string{
+		"preferences": "Package: *\nPin: release a=noble-proposed\nPin-Priority: 400\n\n" +
+			"Package: linux-headers-*\nPin: release a=noble-proposed\nPin-Priority: 600\n",
+		"preferences.d/explanation.pref": "Explanation: only a comment\n\n" +
+			"Explanation: pin the kernel\nPackage: linux-* /^linux-kbuild/\nPin: version 6.8.*\nPin-Priority: 1001\n",
+		"preferences.d/unsupported": "Package: *\nPin: source-version 1.0\nPin-Priority: 100\n\n" +
+			"Package: *\nPin: origin \"\"\nPin-Priority: 0\n\n" +
+			"Package: *\nPin: origin apt.example.com\nPin-Priority: -1\n",
+		"preferences.d/ignored.list": "Package: *\nPin: release a=noble\nPin-Priority: 1\n",
+		"preferences.d/malformed": "Package: linux-headers-*\nPin: release a=noble\nPin-Priority: 990\n\n" +
+			"this is not a stanza\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+
+	preferences, err := parsePreferences(dir, logrus.New())
+	require.NoError(t, err)
+	assert.Equal(t, []pinPreference{
+		{packages: []string{"linux-headers-*"}, pinType: "release", pinArgs: "a=noble-proposed", priority: 600},
+		{packages: []string{"linux-*", "/^linux-kbuild/"}, pinType: "version", pinArgs: "6.8.*", priority: 1001},
+		{packages: []string{"*"}, pinType: "release", pinArgs: "a=noble-proposed", priority: 400},
+		{packages: []string{"*"}, pinType: "origin", pinArgs: "apt.example.com", priority: -1},
+	}, preferences)
+}
+
+type pinPriorityTestEntry struct {
+	name        string
+	preferences []pinPreference
+	pkg         string
+	version     string
+	meta        deb.Stanza
+	expected    int
+}
+
+func TestPinPriority(t *testing.T) {
+	noble := deb.Stanza{"Suite": "noble", "Codename": "noble", "Origin": "Ubuntu", "Label": "Ubuntu", "Version": "24.04"}
+	backports := deb.Stanza{"Suite": "noble-backports", "Codename": "noble", "Origin": "Ubuntu", "NotAutomatic": "yes", "ButAutomaticUpgrades": "yes"}
+	experimental := deb.Stanza{"Suite": "experimental", "Codename": "rc-buggy", "Origin": "Debian", "NotAutomatic": "yes"}
+
+	testEntries := []pinPriorityTestEntry{
+		{
+			name:     "default",
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     noble,
+			expected: defaultPinPriority,
+		},
+		{
+			name:     "not automatic",
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     experimental,
+			expected: notAutomaticPinPriority,
+		},
+		{
+			name:     "but automatic upgrades",
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     backports,
+			expected: automaticUpgradesPriority,
+		},
+		{
+			name: "release fields",
+			preferences: []pinPreference{
+				{packages: []string{"*"}, pinType: "release", pinArgs: "o=Ubuntu,a=noble-backports", priority: 990},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     backports,
+			expected: 990,
+		},
+		{
+			name: "release fields mismatch",
+			preferences: []pinPreference{
+				{packages: []string{"*"}, pinType: "release", pinArgs: "o=Ubuntu,a=noble-backports", priority: 990},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     noble,
+			expected: defaultPinPriority,
+		},
+		{
+			name: "bare release name",
+			preferences: []pinPreference{
+				{packages: []string{"*"}, pinType: "release", pinArgs: "rc-buggy", priority: 200},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     experimental,
+			expected: 200,
+		},
+		{
+			name: "origin",
+			preferences: []pinPreference{
+				{packages: []string{"*"}, pinType: "origin", pinArgs: "\"archive.ubuntu.com\"", priority: -10},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     noble,
+			expected: -10,
+		},
+		{
+			name: "version glob",
+			preferences: []pinPreference{
+				{packages: []string{"linux-headers-*"}, pinType: "version", pinArgs: "6.8.0-45.*", priority: 1001},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			version:  "6.8.0-45.45",
+			meta:     noble,
+			expected: 1001,
+		},
+		{
+			name: "package regular expression",
+			preferences: []pinPreference{
+				{packages: []string{"/^linux-(headers|kbuild)-/"}, pinType: "release", pinArgs: "n=noble", priority: 700},
+			},
+			pkg:      "linux-kbuild-6.8",
+			meta:     noble,
+			expected: 700,
+		},
+		{
+			name: "package mismatch",
+			preferences: []pinPreference{
+				{packages: []string{"linux-image-*"}, pinType: "release", pinArgs: "n=noble", priority: 700},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     noble,
+			expected: defaultPinPriority,
+		},
+		{
+			name: "first match",
+			preferences: []pinPreference{
+				{packages: []string{"linux-*"}, pinType: "release", pinArgs: "l=Ubuntu", priority: 600},
+				{packages: []string{"linux-headers-*"}, pinType: "release", pinArgs: "l=Ubuntu", priority: 700},
+			},
+			pkg:      "linux-headers-6.8.0-45",
+			meta:     noble,
+			expected: 600,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			version := testEntry.version
+			if version == "" {
+				version = "6.8.0-45.45"
+			}
+			ir := testIndexedRepo(t, "repo", testEntry.meta, testPackage(testEntry.pkg, version, ""))
+			pkg := ir.packages.Search(deb.Dependency{Pkg: testEntry.pkg}, false)[0]
+			assert.Equal(t, testEntry.expected, pinPriority(testEntry.preferences, pkg, ir.repo))
+		})
+	}
+}
+
+type versionSelectionTestEntry struct {
+	name        string
+	preferences string
+	expected    string
+}
+
+func TestVersionSelection(t *testing.T) {
+	repos := []indexedRepo{
+		testIndexedRepo(t, "noble", deb.Stanza{"Suite": "noble", "Codename": "noble", "Origin": "Ubuntu"},
+			testPackage("linux-kbuild-6.8", "6.8.0-45.45", ""),
+		),
+		testIndexedRepo(t, "noble-proposed", deb.Stanza{"Suite": "noble-proposed", "Codename": "noble", "Origin": "Ubuntu", "NotAutomatic": "yes", "ButAutomaticUpgrades": "yes"},
+			testPackage("linux-kbuild-6.8", "6.8.0-47.47", ""),
+		),
+		testIndexedRepo(t, "ppa", deb.Stanza{"Suite": "noble", "Codename": "noble", "Origin": "LP-PPA-kernel"},
+			testPackage("linux-kbuild-6.8", "6.8.0-46.46~ppa1", ""),
+		),
+	}
+
+	testEntries := []versionSelectionTestEntry{
+		{
+			name:     "highest version with the default priority",
+			expected: "ppa 6.8.0-46.46~ppa1",
+		},
+		{
+			name:        "general pin",
+			preferences: "Package: *\nPin: release a=noble-proposed\nPin-Priority: 500\n",
+			expected:    "noble-proposed 6.8.0-47.47",
+		},
+		{
+			name:        "negative priority",
+			preferences: "Package: *\nPin: release o=LP-PPA-kernel\nPin-Priority: -1\n",
+			expected:    "noble 6.8.0-45.45",
+		},
+		{
+			name: "specific pin takes precedence",
+			preferences: "Package: *\nPin: release o=Ubuntu\nPin-Priority: 900\n\n" +
+				"Package: linux-kbuild-*\nPin: release o=LP-PPA-kernel\nPin-Priority: 950\n",
+			expected: "ppa 6.8.0-46.46~ppa1",
+		},
+		{
+			name: "specific pin before an earlier general pin",
+			preferences: "Package: *\nPin: release o=LP-PPA-kernel\nPin-Priority: -1\n\n" +
+				"Package: linux-kbuild-6.8\nPin: version 6.8.0-46.*\nPin-Priority: 600\n",
+			expected: "ppa 6.8.0-46.46~ppa1",
+		},
+		{
+			name:        "version pin",
+			preferences: "Package: linux-kbuild-6.8\nPin: version 6.8.0-45.45\nPin-Priority: 1001\n",
+			expected:    "noble 6.8.0-45.45",
+		},
+		{
+			name:        "no candidate",
+			preferences: "Package: *\nPin: version *\nPin-Priority: -1\n",
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "preferences"), []byte(testEntry.preferences), 0644))
+			preferences, err := parsePreferences(dir, logrus.New())
+			require.NoError(t, err)
+
+			resolver := newDependencyResolver(repos, "amd64", nil, preferences, logrus.New())
+			found := resolver.find(deb.Dependency{Pkg: "linux-kbuild-6.8", Relation: deb.VersionDontCare})
+			if testEntry.expected == "" {
+				assert.Nil(t, found)
+				return
+			}
+			require.NotNil(t, found)
+			assert.Equal(t, testEntry.expected, found.repo.Name+" "+found.pkg.Version)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package apt
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/DataDog/aptly/deb"
+
+	"github.com/DataDog/nikos/types"
+)
+
+// HeadersResult describes the packages downloaded for the kernel headers
+type HeadersResult struct {
+	// Packages lists the downloaded packages, as `name_version`
+	Packages []string
+	// MissingDependencies lists the dependencies matching the dependency filter
+	// that could not be found or downloaded
+	MissingDependencies []string
+}
+
+type resolvedPackage struct {
+	pkg  *deb.Package
+	repo *deb.RemoteRepo
+}
+
+// dependencyResolver walks the dependency graph of a package, following only
+// the dependencies whose name matches the filter
+type dependencyResolver struct {
+	repos       []indexedRepo
+	debArch     string
+	filter      *regexp.Regexp
+	preferences []pinPreference
+	logger      types.Logger
+
+	resolved []resolvedPackage
+	missing  []string
+}
+
+func newDependencyResolver(repos []indexedRepo, debArch string, filter *regexp.Regexp, preferences []pinPreference, logger types.Logger) *dependencyResolver {
+	return &dependencyResolver{
+		repos:       repos,
+		debArch:     debArch,
+		filter:      filter,
+		preferences: preferences,
+		logger:      logger,
+	}
+}
+
+// resolve returns the root package followed by its transitive dependencies.
+// Only the root package is mandatory, unresolvable dependencies are recorded
+// in `missing`.
+func (r *dependencyResolver) resolve(root deb.Dependency) ([]resolvedPackage, error) {
+	rootPkg := r.find(root)
+	if rootPkg == nil {
+		return nil, fmt.Errorf("failed to find package %s", root.Pkg)
+	}
+	r.add(*rootPkg)
+
+	for i := 0; i < len(r.resolved); i++ {
+		pkg := r.resolved[i].pkg
+		deps := pkg.Deps()
+		if deps == nil {
+			continue
+		}
+
+		entries := make([]string, 0, len(deps.PreDepends)+len(deps.Depends))
+		entries = append(entries, deps.PreDepends...)
+		entries = append(entries, deps.Depends...)
+
+		for _, entry := range entries {
+			variants, err := deb.ParseDependencyVariants(entry)
+			if err != nil {
+				r.logger.Warnf("Failed to parse dependency `%s` of %s: %s", entry, pkg.Name, err)
+				continue
+			}
+
+			variants = r.included(variants)
+			if len(variants) == 0 || r.satisfied(variants) {
+				continue
+			}
+
+			if !r.resolveVariants(pkg, variants) {
+				r.logger.Debugf("No package satisfies dependency `%s` of %s", entry, pkg.Name)
+				r.missing = append(r.missing, entry)
+			}
+		}
+	}
+
+	return r.resolved, nil
+}
+
+// resolveVariants adds the first alternative that can be found in the repositories
+func (r *dependencyResolver) resolveVariants(parent *deb.Package, variants []deb.Dependency) bool {
+	for _, variant := range variants {
+		if r.conflicts(variant) {
+			continue
+		}
+
+		if candidate := r.find(variant); candidate != nil {
+			r.logger.Infof("Adding dependency %s %s required by %s", candidate.pkg.Name, candidate.pkg.Version, parent.Name)
+			r.add(*candidate)
+			return true
+		}
+	}
+	return false
+}
+
+func (r *dependencyResolver) add(rp resolvedPackage) {
+	r.resolved = append(r.resolved, rp)
+}
+
+func (r *dependencyResolver) included(variants []deb.Dependency) []deb.Dependency {
+	res := make([]deb.Dependency, 0, len(variants))
+	for _, variant := range variants {
+		if r.filter.MatchString(variant.Pkg) {
+			if variant.Architecture == "" {
+				variant.Architecture = r.debArch
+			}
+			res = append(res, variant)
+		}
+	}
+	return res
+}
+
+// satisfied reports whether an already resolved package satisfies one of the alternatives
+func (r *dependencyResolver) satisfied(variants []deb.Dependency) bool {
+	for _, rp := range r.resolved {
+		for _, variant := range variants {
+			if rp.pkg.MatchesDependency(variant) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// conflicts reports whether a different version of the package is already resolved
+func (r *dependencyResolver) conflicts(variant deb.Dependency) bool {
+	for _, rp := range r.resolved {
+		if rp.pkg.Name == variant.Pkg {
+			r.logger.Debugf("Package %s %s already selected, does not satisfy %s", rp.pkg.Name, rp.pkg.Version, variant.String())
+			return true
+		}
+	}
+	return false
+}
+
+type candidate struct {
+	resolvedPackage
+	priority int
+}
+
+// better reports whether c should be preferred over other: the highest pin
+// priority wins, then the highest version using dpkg ordering
+func (c *candidate) better(other *candidate) bool {
+	if c.priority != other.priority {
+		return c.priority > other.priority
+	}
+	return deb.CompareVersions(c.pkg.Version, other.pkg.Version) > 0
+}
+
+// find collects the packages matching the dependency across all repositories
+// and returns the best one, as APT would select its candidate
+func (r *dependencyResolver) find(dep deb.Dependency) *resolvedPackage {
+	var best *candidate
+	for _, ir := range r.repos {
+		if ir.load != nil {
+			ir.load(dep)
+		}
+
+		for _, pkg := range ir.packages.Search(dep, true) {
+			c := &candidate{
+				resolvedPackage: resolvedPackage{pkg: pkg, repo: ir.repo},
+				priority:        pinPriority(r.preferences, pkg, ir.repo),
+			}
+			r.logger.Infof("Found package %s with version %s in %s (priority %d)", pkg.Name, pkg.Version, ir.repo.Name, c.priority)
+
+			if c.priority < 0 {
+				r.logger.Infof("Rejecting %s %s from %s: negative pin priority", pkg.Name, pkg.Version, ir.repo.Name)
+				continue
+			}
+
+			if best == nil {
+				best = c
+			} else if c.better(best) {
+				r.logger.Infof("Rejecting %s %s from %s: superseded by version %s from %s (priority %d)", best.pkg.Name, best.pkg.Version, best.repo.Name, pkg.Version, ir.repo.Name, c.priority)
+				best = c
+			} else {
+				r.logger.Infof("Rejecting %s %s from %s: superseded by version %s from %s (priority %d)", pkg.Name, pkg.Version, ir.repo.Name, best.pkg.Version, best.repo.Name, best.priority)
+			}
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	r.logger.Infof("Selected %s %s from %s (priority %d)", best.pkg.Name, best.pkg.Version, best.repo.Name, best.priority)
+	return &best.resolvedPackage
+}
@@ -0,0 +1,158 @@
+package apt
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DataDog/aptly/deb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPackage returns the stanza of an amd64 package
+func testPackage(name, version, depends string) deb.Stanza {
+	stanza := deb.Stanza{
+		"Package":      name,
+		"Version":      version,
+		"Architecture": "amd64",
+		"Filename":     "pool/main/l/" + name + "_" + version + "_amd64.deb",
+	}
+	if depends != "" {
+		stanza["Depends"] = depends
+	}
+	return stanza
+}
+
+// testIndexedRepo returns a repository with the given Release fields and packages
+func testIndexedRepo(t *testing.T, name string, meta deb.Stanza, stanzas ...deb.Stanza) indexedRepo {
+	repo, err := deb.NewRemoteRepo(name, "http://archive.ubuntu.com/ubuntu/", "noble", []string{"main"}, []string{"amd64"}, false, false, false)
+	require.NoError(t, err)
+	if meta != nil {
+		repo.Meta = meta
+	}
+
+	packages := deb.NewPackageList()
+	for _, stanza := range stanzas {
+		require.NoError(t, packages.Add(deb.NewPackageFromControlFile(stanza.Copy())))
+	}
+	packages.PrepareIndex()
+	return indexedRepo{repo: repo, packages: packages}
+}
+
+type resolveTestEntry struct {
+	name     string
+	repos    []indexedRepo
+	root     string
+	expected []string
+	missing  []string
+	err      bool
+}
+
+func TestDependencyResolver(t *testing.T) {
+	testEntries := []resolveTestEntry{
+		{
+			name: "transitive dependencies",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil,
+					testPackage("linux-headers-6.8.0-45-generic", "6.8.0-45.45", "linux-headers-6.8.0-45, libc6 (>= 2.34)"),
+					testPackage("linux-headers-6.8.0-45", "6.8.0-45.45", "linux-kbuild-6.8 (>= 6.8)"),
+					testPackage("linux-kbuild-6.8", "6.8.0-45.45", ""),
+					testPackage("libc6", "2.39-0ubuntu8", ""),
+				),
+			},
+			root:     "linux-headers-6.8.0-45-generic",
+			expected: []string{"linux-headers-6.8.0-45-generic_6.8.0-45.45", "linux-headers-6.8.0-45_6.8.0-45.45", "linux-kbuild-6.8_6.8.0-45.45"},
+		},
+		{
+			name: "missing root",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil, testPackage("linux-headers-6.8.0-45", "6.8.0-45.45", "")),
+			},
+			root: "linux-headers-6.8.0-45-generic",
+			err:  true,
+		},
+		{
+			name: "missing dependency",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil,
+					testPackage("linux-headers-6.8.0-45-generic", "6.8.0-45.45", "linux-headers-6.8.0-45 (= 6.8.0-45.45)"),
+				),
+			},
+			root:     "linux-headers-6.8.0-45-generic",
+			expected: []string{"linux-headers-6.8.0-45-generic_6.8.0-45.45"},
+			missing:  []string{"linux-headers-6.8.0-45 (= 6.8.0-45.45)"},
+		},
+		{
+			name: "first available alternative",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil,
+					testPackage("linux-headers-6.1.0-25-amd64", "6.1.106-3", "linux-kbuild-6.1-rt | linux-kbuild-6.1"),
+					testPackage("linux-kbuild-6.1", "6.1.106-3", ""),
+				),
+			},
+			root:     "linux-headers-6.1.0-25-amd64",
+			expected: []string{"linux-headers-6.1.0-25-amd64_6.1.106-3", "linux-kbuild-6.1_6.1.106-3"},
+		},
+		{
+			name: "shared dependency",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil,
+					testPackage("linux-headers-6.1.0-25-amd64", "6.1.106-3", "linux-headers-6.1.0-25-common, linux-kbuild-6.1"),
+					testPackage("linux-headers-6.1.0-25-common", "6.1.106-3", "linux-kbuild-6.1"),
+					testPackage("linux-kbuild-6.1", "6.1.106-3", ""),
+				),
+			},
+			root:     "linux-headers-6.1.0-25-amd64",
+			expected: []string{"linux-headers-6.1.0-25-amd64_6.1.106-3", "linux-headers-6.1.0-25-common_6.1.106-3", "linux-kbuild-6.1_6.1.106-3"},
+		},
+		{
+			name: "conflicting versions",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "main", nil,
+					testPackage("linux-headers-6.1.0-25-amd64", "6.1.106-3", "linux-headers-6.1.0-25-common (= 6.1.106-3), linux-kbuild-6.1 (>= 6.1.106-3)"),
+					testPackage("linux-headers-6.1.0-25-common", "6.1.106-3", "linux-kbuild-6.1 (<< 6.1.106-3)"),
+					testPackage("linux-kbuild-6.1", "6.1.106-3", ""),
+					testPackage("linux-kbuild-6.1", "6.1.99-1", ""),
+				),
+			},
+			root:     "linux-headers-6.1.0-25-amd64",
+			expected: []string{"linux-headers-6.1.0-25-amd64_6.1.106-3", "linux-headers-6.1.0-25-common_6.1.106-3", "linux-kbuild-6.1_6.1.106-3"},
+			missing:  []string{"linux-kbuild-6.1 (<< 6.1.106-3)"},
+		},
+		{
+			name: "highest version across repositories",
+			repos: []indexedRepo{
+				testIndexedRepo(t, "release", nil,
+					testPackage("linux-headers-6.1.0-25-amd64", "6.1.106-3", "linux-kbuild-6.1"),
+					testPackage("linux-kbuild-6.1", "6.1.106-3", ""),
+				),
+				testIndexedRepo(t, "security", nil,
+					testPackage("linux-kbuild-6.1", "6.1.112-1", ""),
+				),
+			},
+			root:     "linux-headers-6.1.0-25-amd64",
+			expected: []string{"linux-headers-6.1.0-25-amd64_6.1.106-3", "linux-kbuild-6.1_6.1.112-1"},
+		},
+	}
+
+	filter := regexp.MustCompile(DefaultDependencyFilter)
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			resolver := newDependencyResolver(testEntry.repos, "amd64", filter, nil, logrus.New())
+			resolved, err := resolver.resolve(deb.Dependency{Pkg: testEntry.root, Relation: deb.VersionDontCare})
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var names []string
+			for _, rp := range resolved {
+				names = append(names, rp.pkg.Name+"_"+rp.pkg.Version)
+			}
+			assert.Equal(t, testEntry.expected, names)
+			assert.Equal(t, testEntry.missing, resolver.missing)
+		})
+	}
+}
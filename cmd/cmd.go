@@ -8,9 +8,11 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/DataDog/nikos/apk"
 	"github.com/DataDog/nikos/apt"
 	"github.com/DataDog/nikos/cos"
 	"github.com/DataDog/nikos/rpm"
+	"github.com/DataDog/nikos/rpm/dnfv2"
 	"github.com/DataDog/nikos/types"
 	"github.com/DataDog/nikos/wsl"
 )
@@ -21,8 +23,12 @@ var (
 	outputDir      string
 	verbose        bool
 	aptConfigDir   string
+	aptDepsFilter  string
+	aptFallbacks   bool
+	aptArchives    = apt.DefaultArchiveFallbacks()
 	rpmReposDir    string
 	zypperReposDir string
+	apkCDNURL      string
 )
 
 var RootCmd = &cobra.Command{
@@ -70,15 +76,19 @@ var DownloadCmd = &cobra.Command{
 			case "rhel", "redhat":
 				backend, err = rpm.NewRedHatBackend(&target, rpmReposDir, logger)
 			case "centos":
-				backend, err = rpm.NewCentOSBackend(&target, rpmReposDir, logger)
+				if rpm.IsCentOSStream(&target) {
+					backend, err = rpm.NewCentOSStreamBackend(&target, rpmReposDir, logger)
+				} else {
+					backend, err = rpm.NewCentOSBackend(&target, rpmReposDir, logger)
+				}
+			case "rocky":
+				backend, err = rpm.NewRockyBackend(&target, rpmReposDir, logger)
+			case "almalinux", "alma":
+				backend, err = rpm.NewAlmaLinuxBackend(&target, rpmReposDir, logger)
 			case "oracle", "ol":
 				backend, err = rpm.NewOracleBackend(&target, rpmReposDir, logger)
 			case "amazon":
-				if target.Distro.Release == "2022" {
-					backend, err = rpm.NewAmazonLinux2022Backend(&target, rpmReposDir, logger)
-				} else {
-					backend, err = rpm.NewRedHatBackend(&target, rpmReposDir, logger)
-				}
+				backend, err = rpm.NewAmazonLinuxBackend(&target, rpmReposDir, logger)
 			default:
 				err = fmt.Errorf("unsupported RedHat based distribution '%s'", target.Distro.Display)
 			}
@@ -92,7 +102,24 @@ var DownloadCmd = &cobra.Command{
 				err = fmt.Errorf("unsupported Debian based distribution '%s'", target.Distro.Display)
 			}
 		case "debian":
-			backend, err = apt.NewBackend(&target, aptConfigDir, logger)
+			var aptBackend *apt.Backend
+			if aptBackend, err = apt.NewBackend(&target, aptConfigDir, logger); err == nil {
+				err = aptBackend.SetDependencyFilter(aptDepsFilter)
+				if aptFallbacks {
+					aptBackend.EnableArchiveFallbacks(aptArchives)
+				}
+				backend = aptBackend
+			}
+		case "mariner", "azurelinux":
+			backend, err = rpm.NewAzureLinuxBackend(&target, rpmReposDir, logger)
+		case "photon":
+			backend, err = rpm.NewPhotonBackend(&target, rpmReposDir, logger)
+		case "alpine":
+			var apkBackend *apk.Backend
+			if apkBackend, err = apk.NewBackend(&target, logger); err == nil {
+				apkBackend.SetCDNURL(apkCDNURL)
+				backend = apkBackend
+			}
 		case "cos":
 			backend, err = cos.NewBackend(&target, logger)
 		case "wsl":
@@ -134,8 +161,17 @@ func SetupCommands() error {
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose mode")
 
 	RootCmd.PersistentFlags().StringVarP(&aptConfigDir, "apt-config-dir", "", types.HostEtc("apt"), "APT configuration dir")
-	RootCmd.PersistentFlags().StringVarP(&rpmReposDir, "yum-repos-dir", "", types.HostEtc("yum.repos.d"), "YUM configuration dir")
-	RootCmd.PersistentFlags().StringVarP(&zypperReposDir, "zypper-repos-dir", "", types.HostEtc("zypp", "repos.d"), "YUM configuration dir")
+	RootCmd.PersistentFlags().StringVarP(&aptDepsFilter, "apt-deps-filter", "", apt.DefaultDependencyFilter, "regular expression matching the APT dependencies to download along with the headers")
+	RootCmd.PersistentFlags().BoolVarP(&aptFallbacks, "apt-archive-fallbacks", "", false, "look for the headers in the Debian and Ubuntu archives when they are missing from the APT repositories")
+	RootCmd.PersistentFlags().StringVarP(&aptArchives.UbuntuOldReleasesURL, "ubuntu-old-releases-url", "", aptArchives.UbuntuOldReleasesURL, "Ubuntu old releases archive URL")
+	RootCmd.PersistentFlags().StringVarP(&aptArchives.DebianSnapshotURL, "debian-snapshot-url", "", aptArchives.DebianSnapshotURL, "Debian snapshot archive URL")
+	RootCmd.PersistentFlags().StringVarP(&aptArchives.LaunchpadURL, "launchpad-url", "", aptArchives.LaunchpadURL, "Launchpad URL")
+	RootCmd.PersistentFlags().StringVarP(&aptArchives.LaunchpadAPIURL, "launchpad-api-url", "", aptArchives.LaunchpadAPIURL, "Launchpad API URL")
+	RootCmd.PersistentFlags().BoolVarP(&aptArchives.AllowUnverifiedLaunchpad, "launchpad-allow-unverified", "", false, "use the Launchpad packages whose checksum is not published by the Launchpad API")
+	RootCmd.PersistentFlags().StringVarP(&rpmReposDir, "yum-repos-dir", "", "", "YUM configuration dir, replacing the reposdir of dnf.conf or yum.conf (default /etc/yum.repos.d)")
+	RootCmd.PersistentFlags().StringVarP(&dnfv2.CacheDir, "dnf-cache-dir", "", "", "directory keeping the zchunk repository metadata between runs, to only download the chunks that changed (disabled when empty)")
+	RootCmd.PersistentFlags().StringVarP(&apkCDNURL, "apk-cdn-url", "", apk.DefaultCDNURL, "Alpine CDN URL, used when the apk repositories lack the headers, empty to disable")
+	RootCmd.PersistentFlags().StringVarP(&zypperReposDir, "zypper-repos-dir", "", types.HostEtc("zypp", "repos.d"), "Zypper configuration dir")
 
 	RootCmd.AddCommand(DownloadCmd)
 	return nil
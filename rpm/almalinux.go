@@ -0,0 +1,27 @@
+package rpm
+
+import (
+	"fmt"
+
+	"github.com/DataDog/nikos/types"
+)
+
+var almaLinux = &rhelRebuild{
+	name: "AlmaLinux",
+	vaultURL: func(release, repository string) string {
+		return fmt.Sprintf("https://vault.almalinux.org/%s/%s/$basearch/os/", release, repository)
+	},
+	gpgKey: func(major int) string {
+		if major == 8 {
+			return "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-AlmaLinux"
+		}
+		return fmt.Sprintf("file:///etc/pki/rpm-gpg/RPM-GPG-KEY-AlmaLinux-%d", major)
+	},
+	vars: map[string]string{
+		"contentdir": "almalinux",
+	},
+}
+
+func NewAlmaLinuxBackend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	return newRebuildBackend(almaLinux, target, reposDir, logger)
+}
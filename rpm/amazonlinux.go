@@ -5,18 +5,100 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/DataDog/nikos/rpm/dnfv2"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
 	"github.com/DataDog/nikos/types"
 )
 
-func NewAmazonLinux2022Backend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
-	releaseVer, err := extractReleaseVersionFromImageID()
+// amazonLinuxVars are the defaults of the variables of /etc/yum/vars and /etc/dnf/vars
+var amazonLinuxVars = map[string]string{
+	"awsproto":    "https",
+	"amazonlinux": "amazonlinux",
+	"awsregion":   "default",
+	"awsdomain":   "amazonaws.com",
+}
+
+// NewAmazonLinuxBackend returns the backend of the Amazon Linux release, using DNF
+// releases for Amazon Linux 2022 and later
+func NewAmazonLinuxBackend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	release := target.Distro.Release
+	if release == "" || release == "2" || strings.HasPrefix(release, "2.") {
+		return NewAmazonLinux2Backend(target, reposDir, logger)
+	}
+	return NewAmazonLinux2023Backend(target, reposDir, logger)
+}
+
+// NewAmazonLinux2Backend also looks for the kernels of the amazon-linux-extras topics,
+// such as kernel-5.10, in their repositories
+func NewAmazonLinux2Backend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	b, err := dnfv2.NewBackendWithVars("2", reposDir, amazonLinuxVars)
+	if err != nil {
+		return nil, err
+	}
+
+	if topic := kernelExtrasTopic(target.Uname.Kernel); topic != "" {
+		sectionName := "amzn2extra-" + topic
+
+		found := false
+		for i := range b.Repositories {
+			if b.Repositories[i].SectionName == sectionName {
+				b.Repositories[i].Enabled = true
+				found = true
+			}
+		}
+
+		if !found {
+			logger.Infof("adding the %s extras repository", topic)
+			b.AppendRepository(repo.Repo{
+				SectionName: sectionName,
+				Name:        fmt.Sprintf("Amazon Extras repo for %s", topic),
+				MirrorList:  fmt.Sprintf("$awsproto://$amazonlinux.$awsregion.$awsdomain/$releasever/extras/%s/latest/$basearch/mirror.list", topic),
+				Enabled:     true,
+				GpgCheck:    true,
+				GpgKeys:     []string{"file:///etc/pki/rpm-gpg/RPM-GPG-KEY-amazon-linux-2"},
+			})
+		}
+	}
+
+	return &RedHatBackend{
+		target:     target,
+		logger:     logger,
+		dnfBackend: b,
+	}, nil
+}
+
+// kernelExtrasTopic returns the amazon-linux-extras topic providing the kernel, e.g.
+// kernel-5.10 for 5.10.223-211.872.amzn2.x86_64, or an empty string for the 4.14 core kernel
+func kernelExtrasTopic(kernel string) string {
+	majorMinor := kernelMajorMinor(kernel)
+	if majorMinor == "" || strings.HasPrefix(majorMinor, "4.") {
+		return ""
+	}
+	return "kernel-" + majorMinor
+}
+
+var kernelMajorMinorPattern = regexp.MustCompile(`^(\d+\.\d+)\.`)
+
+func kernelMajorMinor(kernel string) string {
+	if submatches := kernelMajorMinorPattern.FindStringSubmatch(kernel); submatches != nil {
+		return submatches[1]
+	}
+	return ""
+}
+
+// NewAmazonLinux2023Backend supports Amazon Linux 2022 and 2023, whose repositories
+// are versioned by release, e.g. 2023.5.20240805. The headers of the kernels packaged
+// under a versioned name, such as kernel6.12-devel, are looked for as well. Live
+// patches do not change the kernel release, so they need no special handling.
+func NewAmazonLinux2023Backend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	releaseVer, err := amazonLinuxReleaseVersion(target)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract release version: %w", err)
 	}
 
-	b, err := dnfv2.NewBackend(releaseVer, reposDir)
+	b, err := dnfv2.NewBackendWithVars(releaseVer, reposDir, amazonLinuxVars)
 	if err != nil {
 		return nil, err
 	}
@@ -25,10 +107,46 @@ func NewAmazonLinux2022Backend(target *types.Target, reposDir string, logger typ
 		target:     target,
 		logger:     logger,
 		dnfBackend: b,
+		pkgNames:   amazonLinux2023PkgNames(target.Uname.Kernel),
 	}, nil
 }
 
-var imageFilePattern = regexp.MustCompile(`image_file="al2022-\w+-(2022.0.\d{8}).*"`)
+// amazonLinux2023PkgNames returns the names of the headers package of the kernel,
+// e.g. kernel-devel and kernel6.12-devel for 6.12.37-61.105.amzn2023.x86_64
+func amazonLinux2023PkgNames(kernel string) []string {
+	pkgNames := []string{"kernel-devel"}
+	if majorMinor := kernelMajorMinor(kernel); majorMinor != "" {
+		pkgNames = append(pkgNames, fmt.Sprintf("kernel%s-devel", majorMinor))
+	}
+	return pkgNames
+}
+
+var versionedReleasePattern = regexp.MustCompile(`^\d{4}\.\d+\.\d{8}$`)
+
+// amazonLinuxReleaseVersion returns the versioned release of the host, from the
+// release locked in /etc/dnf/vars, the image the host was launched from or os-release
+func amazonLinuxReleaseVersion(target *types.Target) (string, error) {
+	if content, err := os.ReadFile(types.HostEtc("dnf", "vars", "releasever")); err == nil {
+		if releaseVer := strings.TrimSpace(string(content)); releaseVer != "" {
+			return releaseVer, nil
+		}
+	}
+
+	releaseVer, err := extractReleaseVersionFromImageID()
+	if err == nil {
+		return releaseVer, nil
+	}
+
+	if versionID := target.OSRelease["VERSION_ID"]; versionedReleasePattern.MatchString(versionID) {
+		return versionID, nil
+	}
+	if versionedReleasePattern.MatchString(target.Distro.Release) {
+		return target.Distro.Release, nil
+	}
+	return "", err
+}
+
+var imageFilePattern = regexp.MustCompile(`image_file="al20\d\d-\S*?-(\d{4}\.\d+\.\d{8})`)
 
 func extractReleaseVersionFromImageID() (string, error) {
 	imageIDPath := types.HostEtc("image-id")
@@ -36,6 +154,7 @@ func extractReleaseVersionFromImageID() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer f.Close()
 
 	liner := bufio.NewScanner(f)
 	for liner.Scan() {
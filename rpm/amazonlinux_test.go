@@ -0,0 +1,149 @@
+package rpm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/types"
+)
+
+type amazonLinuxReleaseTestEntry struct {
+	name       string
+	releasever string
+	imageID    string
+	versionID  string
+	release    string
+	expected   string
+	err        bool
+}
+
+func TestAmazonLinuxReleaseVersion(t *testing.T) {
+	const (
+		al2023ImageID = `image_name="al2023-ami-2023.5.20240805.0-kernel-6.1-x86_64"
+image_version="2023"
+image_arch="x86_64"
+image_file="al2023-ec2-ami-2023.5.20240805.0-kernel-6.1-x86_64.xfs.gpt"
+image_stamp="6a2e-2d63"
+image_date="20240805201318"
+recipe_name="al2023 ami"
+recipe_id="e1d56f1b-ce2b-0fac-8cc2-6ec0-21bd-3f6b-3d3d2c3f"
+`
+		al2022ImageID = `image_name="al2022-ami-2022.0.20220531.0-kernel-5.15-arm64"
+image_version="2022"
+image_arch="arm64"
+image_file="al2022-ami-2022.0.20220531.0-kernel-5.15-arm64.xfs.gpt"
+`
+	)
+
+	testEntries := []amazonLinuxReleaseTestEntry{
+		{
+			name:       "locked release",
+			releasever: "2023.4.20240416\n",
+			imageID:    al2023ImageID,
+			expected:   "2023.4.20240416",
+		},
+		{
+			name:       "latest release",
+			releasever: "latest\n",
+			imageID:    al2023ImageID,
+			expected:   "latest",
+		},
+		{
+			name:       "empty releasever",
+			releasever: "\n",
+			imageID:    al2023ImageID,
+			expected:   "2023.5.20240805",
+		},
+		{
+			name:     "al2023 image",
+			imageID:  al2023ImageID,
+			expected: "2023.5.20240805",
+		},
+		{
+			name:     "al2022 image",
+			imageID:  al2022ImageID,
+			expected: "2022.0.20220531",
+		},
+		{
+			name:      "image without image_file",
+			imageID:   "image_name=\"custom\"\n",
+			versionID: "2023.6.20241010",
+			expected:  "2023.6.20241010",
+		},
+		{
+			name:      "os-release",
+			versionID: "2023.6.20241010",
+			expected:  "2023.6.20241010",
+		},
+		{
+			name:      "distribution release",
+			versionID: "2023",
+			release:   "2023.6.20241010",
+			expected:  "2023.6.20241010",
+		},
+		{
+			name:      "no versioned release",
+			versionID: "2023",
+			release:   "2023",
+			err:       true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			hostEtc := t.TempDir()
+			t.Setenv("HOST_ETC", hostEtc)
+			if testEntry.releasever != "" {
+				writeHostFile(t, hostEtc, "dnf/vars/releasever", []byte(testEntry.releasever))
+			}
+			if testEntry.imageID != "" {
+				writeHostFile(t, hostEtc, "image-id", []byte(testEntry.imageID))
+			}
+
+			target := &types.Target{
+				Distro:    types.Distro{Release: testEntry.release},
+				OSRelease: map[string]string{"VERSION_ID": testEntry.versionID},
+			}
+			releaseVer, err := amazonLinuxReleaseVersion(target)
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, releaseVer)
+		})
+	}
+}
+
+func TestKernelExtrasTopic(t *testing.T) {
+	testEntries := map[string]string{
+		"4.14.348-265.562.amzn2.x86_64":  "",
+		"5.4.281-197.364.amzn2.x86_64":   "kernel-5.4",
+		"5.10.223-211.872.amzn2.x86_64":  "kernel-5.10",
+		"5.15.164-108.161.amzn2.aarch64": "kernel-5.15",
+		"":                               "",
+	}
+
+	for kernel, expected := range testEntries {
+		t.Run(kernel, func(t *testing.T) {
+			assert.Equal(t, expected, kernelExtrasTopic(kernel))
+		})
+	}
+}
+
+func TestAmazonLinux2023PkgNames(t *testing.T) {
+	testEntries := map[string][]string{
+		"6.1.102-111.182.amzn2023.x86_64": {"kernel-devel", "kernel6.1-devel"},
+		"6.12.37-61.105.amzn2023.aarch64": {"kernel-devel", "kernel6.12-devel"},
+		"5.15.73-45.135.amzn2022.x86_64":  {"kernel-devel", "kernel5.15-devel"},
+		"":                                {"kernel-devel"},
+	}
+
+	for kernel, expected := range testEntries {
+		t.Run(kernel, func(t *testing.T) {
+			assert.Equal(t, expected, amazonLinux2023PkgNames(kernel))
+		})
+	}
+}
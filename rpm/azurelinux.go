@@ -0,0 +1,19 @@
+package rpm
+
+import (
+	"github.com/DataDog/nikos/types"
+)
+
+// NewAzureLinuxBackend supports Azure Linux and CBL-Mariner, whose flavoured kernels,
+// such as kernel-mshv, have their own devel packages
+func NewAzureLinuxBackend(target *types.Target, reposDir string, logger types.Logger) (*TdnfBackend, error) {
+	return newTdnfBackend(target, reposDir, logger, nil, azureLinuxPkgName)
+}
+
+// azureLinuxPkgName returns the devel package of a kernel flavour, e.g. kernel-mshv-devel
+func azureLinuxPkgName(flavour string) string {
+	if flavour == "" {
+		return "kernel-devel"
+	}
+	return "kernel-" + flavour + "-devel"
+}
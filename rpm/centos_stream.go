@@ -0,0 +1,147 @@
+package rpm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDog/nikos/rpm/dnfv2"
+	"github.com/DataDog/nikos/rpm/dnfv2/backend"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+	rpmtypes "github.com/DataDog/nikos/rpm/dnfv2/types"
+	"github.com/DataDog/nikos/types"
+)
+
+const centOSStreamKojiURL = "https://kojihub.stream.centos.org/kojifiles/packages/"
+
+type CentOSStreamBackend struct {
+	dnfBackend *backend.Backend
+	target     *types.Target
+	logger     types.Logger
+	// koji provides the kernels that rotated out of the mirrors and composes
+	koji *repo.Koji
+}
+
+// IsCentOSStream returns whether the host runs CentOS Stream rather than CentOS Linux
+func IsCentOSStream(target *types.Target) bool {
+	if strings.Contains(target.OSRelease["NAME"], "Stream") {
+		return true
+	}
+	redhatRelease, err := os.ReadFile(types.HostEtc("redhat-release"))
+	return err == nil && strings.Contains(string(redhatRelease), "Stream")
+}
+
+func (b *CentOSStreamBackend) GetKernelHeaders(directory string) error {
+	pkgNevra := "kernel-devel"
+	pkgMatcher := dnfv2.DefaultPkgMatcher(pkgNevra, b.target.Uname.Kernel)
+
+	pkg, data, err := b.dnfBackend.FetchPackage(pkgMatcher)
+	if err != nil && b.koji != nil {
+		b.logger.Infof("`%s` not found in the repositories, trying koji: %v", pkgNevra, err)
+
+		header, headerErr := kernelPkgHeader(pkgNevra, b.target.Uname.Kernel)
+		if headerErr != nil {
+			return headerErr
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+		pkg, data, err = b.koji.DownloadPackage(ctx, "kernel", header)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch `%s` package: %w", pkgNevra, err)
+	}
+
+	return dnfv2.ExtractPackage(pkg, data, directory, b.target, b.logger)
+}
+
+func (b *CentOSStreamBackend) Close() {
+}
+
+// kernelPkgHeader returns the header of a kernel package from the kernel release,
+// e.g. 5.14.0-362.el9.x86_64
+func kernelPkgHeader(name, kernel string) (*repo.PkgInfoHeader, error) {
+	archIndex := strings.LastIndexByte(kernel, '.')
+	if archIndex < 0 {
+		return nil, fmt.Errorf("failed to parse kernel release %s", kernel)
+	}
+	ver, rel, found := strings.Cut(kernel[:archIndex], "-")
+	if !found {
+		return nil, fmt.Errorf("failed to parse kernel release %s", kernel)
+	}
+
+	return &repo.PkgInfoHeader{
+		Name:    name,
+		Version: rpmtypes.Version{Ver: ver, Rel: rel},
+		Arch:    kernel[archIndex+1:],
+	}, nil
+}
+
+func NewCentOSStreamBackend(target *types.Target, reposDir string, logger types.Logger) (*CentOSStreamBackend, error) {
+	release, err := getRedhatRelease()
+	if err != nil {
+		release = target.Distro.Release
+	}
+
+	version, err := strconv.Atoi(strings.SplitN(release, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect CentOS Stream release: %w", err)
+	}
+
+	// $stream is derived from the release, e.g. 9-stream
+	b, err := dnfv2.NewBackend(strconv.Itoa(version), reposDir)
+	if err != nil {
+		return nil, err
+	}
+
+	gpgKey := "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-centosofficial"
+	if version >= 10 {
+		gpgKey = "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-centosofficial-SHA256"
+	}
+
+	type source struct {
+		name    string
+		baseURL string
+	}
+
+	var sources []source
+	if version <= 8 {
+		// CentOS Stream 8 reached its end of life and was moved to the vault
+		sources = []source{{"vault", fmt.Sprintf("http://vault.centos.org/%d-stream", version)}}
+	} else {
+		sources = []source{
+			{"mirror", "https://mirror.stream.centos.org/$stream"},
+			{"compose", fmt.Sprintf("https://composes.stream.centos.org/stream-%d/production/latest-CentOS-Stream/compose", version)},
+		}
+	}
+
+	for _, source := range sources {
+		for _, repository := range []string{"BaseOS", "AppStream"} {
+			name := fmt.Sprintf("centos-stream-%d-%s-%s", version, strings.ToLower(repository), source.name)
+			b.AppendRepository(repo.Repo{
+				SectionName: name,
+				Name:        name,
+				BaseURL:     fmt.Sprintf("%s/%s/$basearch/os/", source.baseURL, repository),
+				Enabled:     true,
+				GpgCheck:    true,
+				GpgKeys:     []string{gpgKey},
+			})
+		}
+	}
+
+	streamBackend := &CentOSStreamBackend{
+		target:     target,
+		logger:     logger,
+		dnfBackend: b,
+	}
+	if version >= 9 {
+		streamBackend.koji = &repo.Koji{
+			PackagesURL: centOSStreamKojiURL,
+			GpgKeys:     []string{gpgKey},
+		}
+	}
+	return streamBackend, nil
+}
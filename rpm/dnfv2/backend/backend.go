@@ -3,7 +3,11 @@ package backend
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,10 +18,12 @@ import (
 
 type Backend struct {
 	Repositories []repo.Repo
-	varsReplacer *strings.Replacer
+	varsReplacer dnfVars
+	cacheDir     string
+	transports   *repo.TransportPool
 }
 
-func NewBackend(reposDir string, varsDir []string, builtinVariables map[string]string) (*Backend, error) {
+func NewBackend(reposDirs []string, mainConfig repo.MainConfig, varsDir []string, builtinVariables map[string]string) (*Backend, error) {
 	varMaps := []map[string]string{builtinVariables}
 	for _, varDir := range varsDir {
 		if varDir == "" {
@@ -34,25 +40,36 @@ func NewBackend(reposDir string, varsDir []string, builtinVariables map[string]s
 		}
 	}
 
+	// the environment takes precedence, to allow overriding the host configuration
+	varMaps = append(varMaps, envVars(os.Environ()))
 	varsReplacer := buildVarsReplacer(varMaps...)
 
-	repos, err := repo.ReadFromDir(reposDir)
-	if err != nil {
-		return nil, err
+	var repos []repo.Repo
+	for _, reposDir := range uniqueDirs(reposDirs) {
+		dirRepos, err := repo.ReadFromDirWithDefaults(reposDir, mainConfig)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, dirRepos...)
 	}
 
+	// the repositories share their connections
+	transports := repo.NewTransportPool()
 	replacedRepos := make([]repo.Repo, 0, len(repos))
 	for _, r := range repos {
+		r.Transports = transports
 		replacedRepos = append(replacedRepos, replaceInRepo(varsReplacer, r))
 	}
 
 	return &Backend{
 		Repositories: replacedRepos,
 		varsReplacer: varsReplacer,
+		cacheDir:     mainConfig.CacheDir,
+		transports:   transports,
 	}, nil
 }
 
-func replaceInRepo(varsReplacer *strings.Replacer, r repo.Repo) repo.Repo {
+func replaceInRepo(varsReplacer dnfVars, r repo.Repo) repo.Repo {
 	r.Name = varsReplacer.Replace(r.Name)
 	r.BaseURL = varsReplacer.Replace(r.BaseURL)
 	r.MirrorList = varsReplacer.Replace(r.MirrorList)
@@ -65,30 +82,164 @@ func replaceInRepo(varsReplacer *strings.Replacer, r repo.Repo) repo.Repo {
 	r.SSLClientCert = varsReplacer.Replace(r.SSLClientCert)
 	r.SSLClientKey = varsReplacer.Replace(r.SSLClientKey)
 	r.SSLCaCert = varsReplacer.Replace(r.SSLCaCert)
+	r.Proxy = varsReplacer.Replace(r.Proxy)
 	return r
 }
 
+// uniqueDirs removes the duplicated directories, which are often symlinked
+// to each other, e.g. /etc/yum/repos.d to /etc/yum.repos.d
+func uniqueDirs(dirs []string) []string {
+	seen := make(map[string]bool, len(dirs))
+	res := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		resolved := utils.HostEtcJoin(dir)
+		if target, err := filepath.EvalSymlinks(resolved); err == nil {
+			resolved = target
+		}
+
+		if seen[resolved] {
+			continue
+		}
+		seen[resolved] = true
+		res = append(res, dir)
+	}
+	return res
+}
+
+// AppendRepository adds a fallback repository. Those are best effort, skipped when
+// unavailable, and only searched when the configured repositories do not provide the
+// package. A zero priority or cost is replaced by the default one, and the metadata
+// cache and transports of the configured repositories are used when not set.
 func (b *Backend) AppendRepository(r repo.Repo) {
+	if r.Priority == 0 {
+		r.Priority = repo.DefaultPriority
+	}
+	if r.Cost == 0 {
+		r.Cost = repo.DefaultCost
+	}
+	r.SkipIfUnavailable = true
+	r.Fallback = true
+	if r.CacheDir == "" {
+		r.CacheDir = b.cacheDir
+	}
+	if r.Transports == nil {
+		r.Transports = b.transports
+	}
 	b.Repositories = append(b.Repositories, replaceInRepo(b.varsReplacer, r))
 }
 
+// enabledRepositories returns the enabled configured or fallback repositories, by
+// ascending priority then cost, keeping the configuration order otherwise
+func (b *Backend) enabledRepositories(fallback bool) []repo.Repo {
+	enabled := make([]repo.Repo, 0, len(b.Repositories))
+	for _, repository := range b.Repositories {
+		if repository.Enabled && repository.Fallback == fallback {
+			enabled = append(enabled, repository)
+		}
+	}
+
+	sortRepositories(enabled)
+	return enabled
+}
+
+// sectionRepositories returns the repositories of the given sections, whether they are
+// enabled or not, in the same order as enabledRepositories
+func (b *Backend) sectionRepositories(sectionNames []string) []repo.Repo {
+	var res []repo.Repo
+	for _, repository := range b.Repositories {
+		if slices.Contains(sectionNames, repository.SectionName) {
+			res = append(res, repository)
+		}
+	}
+
+	sortRepositories(res)
+	return res
+}
+
+func sortRepositories(repos []repo.Repo) {
+	sort.SliceStable(repos, func(i, j int) bool {
+		if repos[i].Priority != repos[j].Priority {
+			return repos[i].Priority < repos[j].Priority
+		}
+		return repos[i].Cost < repos[j].Cost
+	})
+}
+
+type candidate struct {
+	repository *repo.Repo
+	pkg        *repo.PkgInfo
+}
+
+// better reports whether c should be preferred over other: packages from repositories
+// with a better priority win regardless of their version, then the newest version,
+// then the repository with the lowest cost
+func (c *candidate) better(other *candidate) bool {
+	if c.repository.Priority != other.repository.Priority {
+		return c.repository.Priority < other.repository.Priority
+	}
+	if cmp := repo.ComparePackages(c.pkg, other.pkg); cmp != 0 {
+		return cmp > 0
+	}
+	return c.repository.Cost < other.repository.Cost
+}
+
+// FetchPackage collects the packages accepted by the matcher in all the enabled
+// repositories, and downloads the best one. The next candidates are tried if
+// the download fails. The fallback repositories are only searched when no package
+// of the configured repositories could be downloaded.
 func (b *Backend) FetchPackage(matcher repo.PkgMatchFunc) (*repo.PkgInfo, []byte, error) {
+	return fetchPackage([][]repo.Repo{b.enabledRepositories(false), b.enabledRepositories(true)}, matcher)
+}
+
+// FetchPackageFrom is FetchPackage limited to the repositories of the given sections,
+// which are searched even when disabled
+func (b *Backend) FetchPackageFrom(sectionNames []string, matcher repo.PkgMatchFunc) (*repo.PkgInfo, []byte, error) {
+	return fetchPackage([][]repo.Repo{b.sectionRepositories(sectionNames)}, matcher)
+}
+
+// fetchPackage searches the tiers of repositories in turn, until a package is downloaded
+func fetchPackage(tiers [][]repo.Repo, matcher repo.PkgMatchFunc) (*repo.PkgInfo, []byte, error) {
 	var mErr error
 
-	for _, repository := range b.Repositories {
-		if !repository.Enabled {
-			continue
+	for _, repositories := range tiers {
+		var candidates []*candidate
+		for _, repository := range repositories {
+			pkgs, err := func() ([]*repo.PkgInfo, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				defer cancel()
+				return repository.FindPackages(ctx, matcher)
+			}()
+			if err != nil {
+				var unavailable *repo.UnavailableError
+				if errors.As(err, &unavailable) && !repository.SkipIfUnavailable {
+					return nil, nil, fmt.Errorf("%w (skip_if_unavailable=False)", err)
+				}
+
+				mErr = multierror.Append(mErr, err)
+				continue
+			}
+
+			for _, pkg := range pkgs {
+				candidates = append(candidates, &candidate{repository: &repository, pkg: pkg})
+			}
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
-		defer cancel()
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].better(candidates[j])
+		})
 
-		p, content, err := repository.FetchPackage(ctx, matcher)
-		if err != nil {
-			mErr = multierror.Append(mErr, err)
-			continue
+		for _, c := range candidates {
+			content, err := func() ([]byte, error) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+				defer cancel()
+				return c.repository.DownloadPackage(ctx, c.pkg)
+			}()
+			if err != nil {
+				mErr = multierror.Append(mErr, err)
+				continue
+			}
+			return c.pkg, content, nil
 		}
-		return p, content, nil
 	}
 
 	if mErr == nil {
@@ -119,19 +270,3 @@ func readVars(varsDir string) (map[string]string, error) {
 	}
 	return vars, nil
 }
-
-func buildVarsReplacer(varMaps ...map[string]string) *strings.Replacer {
-	count := 0
-	for _, varMap := range varMaps {
-		count += len(varMap)
-	}
-
-	pairs := make([]string, 0, count*2)
-	for _, varMap := range varMaps {
-		for name, value := range varMap {
-			pairs = append(pairs, "$"+name, value)
-		}
-	}
-
-	return strings.NewReplacer(pairs...)
-}
@@ -0,0 +1,158 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+)
+
+func repoNames(repos []repo.Repo) []string {
+	var names []string
+	for _, r := range repos {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func TestEnabledRepositories(t *testing.T) {
+	b := &Backend{
+		Repositories: []repo.Repo{
+			{Name: "baseos", Enabled: true, Priority: repo.DefaultPriority, Cost: repo.DefaultCost},
+			{Name: "disabled", Enabled: false, Priority: 1, Cost: repo.DefaultCost},
+			{Name: "local", Enabled: true, Priority: repo.DefaultPriority, Cost: 10},
+			{Name: "preferred", Enabled: true, Priority: 10, Cost: repo.DefaultCost},
+		},
+		varsReplacer: buildVarsReplacer(map[string]string{"releasever": "9"}),
+		cacheDir:     "/cache",
+	}
+	b.AppendRepository(repo.Repo{Name: "vault-$releasever", Enabled: true})
+	b.AppendRepository(repo.Repo{Name: "compose", Enabled: true, Priority: 10})
+	b.AppendRepository(repo.Repo{Name: "extended", Enabled: false})
+
+	assert.Equal(t, []string{"preferred", "local", "baseos"}, repoNames(b.enabledRepositories(false)))
+	assert.Equal(t, []string{"compose", "vault-9"}, repoNames(b.enabledRepositories(true)))
+
+	vault := b.Repositories[4]
+	assert.True(t, vault.Fallback)
+	assert.True(t, vault.SkipIfUnavailable)
+	assert.Equal(t, repo.DefaultPriority, vault.Priority)
+	assert.Equal(t, repo.DefaultCost, vault.Cost)
+	assert.Equal(t, "/cache", vault.CacheDir)
+}
+
+// writeTestRepo writes a repository providing the kernel-devel package of the given
+// release, and returns its file:// base URL
+func writeTestRepo(t *testing.T, release string) string {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "repodata"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Packages"), 0755))
+
+	pkgFile := fmt.Sprintf("Packages/kernel-devel-5.14.0-%s.x86_64.rpm", release)
+	pkgContent := []byte("kernel-devel " + release)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, pkgFile), pkgContent, 0644))
+
+	primary := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="1">
+<package type="rpm"><name>kernel-devel</name><arch>x86_64</arch>
+	<version epoch="0" ver="5.14.0" rel="%s"/>
+	<checksum type="sha256" pkgid="YES">%x</checksum>
+	<location href="%s"/>
+	<format><rpm:provides>
+		<rpm:entry name="kernel-devel" flags="EQ" epoch="0" ver="5.14.0" rel="%s"/>
+	</rpm:provides></format>
+</package>
+</metadata>
+`, release, sha256.Sum256(pkgContent), pkgFile, release)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "repodata", "primary.xml"), []byte(primary), 0644))
+
+	repomd := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo">
+<data type="primary">
+	<open-checksum type="sha256">%x</open-checksum>
+	<location href="repodata/primary.xml"/>
+</data>
+</repomd>
+`, sha256.Sum256([]byte(primary)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "repodata", "repomd.xml"), []byte(repomd), 0644))
+
+	return "file://" + dir
+}
+
+func kernelDevelMatcher(pkg *repo.PkgInfoHeader) bool {
+	return pkg.Name == "kernel-devel"
+}
+
+type fetchPackageFromTestEntry struct {
+	name         string
+	sectionNames []string
+	expected     string
+	expectErr    bool
+}
+
+func TestFetchPackageFrom(t *testing.T) {
+	b := &Backend{
+		Repositories: []repo.Repo{
+			{SectionName: "baseos", Name: "baseos", BaseURL: writeTestRepo(t, "1.el9"), Enabled: true, Priority: repo.DefaultPriority, Cost: repo.DefaultCost},
+			{SectionName: "baseos-eus", Name: "baseos-eus", BaseURL: writeTestRepo(t, "2.el9"), Enabled: false, Priority: repo.DefaultPriority, Cost: repo.DefaultCost},
+			{SectionName: "baseos-e4s", Name: "baseos-e4s", BaseURL: writeTestRepo(t, "3.el9"), Enabled: false, Priority: repo.DefaultPriority, Cost: repo.DefaultCost},
+			{SectionName: "broken", Name: "broken", BaseURL: "file://" + t.TempDir(), Enabled: false, Priority: repo.DefaultPriority, Cost: repo.DefaultCost, SkipIfUnavailable: true},
+		},
+	}
+
+	testEntries := []fetchPackageFromTestEntry{
+		{
+			name:         "disabled repository",
+			sectionNames: []string{"baseos-eus"},
+			expected:     "2.el9",
+		},
+		{
+			name:         "newest of the repositories",
+			sectionNames: []string{"baseos-eus", "baseos-e4s"},
+			expected:     "3.el9",
+		},
+		{
+			name:         "unavailable repository skipped",
+			sectionNames: []string{"broken", "baseos-eus"},
+			expected:     "2.el9",
+		},
+		{
+			name:         "other repositories not searched",
+			sectionNames: []string{"broken"},
+			expectErr:    true,
+		},
+		{
+			name:         "unknown section",
+			sectionNames: []string{"unknown"},
+			expectErr:    true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			pkg, data, err := b.FetchPackageFrom(testEntry.sectionNames, kernelDevelMatcher)
+			if testEntry.expectErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, testEntry.expected, pkg.Header.Rel)
+				assert.Equal(t, "kernel-devel "+testEntry.expected, string(data))
+			}
+
+			// the repositories are left untouched
+			assert.Equal(t, []bool{true, false, false, false}, []bool{
+				b.Repositories[0].Enabled, b.Repositories[1].Enabled, b.Repositories[2].Enabled, b.Repositories[3].Enabled,
+			})
+		})
+	}
+
+	pkg, _, err := b.FetchPackage(kernelDevelMatcher)
+	require.NoError(t, err)
+	assert.Equal(t, "1.el9", pkg.Header.Rel)
+}
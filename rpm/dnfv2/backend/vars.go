@@ -0,0 +1,166 @@
+package backend
+
+import (
+	"regexp"
+	"strings"
+)
+
+// dnfVars substitutes DNF variables in repository options, following the libdnf semantics:
+//   - `$name` uses the longest variable name, so `$arch` does not match inside `$archive`
+//   - `${name}`, `${name:-default}` and `${name:+alternate}` are supported
+//   - `\$` is a literal `$`
+//   - unknown variables are kept as is
+type dnfVars map[string]string
+
+var envVarPattern = regexp.MustCompile(`^(?:(DNF[0-9]|YUM[0-9])|DNF_VAR_([A-Za-z0-9_]+))$`)
+
+// envVars returns the variables set in the environment: `DNF0` to `DNF9`,
+// `YUM0` to `YUM9`, and `DNF_VAR_<name>`
+func envVars(environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, env := range environ {
+		name, value, found := strings.Cut(env, "=")
+		if !found {
+			continue
+		}
+
+		if submatches := envVarPattern.FindStringSubmatch(name); submatches != nil {
+			vars[submatches[1]+submatches[2]] = value
+		}
+	}
+	return vars
+}
+
+// buildVarsReplacer merges the variable maps, later maps overriding earlier ones,
+// then derives the variables that are not set explicitly
+func buildVarsReplacer(varMaps ...map[string]string) dnfVars {
+	vars := make(dnfVars)
+	for _, varMap := range varMaps {
+		for name, value := range varMap {
+			vars[name] = value
+		}
+	}
+
+	if releasever, ok := vars["releasever"]; ok {
+		major, minor, _ := strings.Cut(releasever, ".")
+		vars.setDefault("releasever_major", major)
+		vars.setDefault("releasever_minor", minor)
+	}
+	if major := vars["releasever_major"]; major != "" {
+		vars.setDefault("stream", major+"-stream")
+	}
+	vars.setDefault("infra", "stock")
+	vars.setDefault("contentdir", "centos")
+
+	return vars
+}
+
+func (v dnfVars) setDefault(name, value string) {
+	if _, ok := v[name]; !ok {
+		v[name] = value
+	}
+}
+
+// Replace substitutes the variables of a string
+func (v dnfVars) Replace(s string) string {
+	if !strings.ContainsAny(s, "$\\") {
+		return s
+	}
+
+	var res strings.Builder
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '$':
+			res.WriteByte('$')
+			i += 2
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			value, end, ok := v.replaceBraced(s, i)
+			if !ok {
+				res.WriteByte(s[i])
+				i++
+				continue
+			}
+			res.WriteString(value)
+			i = end
+		case s[i] == '$':
+			end := i + 1
+			for end < len(s) && isVarNameChar(s[end]) {
+				end++
+			}
+
+			if value, ok := v[s[i+1:end]]; ok && end > i+1 {
+				res.WriteString(value)
+			} else {
+				res.WriteString(s[i:end])
+			}
+			i = end
+		default:
+			res.WriteByte(s[i])
+			i++
+		}
+	}
+	return res.String()
+}
+
+// replaceBraced substitutes the `${...}` expression starting at index start, and
+// returns the index following it. Expressions that are not valid are kept as is.
+func (v dnfVars) replaceBraced(s string, start int) (string, int, bool) {
+	nameStart := start + 2
+	nameEnd := nameStart
+	for nameEnd < len(s) && isVarNameChar(s[nameEnd]) {
+		nameEnd++
+	}
+	if nameEnd == nameStart || nameEnd >= len(s) {
+		return "", 0, false
+	}
+
+	name := s[nameStart:nameEnd]
+	value, set := v[name]
+
+	if s[nameEnd] == '}' {
+		if !set {
+			return s[start : nameEnd+1], nameEnd + 1, true
+		}
+		return value, nameEnd + 1, true
+	}
+
+	if nameEnd+1 >= len(s) || s[nameEnd] != ':' || (s[nameEnd+1] != '-' && s[nameEnd+1] != '+') {
+		return "", 0, false
+	}
+
+	// the word ends at the matching closing brace, and may contain variables
+	depth := 1
+	wordStart := nameEnd + 2
+	wordEnd := wordStart
+	for ; wordEnd < len(s); wordEnd++ {
+		if s[wordEnd] == '$' && wordEnd+1 < len(s) && s[wordEnd+1] == '{' {
+			depth++
+			wordEnd++
+		} else if s[wordEnd] == '}' {
+			if depth--; depth == 0 {
+				break
+			}
+		}
+	}
+	if depth != 0 {
+		return "", 0, false
+	}
+
+	word := s[wordStart:wordEnd]
+	nonEmpty := set && value != ""
+	if s[nameEnd+1] == '-' {
+		if nonEmpty {
+			return value, wordEnd + 1, true
+		}
+		return v.Replace(word), wordEnd + 1, true
+	}
+
+	if nonEmpty {
+		return v.Replace(word), wordEnd + 1, true
+	}
+	return "", wordEnd + 1, true
+}
+
+func isVarNameChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
@@ -0,0 +1,116 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type varsReplaceTestEntry struct {
+	name     string
+	input    string
+	expected string
+}
+
+func TestVarsReplace(t *testing.T) {
+	vars := buildVarsReplacer(map[string]string{
+		"arch":       "x86_64",
+		"basearch":   "x86_64",
+		"releasever": "9.2",
+		"empty":      "",
+	})
+
+	testEntries := []varsReplaceTestEntry{
+		{
+			name:     "simple",
+			input:    "https://example.com/$releasever/$basearch/os/",
+			expected: "https://example.com/9.2/x86_64/os/",
+		},
+		{
+			name:     "braces",
+			input:    "https://example.com/${releasever}/${basearch}os/",
+			expected: "https://example.com/9.2/x86_64os/",
+		},
+		{
+			name:     "longest name",
+			input:    "https://example.com/$archive/$arch",
+			expected: "https://example.com/$archive/x86_64",
+		},
+		{
+			name:     "unknown",
+			input:    "https://example.com/$unknown/${unknown}/",
+			expected: "https://example.com/$unknown/${unknown}/",
+		},
+		{
+			name:     "releasever major and minor",
+			input:    "$releasever_major-$releasever_minor",
+			expected: "9-2",
+		},
+		{
+			name:     "derived defaults",
+			input:    "$contentdir/$stream/$infra",
+			expected: "centos/9-stream/stock",
+		},
+		{
+			name:     "default value",
+			input:    "${unknown:-default}/${empty:-default}/${arch:-default}",
+			expected: "default/default/x86_64",
+		},
+		{
+			name:     "alternate value",
+			input:    "${unknown:+alt}/${empty:+alt}/${arch:+alt}",
+			expected: "//alt",
+		},
+		{
+			name:     "nested",
+			input:    "${unknown:-${basearch}-${releasever_major:+major}}",
+			expected: "x86_64-major",
+		},
+		{
+			name:     "escaped",
+			input:    `\$basearch`,
+			expected: "$basearch",
+		},
+		{
+			name:     "unterminated",
+			input:    "${basearch:-foo",
+			expected: "${basearch:-foo",
+		},
+		{
+			name:     "dollar at end",
+			input:    "price$",
+			expected: "price$",
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			assert.Equal(t, entry.expected, vars.Replace(entry.input))
+		})
+	}
+}
+
+func TestVarsOverride(t *testing.T) {
+	builtins := map[string]string{"basearch": "x86_64", "releasever": "8"}
+	varsDir := map[string]string{"basearch": "x86_64_v2", "releasever_major": "8", "stream": "custom"}
+	env := envVars([]string{
+		"DNF_VAR_releasever=9.3",
+		"DNF0=zero",
+		"YUM1=one",
+		"DNF_VAR_=invalid",
+		"HOME=/root",
+	})
+
+	vars := buildVarsReplacer(builtins, varsDir, env)
+
+	assert.Equal(t, "x86_64_v2", vars["basearch"])
+	assert.Equal(t, "9.3", vars["releasever"])
+	// explicitly set variables are not derived
+	assert.Equal(t, "8", vars["releasever_major"])
+	assert.Equal(t, "3", vars["releasever_minor"])
+	assert.Equal(t, "custom", vars["stream"])
+	assert.Equal(t, "zero", vars["DNF0"])
+	assert.Equal(t, "one", vars["YUM1"])
+	assert.NotContains(t, vars, "")
+	assert.NotContains(t, vars, "HOME")
+}
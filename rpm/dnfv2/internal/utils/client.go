@@ -2,26 +2,26 @@ package utils
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"time"
 
 	"github.com/DataDog/nikos/rpm/dnfv2/types"
 )
 
 type FetchedData struct {
-	data    []byte
-	gzipped bool
+	data        []byte
+	compression compression
 }
 
+// Reader returns a reader on the decompressed content
 func (d *FetchedData) Reader() (io.ReadCloser, error) {
-	r := bytes.NewReader(d.data)
-	if d.gzipped {
-		return gzip.NewReader(r)
-	}
-	return io.NopCloser(r), nil
+	return decompressReader(bytes.NewReader(d.data), d.compression)
 }
 
 func (d *FetchedData) Data() ([]byte, error) {
@@ -34,35 +34,47 @@ func (d *FetchedData) Data() ([]byte, error) {
 }
 
 type HttpClient struct {
-	inner *http.Client
+	inner   *http.Client
+	options HttpClientOptions
+}
+
+// HttpClientOptions holds the download settings of the package manager configuration
+type HttpClientOptions struct {
+	// Retries is the number of times a failed download is retried
+	Retries int
+	// MinRate aborts downloads slower than this many bytes per second
+	// over LowSpeedTime, 0 disables the check
+	MinRate      int64
+	LowSpeedTime time.Duration
 }
 
 func NewHttpClientFromInner(inner *http.Client) *HttpClient {
 	return &HttpClient{inner: inner}
 }
 
-func (hc *HttpClient) GetWithChecksum(ctx context.Context, url string, checksum *types.Checksum) (FetchedData, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return FetchedData{}, err
-	}
+func NewHttpClient(inner *http.Client, options HttpClientOptions) *HttpClient {
+	return &HttpClient{inner: inner, options: options}
+}
 
-	resp, err := hc.inner.Do(req)
-	if err != nil {
-		return FetchedData{}, err
-	}
-	defer resp.Body.Close()
+func (hc *HttpClient) GetWithChecksum(ctx context.Context, url string, checksum *types.Checksum) (FetchedData, error) {
+	var (
+		readContent []byte
+		encoding    string
+		err         error
+	)
 
-	if resp.StatusCode != http.StatusOK {
-		return FetchedData{}, fmt.Errorf("bad status for `%s`: %s", url, resp.Status)
+	if IsFileURL(url) {
+		readContent, err = readFileURL(url)
+	} else {
+		readContent, encoding, err = hc.get(ctx, url, "")
 	}
-
-	gzipped := UrlHasSuffix(url, ".gz") || resp.Header.Get("Content-Encoding") == "gzip"
-	readContent, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return FetchedData{}, err
 	}
-	content := FetchedData{data: readContent, gzipped: gzipped}
+	content := FetchedData{
+		data:        readContent,
+		compression: detectCompression(readContent, compressionFromName(url, encoding)),
+	}
 
 	if checksum != nil {
 		contentReader, err := content.Reader()
@@ -71,7 +83,7 @@ func (hc *HttpClient) GetWithChecksum(ctx context.Context, url string, checksum
 		}
 		defer contentReader.Close()
 
-		if err := verifyChecksum(contentReader, checksum); err != nil {
+		if err := VerifyChecksum(contentReader, checksum); err != nil {
 			return FetchedData{}, err
 		}
 	}
@@ -82,3 +94,142 @@ func (hc *HttpClient) GetWithChecksum(ctx context.Context, url string, checksum
 func (hc *HttpClient) Get(ctx context.Context, url string) (FetchedData, error) {
 	return hc.GetWithChecksum(ctx, url, nil)
 }
+
+// ErrRangeNotSupported is returned by GetRange when the server ignores range requests
+var ErrRangeNotSupported = errors.New("range requests not supported")
+
+// GetRange downloads the bytes from start to end, both included, of the content at the given URL
+func (hc *HttpClient) GetRange(ctx context.Context, url string, start, end int64) ([]byte, error) {
+	if IsFileURL(url) {
+		content, err := readFileURL(url)
+		if err != nil {
+			return nil, err
+		}
+		if end >= int64(len(content)) || start > end {
+			return nil, fmt.Errorf("invalid range %d-%d for `%s` of size %d", start, end, url, len(content))
+		}
+		return content[start : end+1], nil
+	}
+
+	content, _, err := hc.get(ctx, url, fmt.Sprintf("bytes=%d-%d", start, end))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) != end-start+1 {
+		return nil, fmt.Errorf("invalid range %d-%d for `%s`: got %d bytes", start, end, url, len(content))
+	}
+	return content, nil
+}
+
+// get downloads the content at the given URL, or only the given byte range when
+// not empty, retrying on failures
+func (hc *HttpClient) get(ctx context.Context, url string, byteRange string) ([]byte, string, error) {
+	var (
+		content  []byte
+		encoding string
+		err      error
+	)
+
+	delay := time.Second
+	for try := 0; try <= hc.options.Retries; try++ {
+		if try > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, "", ctx.Err()
+			}
+			delay = min(delay*2, maxRetryDelay)
+		}
+
+		content, encoding, err = hc.getOnce(ctx, url, byteRange)
+		var statusErr *badStatusError
+		if err == nil || errors.Is(err, ErrRangeNotSupported) || (errors.As(err, &statusErr) && statusErr.code < 500) {
+			break
+		}
+	}
+	return content, encoding, err
+}
+
+type badStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *badStatusError) Error() string {
+	return fmt.Sprintf("bad status for `%s`: %s", e.url, e.status)
+}
+
+func (hc *HttpClient) getOnce(ctx context.Context, url string, byteRange string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+
+	resp, err := hc.inner.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if byteRange != "" && resp.StatusCode == http.StatusOK {
+		return nil, "", ErrRangeNotSupported
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return nil, "", &badStatusError{url: url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	var body io.Reader = resp.Body
+	if hc.options.MinRate > 0 && hc.options.LowSpeedTime > 0 {
+		body = &minRateReader{inner: resp.Body, minRate: hc.options.MinRate, window: hc.options.LowSpeedTime}
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, resp.Header.Get("Content-Encoding"), nil
+}
+
+// readFileURL reads a `file://` URL from the host filesystem, for repositories
+// copied onto the node or mounted from a removable drive
+func readFileURL(rawUrl string) ([]byte, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(HostPathJoin(parsed.Path))
+}
+
+const maxRetryDelay = 30 * time.Second
+
+// minRateReader fails when less than minRate bytes per second are read over a window
+type minRateReader struct {
+	inner       io.Reader
+	minRate     int64
+	window      time.Duration
+	windowStart time.Time
+	windowRead  int64
+}
+
+func (r *minRateReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+	}
+
+	n, err := r.inner.Read(p)
+	r.windowRead += int64(n)
+
+	if elapsed := time.Since(r.windowStart); elapsed >= r.window {
+		if rate := float64(r.windowRead) / elapsed.Seconds(); rate < float64(r.minRate) {
+			return n, fmt.Errorf("download rate %.0f B/s below minrate %d B/s", rate, r.minRate)
+		}
+		r.windowStart = time.Now()
+		r.windowRead = 0
+	}
+	return n, err
+}
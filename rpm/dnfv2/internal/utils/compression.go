@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/xi2/xz"
+)
+
+type compression int
+
+const (
+	noCompression compression = iota
+	gzipCompression
+	zstdCompression
+	xzCompression
+	bzip2Compression
+)
+
+func (c compression) String() string {
+	switch c {
+	case gzipCompression:
+		return "gzip"
+	case zstdCompression:
+		return "zstd"
+	case xzCompression:
+		return "xz"
+	case bzip2Compression:
+		return "bzip2"
+	default:
+		return "none"
+	}
+}
+
+var compressionMagics = []struct {
+	kind  compression
+	magic []byte
+}{
+	{gzipCompression, []byte{0x1f, 0x8b}},
+	{zstdCompression, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{xzCompression, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{bzip2Compression, []byte{'B', 'Z', 'h'}},
+}
+
+// compressionFromName returns the compression implied by a file extension or a Content-Encoding
+func compressionFromName(url string, encoding string) compression {
+	switch {
+	case UrlHasSuffix(url, ".gz") || encoding == "gzip":
+		return gzipCompression
+	case UrlHasSuffix(url, ".zst") || encoding == "zstd":
+		return zstdCompression
+	case UrlHasSuffix(url, ".xz"):
+		return xzCompression
+	case UrlHasSuffix(url, ".bz2"):
+		return bzip2Compression
+	default:
+		return noCompression
+	}
+}
+
+// detectCompression finds the compression of the content from its magic bytes.
+// The hint, from the URL extension or the Content-Encoding, is only used when the magic
+// bytes are unknown and the content does not look like text, so that a corrupted file
+// fails with a decompression error instead of an XML parse error. Content that was already
+// decoded by the transport is returned as is.
+func detectCompression(data []byte, hint compression) compression {
+	for _, m := range compressionMagics {
+		if bytes.HasPrefix(data, m.magic) {
+			return m.kind
+		}
+	}
+
+	if trimmed := bytes.TrimLeft(data, " \t\r\n\ufeff"); len(trimmed) == 0 || trimmed[0] == '<' || bytes.HasPrefix(trimmed, []byte("-----BEGIN")) {
+		return noCompression
+	}
+	return hint
+}
+
+// decompressReader wraps the reader with the decompressor matching the compression kind
+func decompressReader(r io.Reader, kind compression) (io.ReadCloser, error) {
+	var (
+		res io.ReadCloser
+		err error
+	)
+
+	switch kind {
+	case gzipCompression:
+		res, err = gzip.NewReader(r)
+	case zstdCompression:
+		var decoder *zstd.Decoder
+		decoder, err = zstd.NewReader(r)
+		if err == nil {
+			res = decoder.IOReadCloser()
+		}
+	case xzCompression:
+		var xzReader *xz.Reader
+		xzReader, err = xz.NewReader(r, 0)
+		res = io.NopCloser(xzReader)
+	case bzip2Compression:
+		res = io.NopCloser(bzip2.NewReader(r))
+	default:
+		return io.NopCloser(r), nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s compressed content: %w", kind, err)
+	}
+	return &decompressedReader{inner: res, kind: kind}, nil
+}
+
+// decompressedReader annotates the decompression errors with the compression kind,
+// some decompressors only check the header on the first read
+type decompressedReader struct {
+	inner io.ReadCloser
+	kind  compression
+}
+
+func (r *decompressedReader) Read(p []byte) (int, error) {
+	n, err := r.inner.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("failed to read %s compressed content: %w", r.kind, err)
+	}
+	return n, err
+}
+
+func (r *decompressedReader) Close() error {
+	return r.inner.Close()
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+const content = "<a/>"
+
+func mustHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	assert.NoError(t, err)
+	return data
+}
+
+func gzipped(t *testing.T) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write([]byte(content))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	return encoder.EncodeAll([]byte(content), nil)
+}
+
+type compressionTestEntry struct {
+	name     string
+	url      string
+	encoding string
+	data     []byte
+	expected compression
+}
+
+func TestCompression(t *testing.T) {
+	testEntries := []compressionTestEntry{
+		{
+			name:     "plain",
+			url:      "https://example.com/repodata/primary.xml",
+			data:     []byte(content),
+			expected: noCompression,
+		},
+		{
+			name:     "gzip",
+			url:      "https://example.com/repodata/primary.xml.gz",
+			data:     gzipped(t),
+			expected: gzipCompression,
+		},
+		{
+			name:     "gzip content encoding",
+			url:      "https://example.com/repodata/primary.xml",
+			encoding: "gzip",
+			data:     gzipped(t),
+			expected: gzipCompression,
+		},
+		{
+			name:     "zstd",
+			url:      "https://example.com/repodata/primary.xml.zst",
+			data:     zstded(t),
+			expected: zstdCompression,
+		},
+		{
+			name:     "xz",
+			url:      "https://example.com/repodata/primary.xml.xz",
+			data:     mustHex(t, "fd377a585a000004e6d6b44604c008042101160000000000000000004c41bc270100033c612f3e00c43d1de9c5d4cf5c00012404949003d61fb6f37d010000000004595a"),
+			expected: xzCompression,
+		},
+		{
+			name:     "bzip2",
+			url:      "https://example.com/repodata/primary.xml.bz2",
+			data:     mustHex(t, "425a6839314159265359996746ea00000099000000800520002000219a68334d173c5dc914e14242659d1ba8"),
+			expected: bzip2Compression,
+		},
+		{
+			name:     "wrong extension",
+			url:      "https://example.com/repodata/primary.xml.gz",
+			data:     zstded(t),
+			expected: zstdCompression,
+		},
+		{
+			name:     "no extension",
+			url:      "https://example.com/repodata/primary",
+			data:     zstded(t),
+			expected: zstdCompression,
+		},
+		{
+			name:     "already decoded",
+			url:      "https://example.com/repodata/primary.xml.gz",
+			data:     []byte(content),
+			expected: noCompression,
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			fetched := FetchedData{
+				data:        entry.data,
+				compression: detectCompression(entry.data, compressionFromName(entry.url, entry.encoding)),
+			}
+			assert.Equal(t, entry.expected, fetched.compression)
+
+			data, err := fetched.Data()
+			assert.NoError(t, err)
+			assert.Equal(t, content, string(data))
+		})
+	}
+}
+
+func TestCorruptedCompression(t *testing.T) {
+	data := []byte("not zstd")
+	fetched := FetchedData{data: data, compression: detectCompression(data, compressionFromName("https://example.com/primary.xml.zst", ""))}
+
+	_, err := fetched.Data()
+	assert.ErrorContains(t, err, "zstd")
+}
@@ -34,3 +34,21 @@ func HostEtcJoin(parts ...string) string {
 func HostVarJoin(parts ...string) string {
 	return rawHostJoin("HOST_VAR", "/var", parts...)
 }
+
+func HostRootJoin(parts ...string) string {
+	return rawHostJoin("HOST_ROOT", "/", parts...)
+}
+
+// HostPathJoin resolves an absolute path of the host filesystem, using the more
+// specific HOST_ETC and HOST_VAR mount points when they apply
+func HostPathJoin(parts ...string) string {
+	if len(parts) != 0 {
+		switch {
+		case os.Getenv("HOST_ETC") != "" && (strings.HasPrefix(parts[0], "/etc/") || parts[0] == "/etc"):
+			return HostEtcJoin(parts...)
+		case os.Getenv("HOST_VAR") != "" && (strings.HasPrefix(parts[0], "/var/") || parts[0] == "/var"):
+			return HostVarJoin(parts...)
+		}
+	}
+	return HostRootJoin(parts...)
+}
@@ -55,3 +55,57 @@ func TestHostEtcJoin(t *testing.T) {
 		})
 	}
 }
+
+type hostPathJoinTestEntry struct {
+	name        string
+	hostEtcEnv  string
+	hostRootEnv string
+	join        []string
+	expected    string
+}
+
+func TestHostPathJoin(t *testing.T) {
+	testEntries := []hostPathJoinTestEntry{
+		{
+			name:     "no env",
+			join:     []string{"/mnt/repo", "repodata"},
+			expected: "/mnt/repo/repodata",
+		},
+		{
+			name:        "root env",
+			hostRootEnv: "/host",
+			join:        []string{"/mnt/repo", "repodata"},
+			expected:    "/host/mnt/repo/repodata",
+		},
+		{
+			name:        "etc env takes precedence",
+			hostEtcEnv:  "/host/etc",
+			hostRootEnv: "/rootfs",
+			join:        []string{"/etc/pki/rpm-gpg/key"},
+			expected:    "/host/etc/pki/rpm-gpg/key",
+		},
+		{
+			name:        "etc through root env",
+			hostRootEnv: "/rootfs",
+			join:        []string{"/etc/pki/rpm-gpg/key"},
+			expected:    "/rootfs/etc/pki/rpm-gpg/key",
+		},
+		{
+			name:        "etc prefix only",
+			hostEtcEnv:  "/host/etc",
+			hostRootEnv: "/rootfs",
+			join:        []string{"/etcd/data"},
+			expected:    "/rootfs/etcd/data",
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			t.Setenv("HOST_ETC", entry.hostEtcEnv)
+			t.Setenv("HOST_VAR", "")
+			t.Setenv("HOST_ROOT", entry.hostRootEnv)
+			got := HostPathJoin(entry.join...)
+			assert.Equal(t, entry.expected, got)
+		})
+	}
+}
@@ -25,4 +25,6 @@ func UrlHasSuffix(rawUrl string, suffix string) bool {
 	return strings.HasSuffix(parsed.Path, suffix)
 }
 
-
+func IsFileURL(rawUrl string) bool {
+	return strings.HasPrefix(rawUrl, "file:")
+}
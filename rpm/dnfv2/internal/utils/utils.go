@@ -31,7 +31,8 @@ func GetAndUnmarshalXML[T any](ctx context.Context, httpClient *HttpClient, url
 	return &res, nil
 }
 
-func verifyChecksum(reader io.Reader, checksum *types.Checksum) error {
+// VerifyChecksum checks the content of the reader against the expected checksum
+func VerifyChecksum(reader io.Reader, checksum *types.Checksum) error {
 	var hasher hash.Hash
 	switch checksum.Type {
 	case "sha256":
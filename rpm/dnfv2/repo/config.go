@@ -0,0 +1,184 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/internal/utils"
+)
+
+// MainConfigPaths are the package manager configuration files, the first one found is used
+var MainConfigPaths = []string{"/etc/dnf/dnf.conf", "/etc/yum.conf", "/etc/zypp/zypp.conf"}
+
+// DefaultReposDirs are the repository directories used when `reposdir` is not set
+var DefaultReposDirs = []string{"/etc/yum.repos.d", "/etc/yum/repos.d", "/etc/distro.repos.d"}
+
+// MainConfig holds the options of the `[main]` section of the package manager
+// configuration, used as defaults by all repositories. The global `exclude` is not
+// read: it is commonly used to lock the kernel packages (e.g. `exclude=kernel*`),
+// which would hide the headers of the running kernel.
+type MainConfig struct {
+	ReposDirs     []string
+	GpgCheck      bool
+	SSLVerify     bool
+	SSLClientKey  string
+	SSLClientCert string
+	SSLCaCert     string
+	Proxy         string
+	ProxyUsername string
+	ProxyPassword string
+	Timeout       time.Duration
+	Retries       int
+	MinRate       int64
+	IPResolve     string
+	// SkipIfUnavailable defaults to true, unlike dnf, so that a broken repository
+	// does not prevent finding the headers elsewhere when it is not configured
+	SkipIfUnavailable bool
+	// CacheDir is where nikos keeps repository metadata between runs, the cache is
+	// disabled when empty. It is not the dnf `cachedir`, which belongs to the host.
+	CacheDir string
+}
+
+func DefaultMainConfig() MainConfig {
+	return MainConfig{
+		ReposDirs: DefaultReposDirs,
+		SSLVerify: true,
+		Timeout:   30 * time.Second,
+		// dnf retries 10 times by default, which makes unreachable repositories far too slow
+		Retries:           0,
+		MinRate:           1000,
+		SkipIfUnavailable: true,
+	}
+}
+
+// ReadMainConfig reads the `[main]` section of the first configuration file found.
+// Without any, the defaults are returned.
+func ReadMainConfig(paths ...string) (MainConfig, error) {
+	config := DefaultMainConfig()
+
+	for _, path := range paths {
+		path = utils.HostEtcJoin(path)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		cfg, err := ini.Load(path)
+		if err != nil {
+			return config, err
+		}
+
+		if err := config.load(cfg.Section("main")); err != nil {
+			return config, fmt.Errorf("invalid configuration in %s: %w", path, err)
+		}
+		return config, nil
+	}
+
+	return config, nil
+}
+
+func (c *MainConfig) load(section *ini.Section) error {
+	if reposDir := section.Key("reposdir").String(); reposDir != "" {
+		c.ReposDirs = splitList(reposDir)
+	}
+
+	c.GpgCheck = section.Key("gpgcheck").MustBool(c.GpgCheck)
+	c.SSLVerify = section.Key("sslverify").MustBool(c.SSLVerify)
+	c.SSLClientKey = section.Key("sslclientkey").MustString(c.SSLClientKey)
+	c.SSLClientCert = section.Key("sslclientcert").MustString(c.SSLClientCert)
+	c.SSLCaCert = section.Key("sslcacert").MustString(c.SSLCaCert)
+	c.Proxy = section.Key("proxy").MustString(c.Proxy)
+	c.ProxyUsername = section.Key("proxy_username").MustString(c.ProxyUsername)
+	c.ProxyPassword = section.Key("proxy_password").MustString(c.ProxyPassword)
+	c.IPResolve = section.Key("ip_resolve").MustString(c.IPResolve)
+	c.SkipIfUnavailable = section.Key("skip_if_unavailable").MustBool(c.SkipIfUnavailable)
+
+	var err error
+	if c.Timeout, err = parseSeconds(section, c.Timeout, "timeout", "download.connect_timeout"); err != nil {
+		return err
+	}
+	if c.Retries, err = parseInt(section, c.Retries, "retries", "download.max_silent_tries"); err != nil {
+		return err
+	}
+	if c.MinRate, err = parseRate(section, c.MinRate, "minrate", "download.min_download_speed"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// firstKey returns the first key set among the dnf/yum name and the zypp.conf name
+func firstKey(section *ini.Section, names ...string) *ini.Key {
+	for _, name := range names {
+		if section.HasKey(name) && section.Key(name).String() != "" {
+			return section.Key(name)
+		}
+	}
+	return nil
+}
+
+func parseSeconds(section *ini.Section, dfault time.Duration, names ...string) (time.Duration, error) {
+	key := firstKey(section, names...)
+	if key == nil {
+		return dfault, nil
+	}
+
+	seconds, err := strconv.ParseFloat(key.String(), 64)
+	if err != nil {
+		return dfault, fmt.Errorf("invalid %s `%s`", key.Name(), key.String())
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func parseInt(section *ini.Section, dfault int, names ...string) (int, error) {
+	key := firstKey(section, names...)
+	if key == nil {
+		return dfault, nil
+	}
+
+	value, err := strconv.Atoi(key.String())
+	if err != nil {
+		return dfault, fmt.Errorf("invalid %s `%s`", key.Name(), key.String())
+	}
+	return value, nil
+}
+
+// parseRate reads a rate in bytes per second, with an optional k, M or G suffix
+func parseRate(section *ini.Section, dfault int64, names ...string) (int64, error) {
+	key := firstKey(section, names...)
+	if key == nil {
+		return dfault, nil
+	}
+
+	value := strings.TrimSpace(key.String())
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return dfault, fmt.Errorf("invalid %s `%s`", key.Name(), key.String())
+	}
+	return int64(rate * float64(multiplier)), nil
+}
+
+// splitList splits a list option, whose values can be separated by spaces or commas
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
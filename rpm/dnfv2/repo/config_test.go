@@ -0,0 +1,182 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeEtcFiles writes files, given by their path under /etc, in a temporary HOST_ETC
+func writeEtcFiles(t *testing.T, files map[string]string) {
+	hostEtc := t.TempDir()
+	t.Setenv("HOST_ETC", hostEtc)
+	for path, content := range files {
+		path = filepath.Join(hostEtc, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+type mainConfigTestEntry struct {
+	name     string
+	files    map[string]string
+	expected func(*MainConfig)
+	err      bool
+}
+
+func TestReadMainConfig(t *testing.T) {
+	testEntries := []mainConfigTestEntry{
+		{
+			name:     "no configuration",
+			expected: func(*MainConfig) {},
+		},
+		{
+			name: "zypp.conf",
+			files: map[string]string{
+				"zypp/zypp.conf": "[main]\ndownload.connect_timeout = 60\ndownload.max_silent_tries = 3\ndownload.min_download_speed = 2k\n",
+			},
+			expected: func(c *MainConfig) {
+				c.Timeout = 60 * time.Second
+				c.Retries = 3
+				c.MinRate = 2048
+			},
+		},
+		{
+			name: "yum.conf over zypp.conf",
+			files: map[string]string{
+				"yum.conf":       "[main]\ngpgcheck=1\ntimeout=15\nproxy=http://yum-proxy:3128\n",
+				"zypp/zypp.conf": "[main]\ndownload.connect_timeout = 60\n",
+			},
+			expected: func(c *MainConfig) {
+				c.GpgCheck = true
+				c.Timeout = 15 * time.Second
+				c.Proxy = "http://yum-proxy:3128"
+			},
+		},
+		{
+			name: "dnf.conf over yum.conf",
+			files: map[string]string{
+				"dnf/dnf.conf": "[main]\ngpgcheck=True\nsslverify=False\nminrate=1M\nskip_if_unavailable=False\n",
+				"yum.conf":     "[main]\ntimeout=15\nproxy=http://yum-proxy:3128\n",
+			},
+			expected: func(c *MainConfig) {
+				c.GpgCheck = true
+				c.SSLVerify = false
+				c.MinRate = 1 << 20
+				c.SkipIfUnavailable = false
+			},
+		},
+		{
+			name: "empty dnf.conf",
+			files: map[string]string{
+				"dnf/dnf.conf": "",
+				"yum.conf":     "[main]\ngpgcheck=1\n",
+			},
+			expected: func(*MainConfig) {},
+		},
+		{
+			name: "reposdir",
+			files: map[string]string{
+				"dnf/dnf.conf": "[main]\nreposdir=/etc/yum.repos.d, /etc/custom.repos.d /opt/repos\n",
+			},
+			expected: func(c *MainConfig) {
+				c.ReposDirs = []string{"/etc/yum.repos.d", "/etc/custom.repos.d", "/opt/repos"}
+			},
+		},
+		{
+			name: "invalid timeout",
+			files: map[string]string{
+				"dnf/dnf.conf": "[main]\ntimeout=never\n",
+			},
+			err: true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			writeEtcFiles(t, testEntry.files)
+
+			config, err := ReadMainConfig(MainConfigPaths...)
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			expected := DefaultMainConfig()
+			testEntry.expected(&expected)
+			assert.Equal(t, expected, config)
+		})
+	}
+}
+
+type repoOverridesTestEntry struct {
+	name      string
+	section   string
+	gpgCheck  bool
+	sslVerify bool
+	proxy     string
+	timeout   time.Duration
+}
+
+func TestReadRepoOverrides(t *testing.T) {
+	const mainConfig = "[main]\ngpgcheck=1\nsslverify=0\nproxy=http://proxy:3128\ntimeout=10\n"
+
+	testEntries := []repoOverridesTestEntry{
+		{
+			name:      "main defaults",
+			section:   "[baseos]\nbaseurl=https://example.com/baseos\n",
+			gpgCheck:  true,
+			sslVerify: false,
+			proxy:     "http://proxy:3128",
+			timeout:   10 * time.Second,
+		},
+		{
+			name:      "overrides",
+			section:   "[baseos]\nbaseurl=https://example.com/baseos\ngpgcheck=0\nsslverify=1\nproxy=http://repo-proxy:8080\ntimeout=2.5\n",
+			gpgCheck:  false,
+			sslVerify: true,
+			proxy:     "http://repo-proxy:8080",
+			timeout:   2500 * time.Millisecond,
+		},
+		{
+			name:      "empty proxy",
+			section:   "[baseos]\nbaseurl=https://example.com/baseos\nproxy=\n",
+			gpgCheck:  true,
+			sslVerify: false,
+			proxy:     "",
+			timeout:   10 * time.Second,
+		},
+		{
+			name:      "no proxy",
+			section:   "[baseos]\nbaseurl=https://example.com/baseos\nproxy=_none_\n",
+			gpgCheck:  true,
+			sslVerify: false,
+			proxy:     "_none_",
+			timeout:   10 * time.Second,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			writeEtcFiles(t, map[string]string{
+				"dnf/dnf.conf":          mainConfig,
+				"yum.repos.d/test.repo": testEntry.section,
+			})
+
+			config, err := ReadMainConfig(MainConfigPaths...)
+			require.NoError(t, err)
+			repos, err := ReadFromDirWithDefaults("/etc/yum.repos.d", config)
+			require.NoError(t, err)
+			require.Len(t, repos, 1)
+			assert.Equal(t, testEntry.gpgCheck, repos[0].GpgCheck)
+			assert.Equal(t, testEntry.sslVerify, repos[0].SSLVerify)
+			assert.Equal(t, testEntry.proxy, repos[0].Proxy)
+			assert.Equal(t, testEntry.timeout, repos[0].Timeout)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/internal/utils"
+)
+
+// Koji downloads packages from the build system of a distribution, for the builds
+// that rotated out of its repositories. Koji stores the signed copies of a build
+// under data/signed/<key id>, only those signed with one of GpgKeys are downloaded.
+type Koji struct {
+	// PackagesURL is the URL of the packages directory of the Koji files
+	PackagesURL string
+	GpgKeys     []string
+	// Transports is shared with the repositories, a new transport is created when not set
+	Transports *TransportPool
+}
+
+// DownloadPackage downloads a package built from buildName, e.g. kernel for kernel-devel
+func (k *Koji) DownloadPackage(ctx context.Context, buildName string, header *PkgInfoHeader) (*PkgInfo, []byte, error) {
+	if len(k.GpgKeys) == 0 {
+		return nil, nil, errors.New("no gpg key configured for koji")
+	}
+
+	r := &Repo{Name: "koji", BaseURL: k.PackagesURL, GpgCheck: true, GpgKeys: k.GpgKeys, SSLVerify: true, Transports: k.Transports}
+	httpClient, err := r.createHTTPClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entities, keyErr := readGPGKeys(ctx, httpClient, k.GpgKeys)
+	if len(entities) == 0 {
+		return nil, nil, fmt.Errorf("failed to read gpg key: %w", keyErr.ErrorOrNil())
+	}
+
+	var mErr error
+	for _, sigKey := range kojiSigKeys(entities) {
+		pkgURL, err := kojiPackageURL(k.PackagesURL, buildName, sigKey, header)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fetched, err := httpClient.Get(ctx, pkgURL)
+		if err != nil {
+			mErr = multierror.Append(mErr, err)
+			continue
+		}
+		data, err := fetched.Data()
+		if err != nil {
+			mErr = multierror.Append(mErr, err)
+			continue
+		}
+
+		if err := verifyPackageSignature(bytes.NewReader(data), entities); err != nil {
+			mErr = multierror.Append(mErr, fmt.Errorf("failed to verify `%s`: %w", pkgURL, err))
+			continue
+		}
+
+		return &PkgInfo{Header: *header, Location: pkgURL}, data, nil
+	}
+	return nil, nil, fmt.Errorf("failed to download %s-%s.%s from koji: %w", header.Name, header.Version.EVR(), header.Arch, mErr)
+}
+
+// kojiSigKeys returns the key ids used by Koji for the signing keys and subkeys
+func kojiSigKeys(entities openpgp.EntityList) []string {
+	var sigKeys []string
+	seen := make(map[string]bool)
+	for _, entity := range entities {
+		keyIDs := []uint64{entity.PrimaryKey.KeyId}
+		for _, subkey := range entity.Subkeys {
+			keyIDs = append(keyIDs, subkey.PublicKey.KeyId)
+		}
+
+		for _, keyID := range keyIDs {
+			sigKey := fmt.Sprintf("%08x", uint32(keyID))
+			if !seen[sigKey] {
+				seen[sigKey] = true
+				sigKeys = append(sigKeys, sigKey)
+			}
+		}
+	}
+	return sigKeys
+}
+
+func kojiPackageURL(packagesURL, buildName, sigKey string, header *PkgInfoHeader) (string, error) {
+	fileName := fmt.Sprintf("%s-%s-%s.%s.rpm", header.Name, header.Ver, header.Rel, header.Arch)
+	return utils.UrlJoinPath(packagesURL, buildName, header.Ver, header.Rel, "data", "signed", sigKey, header.Arch, fileName)
+}
@@ -0,0 +1,22 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/types"
+)
+
+func TestKojiPackageURL(t *testing.T) {
+	header := &PkgInfoHeader{
+		Name:    "kernel-devel",
+		Version: types.Version{Ver: "5.14.0", Rel: "362.el9"},
+		Arch:    "x86_64",
+	}
+
+	pkgURL, err := kojiPackageURL("https://kojihub.stream.centos.org/kojifiles/packages/", "kernel", "8483c65d", header)
+	require.NoError(t, err)
+	assert.Equal(t, "https://kojihub.stream.centos.org/kojifiles/packages/kernel/5.14.0/362.el9/data/signed/8483c65d/x86_64/kernel-devel-5.14.0-362.el9.x86_64.rpm", pkgURL)
+}
@@ -2,9 +2,8 @@ package repo
 
 import (
 	"bufio"
+	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -15,6 +14,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"gopkg.in/ini.v1"
@@ -40,9 +40,42 @@ type Repo struct {
 	SSLClientKey  string
 	SSLClientCert string
 	SSLCaCert     string
+	Proxy         string
+	ProxyUsername string
+	ProxyPassword string
+	Timeout       time.Duration
+	Retries       int
+	MinRate       int64
+	IPResolve     string
+	// Priority orders the repositories, lower values first, regardless of the
+	// package versions. Cost orders repositories of the same priority.
+	Priority          int
+	Cost              int
+	IncludePkgs       []string
+	ExcludePkgs       []string
+	SkipIfUnavailable bool
+	// Fallback repositories are only searched when the other repositories do not
+	// provide the package
+	Fallback bool
+	// CacheDir is the metadata cache root, empty to disable the cache
+	CacheDir string
+	// Transports is shared by the repositories of a backend, a new transport
+	// is created for each download when not set
+	Transports *TransportPool
 }
 
+const (
+	DefaultPriority = 99
+	DefaultCost     = 1000
+)
+
 func ReadFromDir(repoDir string) ([]Repo, error) {
+	return ReadFromDirWithDefaults(repoDir, DefaultMainConfig())
+}
+
+// ReadFromDirWithDefaults reads the repositories of a directory, the options not
+// set in a repository section are taken from the main configuration
+func ReadFromDirWithDefaults(repoDir string, defaults MainConfig) ([]Repo, error) {
 	repoFiles, err := filepath.Glob(utils.HostEtcJoin(repoDir, "*.repo"))
 	if err != nil {
 		return nil, err
@@ -68,12 +101,37 @@ func ReadFromDir(repoDir string) ([]Repo, error) {
 			repo.MetaLink = section.Key("metalink").String()
 			repo.Type = section.Key("type").String()
 			repo.Enabled = section.Key("enabled").MustBool()
-			repo.GpgCheck = section.Key("gpgcheck").MustBool()
+			repo.GpgCheck = section.Key("gpgcheck").MustBool(defaults.GpgCheck)
 			repo.GpgKeys = strings.Split(section.Key("gpgkey").String(), ",")
-			repo.SSLVerify = section.Key("sslverify").MustBool(true)
-			repo.SSLClientKey = section.Key("sslclientkey").String()
-			repo.SSLClientCert = section.Key("sslclientcert").String()
-			repo.SSLCaCert = section.Key("sslcacert").String()
+			repo.SSLVerify = section.Key("sslverify").MustBool(defaults.SSLVerify)
+			repo.SSLClientKey = section.Key("sslclientkey").MustString(defaults.SSLClientKey)
+			repo.SSLClientCert = section.Key("sslclientcert").MustString(defaults.SSLClientCert)
+			repo.SSLCaCert = section.Key("sslcacert").MustString(defaults.SSLCaCert)
+			repo.Proxy = defaults.Proxy
+			if section.HasKey("proxy") {
+				// an empty proxy disables the global one
+				repo.Proxy = section.Key("proxy").String()
+			}
+			repo.ProxyUsername = section.Key("proxy_username").MustString(defaults.ProxyUsername)
+			repo.ProxyPassword = section.Key("proxy_password").MustString(defaults.ProxyPassword)
+			repo.IPResolve = section.Key("ip_resolve").MustString(defaults.IPResolve)
+
+			if repo.Timeout, err = parseSeconds(section, defaults.Timeout, "timeout"); err != nil {
+				return nil, fmt.Errorf("repo %s: %w", repo.SectionName, err)
+			}
+			if repo.Retries, err = parseInt(section, defaults.Retries, "retries"); err != nil {
+				return nil, fmt.Errorf("repo %s: %w", repo.SectionName, err)
+			}
+			if repo.MinRate, err = parseRate(section, defaults.MinRate, "minrate"); err != nil {
+				return nil, fmt.Errorf("repo %s: %w", repo.SectionName, err)
+			}
+
+			repo.Priority = section.Key("priority").MustInt(DefaultPriority)
+			repo.Cost = section.Key("cost").MustInt(DefaultCost)
+			repo.IncludePkgs = splitList(section.Key("includepkgs").String())
+			repo.ExcludePkgs = append(splitList(section.Key("excludepkgs").String()), splitList(section.Key("exclude").String())...)
+			repo.SkipIfUnavailable = section.Key("skip_if_unavailable").MustBool(defaults.SkipIfUnavailable)
+			repo.CacheDir = defaults.CacheDir
 
 			// hack for yast2 repo support
 			if repo.Type == "yast2" && repo.BaseURL != "" {
@@ -101,54 +159,147 @@ type PkgInfoHeader struct {
 type PkgMatchFunc = func(*PkgInfoHeader) bool
 
 func (r *Repo) createHTTPClient() (*utils.HttpClient, error) {
-	var certs []tls.Certificate
-	if r.SSLClientCert != "" || r.SSLClientKey != "" {
-		cert, err := tls.LoadX509KeyPair(utils.HostEtcJoin(r.SSLClientCert), utils.HostEtcJoin(r.SSLClientKey))
-		if err != nil {
-			return nil, fmt.Errorf("failed to load SSL certificate: %w", err)
-		}
-		certs = append(certs, cert)
+	pool := r.Transports
+	if pool == nil {
+		pool = NewTransportPool()
 	}
 
-	var certPool *x509.CertPool
-	if r.SSLCaCert != "" {
-		certPool = x509.NewCertPool()
-		customPem, err := os.ReadFile(utils.HostEtcJoin(r.SSLCaCert))
-		if err != nil {
-			return nil, fmt.Errorf("failed to read custom CA cert")
-		}
-		if !certPool.AppendCertsFromPEM(customPem) {
-			return nil, fmt.Errorf("failed to add custom CA cert to cert pool")
-		}
+	transport, err := pool.transport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return utils.NewHttpClient(&http.Client{Transport: transport}, utils.HttpClientOptions{
+		Retries:      r.Retries,
+		MinRate:      r.MinRate,
+		LowSpeedTime: r.timeout(),
+	}), nil
+}
+
+func (r *Repo) timeout() time.Duration {
+	if r.Timeout <= 0 {
+		return DefaultMainConfig().Timeout
 	}
+	return r.Timeout
+}
 
-	inner := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: !r.SSLVerify,
-				Certificates:       certs,
-				RootCAs:            certPool,
-			},
-		},
+// proxyFunc returns the proxy configured for the repository, or the one from the
+// environment when there is none. `_none_` disables the proxy.
+func (r *Repo) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	switch r.Proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "_none_":
+		return nil, nil
 	}
 
-	return utils.NewHttpClientFromInner(inner), nil
+	proxyURL, err := url.Parse(r.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy `%s`: %w", r.Proxy, err)
+	}
+	if r.ProxyUsername != "" {
+		proxyURL.User = url.UserPassword(r.ProxyUsername, r.ProxyPassword)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// ipResolveNetwork returns the network to dial, according to `ip_resolve`
+func ipResolveNetwork(ipResolve string) string {
+	switch strings.ToLower(ipResolve) {
+	case "4", "ipv4":
+		return "tcp4"
+	case "6", "ipv6":
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// UnavailableError is returned when the metadata of a repository cannot be fetched
+type UnavailableError struct {
+	Repo string
+	Err  error
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("repository %s is unavailable: %s", e.Repo, e.Err)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// IsPackageAllowed applies `includepkgs` and `excludepkgs` to a package name
+func (r *Repo) IsPackageAllowed(name string) bool {
+	if len(r.IncludePkgs) != 0 && !matchAnyPattern(r.IncludePkgs, name) {
+		return false
+	}
+	return !matchAnyPattern(r.ExcludePkgs, name)
+}
+
+func matchAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, err := filepath.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
 }
 
+// FetchPackage downloads the newest package of the repository accepted by the matcher
 func (r *Repo) FetchPackage(ctx context.Context, pkgMatcher PkgMatchFunc) (*PkgInfo, []byte, error) {
-	httpClient, err := r.createHTTPClient()
+	pkgs, err := r.FindPackages(ctx, pkgMatcher)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	repoMd, err := r.FetchRepoMD(ctx, httpClient)
+	data, err := r.DownloadPackage(ctx, pkgs[0])
 	if err != nil {
 		return nil, nil, err
 	}
+	return pkgs[0], data, nil
+}
+
+// FindPackages returns all the packages of the repository accepted by the matcher,
+// newest first
+func (r *Repo) FindPackages(ctx context.Context, pkgMatcher PkgMatchFunc) ([]*PkgInfo, error) {
+	httpClient, err := r.createHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	repoMd, err := r.FetchRepoMD(ctx, httpClient)
+	if err != nil {
+		return nil, &UnavailableError{Repo: r.Name, Err: err}
+	}
+
+	if len(r.IncludePkgs) != 0 || len(r.ExcludePkgs) != 0 {
+		matcher := pkgMatcher
+		pkgMatcher = func(pkg *PkgInfoHeader) bool {
+			return r.IsPackageAllowed(pkg.Name) && matcher(pkg)
+		}
+	}
+
+	pkgs, err := r.FetchPackagesFromList(ctx, httpClient, repoMd, pkgMatcher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find valid package from repo %s: %w", r.Name, err)
+	}
+
+	SortPackages(pkgs)
+	return pkgs, nil
+}
+
+// DownloadPackage downloads a package of the repository. When `gpgcheck` is enabled,
+// unsigned packages and those signed with other keys than `gpgkey` are rejected.
+func (r *Repo) DownloadPackage(ctx context.Context, pkgInfo *PkgInfo) ([]byte, error) {
+	httpClient, err := r.createHTTPClient()
+	if err != nil {
+		return nil, err
+	}
 
 	fetchURL, err := r.FetchURL(ctx, httpClient)
 	if err != nil {
-		return nil, nil, err
+		return nil, &UnavailableError{Repo: r.Name, Err: err}
 	}
 
 	var entityList openpgp.EntityList
@@ -156,41 +307,89 @@ func (r *Repo) FetchPackage(ctx context.Context, pkgMatcher PkgMatchFunc) (*PkgI
 		el, err := readGPGKeys(ctx, httpClient, r.GpgKeys)
 		// if we found keys we can ignore the error
 		if err != nil && len(el) == 0 {
-			return nil, nil, fmt.Errorf("failed to read gpg key: %w", err)
+			return nil, fmt.Errorf("failed to read gpg key: %w", err)
 		}
 		entityList = el
 	}
 
-	pkgInfo, err := r.FetchPackageFromList(ctx, httpClient, repoMd, pkgMatcher)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to find valid package from repo %s: %w", r.Name, err)
-	}
-
 	pkgUrl, err := utils.UrlJoinPath(fetchURL, pkgInfo.Location)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	pkgRpm, err := httpClient.GetWithChecksum(ctx, pkgUrl, pkgInfo.Checksum)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	if r.GpgCheck {
 		rpmReader, err := pkgRpm.Reader()
+		if err != nil {
+			return nil, err
+		}
 		defer rpmReader.Close()
 
-		if err != nil {
-			return nil, nil, err
+		if err := verifyPackageSignature(rpmReader, entityList); err != nil {
+			return nil, err
 		}
-		_, _, err = rpmutils.Verify(rpmReader, entityList)
-		if err != nil {
-			return nil, nil, err
+	}
+
+	return pkgRpm.Data()
+}
+
+// verifyPackageSignature checks that a package is signed by one of the keys, as dnf
+// does with gpgcheck. rpmutils.Verify accepts packages without signature, and does
+// not check the signer when no key is given.
+func verifyPackageSignature(rpm io.Reader, entities openpgp.EntityList) error {
+	_, sigs, err := rpmutils.Verify(rpm, entities)
+	if err != nil {
+		return err
+	}
+	if len(sigs) == 0 {
+		return errors.New("package is not signed")
+	}
+
+	for _, sig := range sigs {
+		if sig.Signer == nil || !containsEntity(entities, sig.Signer) {
+			return fmt.Errorf("package is signed with unknown key %016X", sig.KeyId)
+		}
+	}
+	return nil
+}
+
+func containsEntity(entities openpgp.EntityList, entity *openpgp.Entity) bool {
+	for _, e := range entities {
+		if bytes.Equal(e.PrimaryKey.Fingerprint, entity.PrimaryKey.Fingerprint) {
+			return true
 		}
 	}
+	return false
+}
+
+// SortPackages sorts packages from the newest to the oldest, comparing their EVR.
+// For the same EVR, architecture specific packages come before noarch ones.
+func SortPackages(pkgs []*PkgInfo) {
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return ComparePackages(pkgs[i], pkgs[j]) > 0
+	})
+}
+
+// ComparePackages returns 1 if a should be preferred over b, -1 if b should
+// be preferred, and 0 if they are equivalent
+func ComparePackages(a, b *PkgInfo) int {
+	if c := a.Header.Version.Compare(b.Header.Version); c != 0 {
+		return c
+	}
 
-	pkgRpmData, err := pkgRpm.Data()
-	return pkgInfo, pkgRpmData, err
+	aNoarch, bNoarch := a.Header.Arch == "noarch", b.Header.Arch == "noarch"
+	switch {
+	case aNoarch == bNoarch:
+		return 0
+	case bNoarch:
+		return 1
+	default:
+		return -1
+	}
 }
 
 func readGPGKeys(ctx context.Context, httpClient *utils.HttpClient, gpgKeys []string) (openpgp.EntityList, *multierror.Error) {
@@ -214,7 +413,7 @@ func readGPGKeys(ctx context.Context, httpClient *utils.HttpClient, gpgKeys []st
 
 		var publicKeyReader io.Reader
 		if gpgKeyUrl.Scheme == "file" {
-			publicKeyFile, err := os.Open(utils.HostEtcJoin(gpgKeyUrl.Path))
+			publicKeyFile, err := os.Open(utils.HostPathJoin(gpgKeyUrl.Path))
 			if err != nil {
 				errors = multierror.Append(errors, err)
 				continue
@@ -365,28 +564,43 @@ func fetchURLFromMetaLink(ctx context.Context, httpClient *utils.HttpClient, met
 	return "", fmt.Errorf("failed to fetch base URL from meta link: %s", metaLinkURL)
 }
 
+// FetchPackageFromList returns the newest package of the primary metadata accepted by the matcher
 func (r *Repo) FetchPackageFromList(ctx context.Context, httpClient *utils.HttpClient, repoMd *types.Repomd, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
+	pkgs, err := r.FetchPackagesFromList(ctx, httpClient, repoMd, pkgMatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	SortPackages(pkgs)
+	return pkgs[0], nil
+}
+
+// FetchPackagesFromList returns all the packages of the primary metadata accepted by the matcher
+func (r *Repo) FetchPackagesFromList(ctx context.Context, httpClient *utils.HttpClient, repoMd *types.Repomd, pkgMatcher PkgMatchFunc) ([]*PkgInfo, error) {
 	fetchURL, err := r.FetchURL(ctx, httpClient)
 	if err != nil {
 		return nil, err
 	}
 
+	var zckData *types.RepomdData
+	for i := range repoMd.Data {
+		if repoMd.Data[i].Type == "primary_zck" {
+			zckData = &repoMd.Data[i]
+		}
+	}
+
+	var res []*PkgInfo
 	for _, d := range repoMd.Data {
 		if d.Type == "primary" {
-			primaryURL, err := utils.UrlJoinPath(fetchURL, d.Location.Href)
+			openPrimary, err := r.fetchPrimary(ctx, httpClient, fetchURL, &d, zckData)
 			if err != nil {
 				return nil, err
 			}
 
-			primaryContent, err := httpClient.GetWithChecksum(ctx, primaryURL, &d.OpenChecksum)
-			if err != nil {
-				return nil, err
-			}
-
-			var pkgInfo *PkgInfo
+			var pkgInfos []*PkgInfo
 			for _, path := range []xmlPkgPath{fastPath, slowPath} {
-				pkgInfo, err = func(path xmlPkgPath) (*PkgInfo, error) {
-					primaryContentReader, err := primaryContent.Reader()
+				pkgInfos, err = func(path xmlPkgPath) ([]*PkgInfo, error) {
+					primaryContentReader, err := openPrimary()
 					if err != nil {
 						return nil, err
 					}
@@ -395,30 +609,63 @@ func (r *Repo) FetchPackageFromList(ctx context.Context, httpClient *utils.HttpC
 					return path(primaryContentReader, pkgMatcher)
 				}(path)
 
-				if err != nil {
-					continue
-				}
-				if pkgInfo != nil {
-					return pkgInfo, nil
-				}
-
 				// if we found nothing but no error we don't run the slow path
-				break
+				if err == nil {
+					break
+				}
 			}
 
 			// if the slow path returns an error we fire it
 			if err != nil {
 				return nil, err
 			}
+			res = append(res, pkgInfos...)
 		}
 	}
 
-	return nil, errors.New("no matching package found")
+	if len(res) == 0 {
+		return nil, errors.New("no matching package found")
+	}
+	return res, nil
 }
 
-type xmlPkgPath = func(io.Reader, PkgMatchFunc) (*PkgInfo, error)
+// fetchPrimary downloads the primary metadata and returns a function opening it. When the
+// metadata cache holds a zchunk copy, only the chunks changed since are downloaded, falling
+// back to the usual metadata on failure. The cache is then seeded, or replaced, for the next runs.
+func (r *Repo) fetchPrimary(ctx context.Context, httpClient *utils.HttpClient, fetchURL string, primaryData, zckData *types.RepomdData) (func() (io.ReadCloser, error), error) {
+	var zckURL string
+	if zckData != nil && r.metadataCacheDir() != "" {
+		if u, err := utils.UrlJoinPath(fetchURL, zckData.Location.Href); err == nil {
+			zckURL = u
+		}
+	}
 
-func fastPath(reader io.Reader, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
+	if zckURL != "" && r.hasCachedZck() {
+		if openPrimary, err := r.fetchPrimaryZck(ctx, httpClient, zckURL, zckData); err == nil {
+			return openPrimary, nil
+		}
+	}
+
+	primaryURL, err := utils.UrlJoinPath(fetchURL, primaryData.Location.Href)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryContent, err := httpClient.GetWithChecksum(ctx, primaryURL, &primaryData.OpenChecksum)
+	if err != nil {
+		return nil, err
+	}
+
+	if zckURL != "" {
+		// the cache is best effort
+		_ = r.seedZckCache(ctx, httpClient, zckURL, zckData)
+	}
+	return primaryContent.Reader, nil
+}
+
+type xmlPkgPath = func(io.Reader, PkgMatchFunc) ([]*PkgInfo, error)
+
+func fastPath(reader io.Reader, pkgMatcher PkgMatchFunc) ([]*PkgInfo, error) {
 	handler := &PkgHandler{
 		matcher: pkgMatcher,
 	}
@@ -426,8 +673,11 @@ func fastPath(reader io.Reader, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
 	if err := decoder.Parse(); err != nil {
 		return nil, err
 	}
+	if handler.err != nil {
+		return nil, handler.err
+	}
 
-	return handler.winner, nil
+	return handler.matches, nil
 }
 
 type parseState int
@@ -443,164 +693,176 @@ const (
 	InChecksum
 )
 
+// PkgHandler is the xmlite handler of the fast path. The fields of each package are
+// buffered, whatever their order, and the package is matched at its end tag.
 type PkgHandler struct {
 	err     error
 	matcher PkgMatchFunc
-	winner  *PkgInfo
+	matches []*PkgInfo
 	state   parseState
-	current *TempPkgInfo
+	// skipDepth counts the nested elements that are not read
+	skipDepth int
+	// current is the package being read, its provides are reused by the next package
+	current types.Package
 }
 
-type TempPkgInfo struct {
-	arch      string
-	location  string
-	checksum  *types.Checksum
-	currEntry *TempProvides
-}
-
-type TempProvides struct {
-	name  string
-	epoch string
-	ver   string
-	rel   string
+// localName removes the namespace prefix of a name
+func localName(name []byte) []byte {
+	if i := bytes.LastIndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
 }
 
 func (ph *PkgHandler) StartTag(name []byte) {
-	switch string(name) {
-	case "package":
-		ph.state = InPackage
-		ph.current = &TempPkgInfo{}
-	case "arch":
-		if ph.state == InPackage {
-			ph.state = InArch
-		}
-	case "location":
-		if ph.state == InPackage {
-			ph.state = InLocation
-		}
-	case "checksum":
-		if ph.state == InPackage {
-			ph.state = InChecksum
-			if ph.current != nil {
-				ph.current.checksum = &types.Checksum{}
-			}
-		}
-	case "format":
-		if ph.state == InPackage {
-			ph.state = InFormat
-		}
-	case "rpm:provides":
-		if ph.state == InFormat {
-			ph.state = InProvides
-		}
-	case "rpm:entry":
-		if ph.state == InProvides {
-			ph.state = InEntry
-			if ph.current != nil {
-				ph.current.currEntry = &TempProvides{}
-			}
-		}
+	if ph.skipDepth > 0 {
+		ph.skipDepth++
+		return
 	}
+
+	next := ph.state
+	switch local := string(localName(name)); {
+	case ph.state == Start && local == "package":
+		next = InPackage
+		ph.current = types.Package{Provides: ph.current.Provides[:0]}
+	case ph.state == Start:
+		// root element
+	case ph.state == InPackage && local == "arch":
+		next = InArch
+	case ph.state == InPackage && local == "location":
+		next = InLocation
+	case ph.state == InPackage && local == "checksum":
+		next = InChecksum
+	case ph.state == InPackage && local == "format":
+		next = InFormat
+	case ph.state == InFormat && local == "provides":
+		next = InProvides
+	case ph.state == InProvides && local == "entry":
+		next = InEntry
+		ph.current.Provides = append(ph.current.Provides, types.Provides{})
+	default:
+		ph.skipDepth++
+	}
+	ph.state = next
 }
 
 func (ph *PkgHandler) EndTag(name []byte) {
-	switch string(name) {
-	case "package":
-		ph.state = Start
-		ph.current = nil
-	case "arch":
-		if ph.state == InArch {
-			ph.state = InPackage
-		}
-	case "location":
-		if ph.state == InLocation {
-			ph.state = InPackage
-		}
-	case "checksum":
-		if ph.state == InChecksum {
-			ph.state = InPackage
-		}
-	case "format":
-		if ph.state == InFormat {
-			ph.state = InPackage
-		}
-	case "rpm:provides":
-		if ph.state == InProvides {
-			ph.state = InFormat
-		}
-	case "rpm:entry":
-		if ph.state == InEntry {
-			ph.state = InProvides
-			if ph.current != nil && ph.current.currEntry != nil && !strings.Contains(ph.current.currEntry.name, "(") && ph.matcher != nil && ph.winner == nil {
-				if ph.current.arch == "" {
-					ph.err = errors.New("arch declared after entry, fast path impossible")
-				}
+	if ph.skipDepth > 0 {
+		ph.skipDepth--
+		return
+	}
 
-				pkgInfo := &PkgInfo{
-					Header: PkgInfoHeader{
-						Name: ph.current.currEntry.name,
-						Version: types.Version{
-							Epoch: ph.current.currEntry.epoch,
-							Ver:   ph.current.currEntry.ver,
-							Rel:   ph.current.currEntry.rel,
-						},
-						Arch: ph.current.arch,
-					},
-					Location: ph.current.location,
-					Checksum: ph.current.checksum,
-				}
+	switch ph.state {
+	case InPackage:
+		ph.state = Start
+		ph.endPackage()
+	case InArch, InLocation, InChecksum, InFormat:
+		ph.state = InPackage
+	case InProvides:
+		ph.state = InFormat
+	case InEntry:
+		ph.state = InProvides
+	}
+}
 
-				if ph.matcher(&pkgInfo.Header) {
-					ph.winner = pkgInfo
-				}
+func (ph *PkgHandler) endPackage() {
+	if ph.err != nil || ph.matcher == nil {
+		return
+	}
 
-				ph.current.currEntry = nil
-			}
-		}
+	pkgInfo, err := matchPackage(&ph.current, ph.matcher)
+	if err != nil {
+		ph.err = err
+		return
+	}
+	if pkgInfo != nil {
+		ph.matches = append(ph.matches, pkgInfo)
 	}
 }
 
 func (ph *PkgHandler) Attr(name, value []byte) {
-	if ph.current == nil {
+	if ph.skipDepth > 0 {
 		return
 	}
 
-	if ph.state == InLocation && string(name) == "href" {
-		ph.current.location = string(value)
-	} else if ph.state == InEntry && ph.current.currEntry != nil {
+	switch ph.state {
+	case InLocation:
+		if string(name) == "href" {
+			ph.current.Location.Href = string(value)
+		}
+	case InChecksum:
+		if string(name) == "type" {
+			ph.current.Checksum.Type = string(value)
+		}
+	case InEntry:
+		entry := &ph.current.Provides[len(ph.current.Provides)-1]
 		switch string(name) {
 		case "name":
-			ph.current.currEntry.name = string(value)
+			entry.Name = string(value)
 		case "epoch":
-			ph.current.currEntry.epoch = string(value)
+			entry.Epoch = string(value)
 		case "ver":
-			ph.current.currEntry.ver = string(value)
+			entry.Ver = string(value)
 		case "rel":
-			ph.current.currEntry.rel = string(value)
-		}
-	} else if ph.state == InChecksum && string(name) == "type" {
-		if ph.current.checksum != nil {
-			ph.current.checksum.Type = string(value)
+			entry.Rel = string(value)
 		}
 	}
 }
 
 func (ph *PkgHandler) CharData(value []byte) {
-	if ph.current == nil {
+	if ph.skipDepth > 0 {
 		return
 	}
 
+	// the data can be split by nested elements, as encoding/xml does it is concatenated
 	switch ph.state {
 	case InArch:
-		ph.current.arch = string(value)
+		ph.current.Arch += string(value)
 	case InChecksum:
-		if ph.current.checksum != nil {
-			ph.current.checksum.Hash = string(value)
+		ph.current.Checksum.Hash += string(value)
+	}
+}
+
+// matchPackage returns the package with its first provide accepted by the matcher, or nil
+// when there is none. Matching packages must have an arch, a location and a checksum.
+func matchPackage(pkg *types.Package, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
+	for _, provides := range pkg.Provides {
+		// arch specific and rich provides, such as `kernel-devel(x86-64)`, are not package names
+		if strings.Contains(provides.Name, "(") {
+			continue
+		}
+
+		header := PkgInfoHeader{
+			Name:    provides.Name,
+			Version: provides.Version,
+			Arch:    pkg.Arch,
+		}
+		if !pkgMatcher(&header) {
+			continue
+		}
+
+		switch {
+		case pkg.Arch == "":
+			return nil, fmt.Errorf("package %s has no arch", provides.Name)
+		case pkg.Location.Href == "":
+			return nil, fmt.Errorf("package %s has no location", provides.Name)
+		case pkg.Checksum.Type == "" || pkg.Checksum.Hash == "":
+			return nil, fmt.Errorf("package %s has no checksum", provides.Name)
 		}
+
+		checksum := pkg.Checksum
+		return &PkgInfo{
+			Header:   header,
+			Location: pkg.Location.Href,
+			Checksum: &checksum,
+		}, nil
 	}
+	return nil, nil
 }
 
-func slowPath(reader io.Reader, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
+func slowPath(reader io.Reader, pkgMatcher PkgMatchFunc) ([]*PkgInfo, error) {
+	var matches []*PkgInfo
+
 	d := xml.NewDecoder(reader)
 	for {
 		tok, err := d.Token()
@@ -618,26 +880,17 @@ func slowPath(reader io.Reader, pkgMatcher PkgMatchFunc) (*PkgInfo, error) {
 					return nil, err
 				}
 
-				for _, provides := range pkg.Provides {
-
-					pkgInfo := &PkgInfo{
-						Header: PkgInfoHeader{
-							Name:    provides.Name,
-							Version: provides.Version,
-							Arch:    pkg.Arch,
-						},
-						Location: pkg.Location.Href,
-						Checksum: &pkg.Checksum,
-					}
-
-					if pkgMatcher(&pkgInfo.Header) {
-						return pkgInfo, nil
-					}
+				pkgInfo, err := matchPackage(&pkg, pkgMatcher)
+				if err != nil {
+					return nil, err
+				}
+				if pkgInfo != nil {
+					matches = append(matches, pkgInfo)
 				}
 			}
 		default:
 		}
 	}
 
-	return nil, nil
+	return matches, nil
 }
@@ -0,0 +1,346 @@
+package repo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/sassoftware/go-rpmutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const primaryHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="2">
+`
+
+type pkgPathTestEntry struct {
+	name      string
+	packages  string
+	expected  []string
+	expectErr bool
+}
+
+func kernelDevelMatcher(pkg *PkgInfoHeader) bool {
+	return pkg.Name == "kernel-devel" || pkg.Name == "kernel-devel-uname-r"
+}
+
+// TestPkgPaths checks that the fast path finds the same packages as the slow path
+func TestPkgPaths(t *testing.T) {
+	testEntries := []pkgPathTestEntry{
+		{
+			name: "usual order",
+			packages: `<package type="rpm"><name>kernel-devel</name><arch>x86_64</arch>
+				<version epoch="0" ver="5.14.0" rel="1.el9"/>
+				<checksum type="sha256" pkgid="YES">aaaa</checksum>
+				<location href="Packages/kernel-devel-5.14.0-1.el9.x86_64.rpm"/>
+				<format><rpm:provides>
+					<rpm:entry name="kernel-devel(x86-64)" flags="EQ" epoch="0" ver="5.14.0" rel="1.el9"/>
+					<rpm:entry name="kernel-devel" flags="EQ" epoch="0" ver="5.14.0" rel="1.el9"/>
+				</rpm:provides></format>
+			</package>`,
+			expected: []string{"kernel-devel 0:5.14.0-1.el9 x86_64 Packages/kernel-devel-5.14.0-1.el9.x86_64.rpm sha256:aaaa"},
+		},
+		{
+			name: "location, checksum and arch after format",
+			packages: `<package type="rpm"><name>kernel-devel</name>
+				<format><rpm:provides>
+					<rpm:entry name="kernel-devel" flags="EQ" epoch="0" ver="5.14.0" rel="1.el9"/>
+				</rpm:provides></format>
+				<arch>x86_64</arch>
+				<location href="Packages/first.rpm"/>
+				<checksum type="sha256">aaaa</checksum>
+			</package>
+			<package type="rpm"><name>kernel-devel</name>
+				<format><rpm:provides>
+					<rpm:entry name="kernel-devel" flags="EQ" epoch="0" ver="5.14.0" rel="2.el9"/>
+				</rpm:provides></format>
+				<checksum type="sha256">bbbb</checksum>
+				<location href="Packages/second.rpm"/>
+				<arch>aarch64</arch>
+			</package>`,
+			expected: []string{
+				"kernel-devel 0:5.14.0-1.el9 x86_64 Packages/first.rpm sha256:aaaa",
+				"kernel-devel 0:5.14.0-2.el9 aarch64 Packages/second.rpm sha256:bbbb",
+			},
+		},
+		{
+			name: "one match per package",
+			packages: `<package type="rpm"><arch>x86_64</arch><location href="a.rpm"/><checksum type="sha256">aaaa</checksum>
+				<format><rpm:provides>
+					<rpm:entry name="kernel-devel-uname-r" ver="5.14.0-1.el9.x86_64"/>
+					<rpm:entry name="kernel-devel" ver="5.14.0" rel="1.el9"/>
+				</rpm:provides></format>
+			</package>`,
+			expected: []string{"kernel-devel-uname-r :5.14.0-1.el9.x86_64- x86_64 a.rpm sha256:aaaa"},
+		},
+		{
+			name: "nested unknown elements and entities",
+			packages: `<package type="rpm"><arch>x86_64</arch>
+				<description><arch>fake</arch><location href="fake.rpm"/></description>
+				<location href="Packages/kernel&amp;devel.rpm"/><checksum type="sha256">aa<!-- split -->aa</checksum>
+				<format><rpm:requires><rpm:entry name="kernel-devel"/></rpm:requires>
+				<rpm:provides><rpm:entry name="kernel-devel" ver="5.14.0" rel="1"/></rpm:provides></format>
+			</package>`,
+			expected: []string{"kernel-devel :5.14.0-1 x86_64 Packages/kernel&devel.rpm sha256:aaaa"},
+		},
+		{
+			name: "no match",
+			packages: `<package type="rpm"><arch>x86_64</arch><location href="a.rpm"/><checksum type="sha256">aaaa</checksum>
+				<format><rpm:provides><rpm:entry name="kernel-headers" ver="5.14.0"/></rpm:provides></format>
+			</package>`,
+			expected: []string{},
+		},
+		{
+			name: "missing location",
+			packages: `<package type="rpm"><arch>x86_64</arch><checksum type="sha256">aaaa</checksum>
+				<format><rpm:provides><rpm:entry name="kernel-devel" ver="5.14.0"/></rpm:provides></format>
+			</package>`,
+			expectErr: true,
+		},
+		{
+			name: "missing checksum",
+			packages: `<package type="rpm"><arch>x86_64</arch><location href="a.rpm"/>
+				<format><rpm:provides><rpm:entry name="kernel-devel" ver="5.14.0"/></rpm:provides></format>
+			</package>`,
+			expectErr: true,
+		},
+		{
+			name: "missing arch in a package not matching",
+			packages: `<package type="rpm"><location href="a.rpm"/><checksum type="sha256">aaaa</checksum>
+				<format><rpm:provides><rpm:entry name="kernel-headers" ver="5.14.0"/></rpm:provides></format>
+			</package>`,
+			expected: []string{},
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			primary := primaryHeader + entry.packages + "\n</metadata>\n"
+
+			for _, path := range []struct {
+				name string
+				path xmlPkgPath
+			}{{"fast", fastPath}, {"slow", slowPath}} {
+				pkgs, err := path.path(strings.NewReader(primary), kernelDevelMatcher)
+				if entry.expectErr {
+					assert.Error(t, err, path.name)
+					continue
+				}
+				if !assert.NoError(t, err, path.name) {
+					continue
+				}
+
+				found := []string{}
+				for _, pkg := range pkgs {
+					found = append(found, strings.Join([]string{
+						pkg.Header.Name,
+						pkg.Header.Epoch + ":" + pkg.Header.Ver + "-" + pkg.Header.Rel,
+						pkg.Header.Arch,
+						pkg.Location,
+						pkg.Checksum.Type + ":" + pkg.Checksum.Hash,
+					}, " "))
+				}
+				assert.Equal(t, entry.expected, found, path.name)
+			}
+		})
+	}
+}
+
+type repoOptionsTestEntry struct {
+	name              string
+	section           string
+	priority          int
+	cost              int
+	includePkgs       []string
+	excludePkgs       []string
+	skipIfUnavailable bool
+}
+
+func TestReadRepoOptions(t *testing.T) {
+	testEntries := []repoOptionsTestEntry{
+		{
+			name:              "defaults",
+			section:           "[baseos]\nbaseurl=https://example.com/baseos\n",
+			priority:          DefaultPriority,
+			cost:              DefaultCost,
+			skipIfUnavailable: true,
+		},
+		{
+			name:              "options",
+			section:           "[baseos]\nbaseurl=https://example.com/baseos\npriority=10\ncost=500\nincludepkgs=kernel*, bash\nexcludepkgs=kernel-rt*\nskip_if_unavailable=False\n",
+			priority:          10,
+			cost:              500,
+			includePkgs:       []string{"kernel*", "bash"},
+			excludePkgs:       []string{"kernel-rt*"},
+			skipIfUnavailable: false,
+		},
+		{
+			name:              "exclude alias",
+			section:           "[baseos]\nbaseurl=https://example.com/baseos\nexcludepkgs=kernel-rt*\nexclude=kernel-debug* kernel-64k*\n",
+			priority:          DefaultPriority,
+			cost:              DefaultCost,
+			excludePkgs:       []string{"kernel-rt*", "kernel-debug*", "kernel-64k*"},
+			skipIfUnavailable: true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "test.repo"), []byte(testEntry.section), 0644))
+
+			repos, err := ReadFromDir(dir)
+			require.NoError(t, err)
+			require.Len(t, repos, 1)
+			assert.Equal(t, testEntry.priority, repos[0].Priority)
+			assert.Equal(t, testEntry.cost, repos[0].Cost)
+			assert.ElementsMatch(t, testEntry.includePkgs, repos[0].IncludePkgs)
+			assert.ElementsMatch(t, testEntry.excludePkgs, repos[0].ExcludePkgs)
+			assert.Equal(t, testEntry.skipIfUnavailable, repos[0].SkipIfUnavailable)
+		})
+	}
+}
+
+// TestMainExcludeIgnored checks that a kernel lock in the main configuration does not hide kernel-devel
+func TestMainExcludeIgnored(t *testing.T) {
+	dir := t.TempDir()
+	mainConfigPath := filepath.Join(dir, "dnf.conf")
+	require.NoError(t, os.WriteFile(mainConfigPath, []byte("[main]\nexclude=kernel*\nexcludepkgs=kernel-devel\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test.repo"), []byte("[baseos]\nbaseurl=https://example.com/baseos\n"), 0644))
+
+	mainConfig, err := ReadMainConfig(mainConfigPath)
+	require.NoError(t, err)
+	repos, err := ReadFromDirWithDefaults(dir, mainConfig)
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+	assert.Empty(t, repos[0].ExcludePkgs)
+	assert.True(t, repos[0].IsPackageAllowed("kernel-devel"))
+}
+
+type packageAllowedTestEntry struct {
+	name        string
+	includePkgs []string
+	excludePkgs []string
+	allowed     map[string]bool
+}
+
+func TestIsPackageAllowed(t *testing.T) {
+	testEntries := []packageAllowedTestEntry{
+		{
+			name:    "no filter",
+			allowed: map[string]bool{"kernel-devel": true, "bash": true},
+		},
+		{
+			name:        "include",
+			includePkgs: []string{"kernel-devel", "kernel-headers"},
+			allowed:     map[string]bool{"kernel-devel": true, "kernel-headers": true, "kernel-devel-matched": false, "bash": false},
+		},
+		{
+			name:        "exclude globs",
+			excludePkgs: []string{"kernel-rt*", "kernel-?4k-devel", "kernel-[dx]ebug-devel"},
+			allowed: map[string]bool{
+				"kernel-devel":       true,
+				"kernel-rt-devel":    false,
+				"kernel-64k-devel":   false,
+				"kernel-6k-devel":    true,
+				"kernel-debug-devel": false,
+				"kernel-xebug-devel": false,
+				"kernel-zebug-devel": true,
+			},
+		},
+		{
+			name:        "exclude takes precedence",
+			includePkgs: []string{"kernel*"},
+			excludePkgs: []string{"kernel-debug*"},
+			allowed:     map[string]bool{"kernel-devel": true, "kernel-debug-devel": false, "bash": false},
+		},
+		{
+			name:        "invalid pattern",
+			excludePkgs: []string{"kernel-[devel"},
+			allowed:     map[string]bool{"kernel-devel": true, "kernel-[devel": true},
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			r := &Repo{IncludePkgs: testEntry.includePkgs, ExcludePkgs: testEntry.excludePkgs}
+			for name, allowed := range testEntry.allowed {
+				assert.Equal(t, allowed, r.IsPackageAllowed(name), name)
+			}
+		})
+	}
+}
+
+// signedPackage returns the test package, signed by signer if not nil
+func signedPackage(t *testing.T, signer *openpgp.Entity) []byte {
+	if signer == nil {
+		data, err := os.ReadFile("testdata/simple-1.0.1-1.i386.rpm")
+		require.NoError(t, err)
+		return data
+	}
+
+	f, err := os.Open("testdata/simple-1.0.1-1.i386.rpm")
+	require.NoError(t, err)
+	defer f.Close()
+
+	outPath := filepath.Join(t.TempDir(), "signed.rpm")
+	_, err = rpmutils.SignRpmFile(f, outPath, signer.PrivateKey, nil)
+	require.NoError(t, err)
+	data, err := os.ReadFile(outPath)
+	require.NoError(t, err)
+	return data
+}
+
+type packageSignatureTestEntry struct {
+	name      string
+	signer    *openpgp.Entity
+	entities  openpgp.EntityList
+	expectErr bool
+}
+
+func TestVerifyPackageSignature(t *testing.T) {
+	trusted, err := openpgp.NewEntity("trusted", "", "trusted@example.com", nil)
+	require.NoError(t, err)
+	untrusted, err := openpgp.NewEntity("untrusted", "", "untrusted@example.com", nil)
+	require.NoError(t, err)
+
+	testEntries := []packageSignatureTestEntry{
+		{
+			name:     "signed by a known key",
+			signer:   trusted,
+			entities: openpgp.EntityList{untrusted, trusted},
+		},
+		{
+			name:      "signed by an unknown key",
+			signer:    untrusted,
+			entities:  openpgp.EntityList{trusted},
+			expectErr: true,
+		},
+		{
+			name:      "signed without keys",
+			signer:    trusted,
+			expectErr: true,
+		},
+		{
+			name:      "unsigned",
+			entities:  openpgp.EntityList{trusted},
+			expectErr: true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			data := signedPackage(t, testEntry.signer)
+			err := verifyPackageSignature(bytes.NewReader(data), testEntry.entities)
+			if testEntry.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
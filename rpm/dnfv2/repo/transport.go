@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/internal/utils"
+)
+
+const (
+	transportKeepAlive       = 30 * time.Second
+	transportIdleConnTimeout = 90 * time.Second
+	transportMaxIdlePerHost  = 4
+	tlsSessionCacheSize      = 64
+)
+
+// TransportPool shares HTTP transports between the repositories using the same TLS identity
+// and connection settings, so that connections and TLS sessions are reused, and the CA and
+// client certificates are only loaded once
+type TransportPool struct {
+	lock       sync.Mutex
+	transports map[transportKey]*http.Transport
+}
+
+type transportKey struct {
+	sslVerify     bool
+	sslCaCert     string
+	sslClientCert string
+	sslClientKey  string
+	proxy         string
+	proxyUsername string
+	proxyPassword string
+	network       string
+	timeout       time.Duration
+}
+
+func NewTransportPool() *TransportPool {
+	return &TransportPool{transports: make(map[transportKey]*http.Transport)}
+}
+
+// CloseIdleConnections closes the idle connections of all the transports
+func (p *TransportPool) CloseIdleConnections() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, transport := range p.transports {
+		transport.CloseIdleConnections()
+	}
+}
+
+func (p *TransportPool) transport(r *Repo) (*http.Transport, error) {
+	key := transportKey{
+		sslVerify:     r.SSLVerify,
+		sslCaCert:     r.SSLCaCert,
+		sslClientCert: r.SSLClientCert,
+		sslClientKey:  r.SSLClientKey,
+		proxy:         r.Proxy,
+		proxyUsername: r.ProxyUsername,
+		proxyPassword: r.ProxyPassword,
+		network:       ipResolveNetwork(r.IPResolve),
+		timeout:       r.timeout(),
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if transport, ok := p.transports[key]; ok {
+		return transport, nil
+	}
+
+	transport, err := newTransport(r, key)
+	if err != nil {
+		return nil, err
+	}
+	p.transports[key] = transport
+	return transport, nil
+}
+
+func newTransport(r *Repo, key transportKey) (*http.Transport, error) {
+	var certs []tls.Certificate
+	if key.sslClientCert != "" || key.sslClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(utils.HostEtcJoin(key.sslClientCert), utils.HostEtcJoin(key.sslClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSL certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	var certPool *x509.CertPool
+	if key.sslCaCert != "" {
+		certPool = x509.NewCertPool()
+		customPem, err := os.ReadFile(utils.HostEtcJoin(key.sslCaCert))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read custom CA cert: %w", err)
+		}
+		if !certPool.AppendCertsFromPEM(customPem) {
+			return nil, fmt.Errorf("failed to add custom CA cert to cert pool")
+		}
+	}
+
+	proxy, err := r.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: key.timeout, KeepAlive: transportKeepAlive}
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, key.network, addr)
+		},
+		// a custom dialer and TLS configuration disable HTTP/2 unless forced
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   key.timeout,
+		ResponseHeaderTimeout: key.timeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       transportIdleConnTimeout,
+		MaxIdleConnsPerHost:   transportMaxIdlePerHost,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: !key.sslVerify,
+			Certificates:       certs,
+			RootCAs:            certPool,
+			ClientSessionCache: tls.NewLRUClientSessionCache(tlsSessionCacheSize),
+		},
+	}, nil
+}
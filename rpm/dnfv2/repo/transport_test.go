@@ -0,0 +1,34 @@
+package repo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransportPool(t *testing.T) {
+	pool := NewTransportPool()
+
+	base := Repo{SectionName: "baseos", SSLVerify: true}
+	appstream := Repo{SectionName: "appstream", SSLVerify: true}
+	insecure := Repo{SectionName: "insecure", SSLVerify: false}
+	proxied := Repo{SectionName: "proxied", SSLVerify: true, Proxy: "http://proxy:3128"}
+
+	baseTransport, err := pool.transport(&base)
+	assert.NoError(t, err)
+	appstreamTransport, err := pool.transport(&appstream)
+	assert.NoError(t, err)
+	insecureTransport, err := pool.transport(&insecure)
+	assert.NoError(t, err)
+	proxiedTransport, err := pool.transport(&proxied)
+	assert.NoError(t, err)
+
+	assert.Same(t, baseTransport, appstreamTransport)
+	assert.NotSame(t, baseTransport, insecureTransport)
+	assert.NotSame(t, baseTransport, proxiedTransport)
+	assert.True(t, insecureTransport.TLSClientConfig.InsecureSkipVerify)
+	assert.NotNil(t, baseTransport.TLSClientConfig.ClientSessionCache)
+
+	_, err = pool.transport(&Repo{SSLCaCert: "/nonexistent/ca.pem"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,333 @@
+package repo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zchunk files, used by Fedora for `primary_zck` metadata, are split in chunks compressed
+// independently, so that only the chunks that changed since a cached copy have to be
+// downloaded. The format is described in
+// https://github.com/zchunk/zchunk/blob/main/zchunk_format.txt
+
+var zckMagic = []byte("\x00ZCK1")
+
+var errZckTruncated = errors.New("truncated zchunk header")
+
+const (
+	zckFlagStreams      = 1 << 0
+	zckFlagOptional     = 1 << 1
+	zckFlagUncompressed = 1 << 2
+
+	zckCompressionNone = 0
+	zckCompressionZstd = 2
+)
+
+type zckHashType uint64
+
+const (
+	zckHashSHA1 zckHashType = iota
+	zckHashSHA256
+	zckHashSHA512
+	zckHashSHA512_128
+)
+
+func (t zckHashType) size() (int, error) {
+	switch t {
+	case zckHashSHA1:
+		return sha1.Size, nil
+	case zckHashSHA256:
+		return sha256.Size, nil
+	case zckHashSHA512:
+		return sha512.Size, nil
+	case zckHashSHA512_128:
+		return 16, nil
+	default:
+		return 0, fmt.Errorf("unsupported zchunk checksum type %d", t)
+	}
+}
+
+func (t zckHashType) sum(data []byte) []byte {
+	switch t {
+	case zckHashSHA1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	case zckHashSHA256:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	case zckHashSHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha512.Sum512(data)
+		return sum[:16]
+	}
+}
+
+type zckChunk struct {
+	checksum []byte
+	// offset of the compressed chunk from the start of the data section
+	offset             int64
+	length             int64
+	uncompressedLength int64
+}
+
+type zckHeader struct {
+	// raw holds the lead and the header, the data section follows it
+	raw            []byte
+	headerChecksum []byte
+	flags          uint64
+	compression    uint64
+	chunkHashType  zckHashType
+	dict           zckChunk
+	chunks         []zckChunk
+}
+
+// dataSize returns the size of the data section, made of the dictionary then the chunks
+func (h *zckHeader) dataSize() int64 {
+	size := h.dict.length
+	for _, chunk := range h.chunks {
+		size += chunk.length
+	}
+	return size
+}
+
+type zckParser struct {
+	data []byte
+	pos  int
+}
+
+// compInt reads a compressed integer: 7 bits per byte, least significant first,
+// the last byte having its high bit set
+func (p *zckParser) compInt() (uint64, error) {
+	var value uint64
+	for shift := 0; shift < 64; shift += 7 {
+		if p.pos >= len(p.data) {
+			return 0, errZckTruncated
+		}
+		b := p.data[p.pos]
+		p.pos++
+
+		value |= uint64(b&0x7f) << shift
+		if b&0x80 != 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("invalid zchunk integer")
+}
+
+func (p *zckParser) length() (int64, error) {
+	value, err := p.compInt()
+	if err != nil {
+		return 0, err
+	}
+	if value > 1<<40 {
+		return 0, fmt.Errorf("invalid zchunk length %d", value)
+	}
+	return int64(value), nil
+}
+
+func (p *zckParser) bytes(n int) ([]byte, error) {
+	if n < 0 || len(p.data)-p.pos < n {
+		return nil, errZckTruncated
+	}
+	res := p.data[p.pos : p.pos+n]
+	p.pos += n
+	return res, nil
+}
+
+// parseZckHeader parses the header at the beginning of data, which must hold at least
+// the whole header. The checksums are verified by the callers, against the repomd.xml ones.
+func parseZckHeader(data []byte) (*zckHeader, error) {
+	p := &zckParser{data: data}
+
+	magic, err := p.bytes(len(zckMagic))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, zckMagic) {
+		return nil, errors.New("not a zchunk file")
+	}
+
+	hashType, err := p.compInt()
+	if err != nil {
+		return nil, err
+	}
+	hashSize, err := zckHashType(hashType).size()
+	if err != nil {
+		return nil, err
+	}
+	headerSize, err := p.length()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &zckHeader{}
+	if h.headerChecksum, err = p.bytes(hashSize); err != nil {
+		return nil, err
+	}
+
+	totalSize := int64(p.pos) + headerSize
+	if int64(len(data)) < totalSize {
+		return nil, errZckTruncated
+	}
+	h.raw = data[:totalSize]
+	p.data = h.raw
+
+	// preface
+	if _, err := p.bytes(hashSize); err != nil {
+		return nil, err
+	}
+	if h.flags, err = p.compInt(); err != nil {
+		return nil, err
+	}
+	if h.compression, err = p.compInt(); err != nil {
+		return nil, err
+	}
+	if h.flags&zckFlagOptional != 0 {
+		count, err := p.compInt()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := p.compInt(); err != nil {
+				return nil, err
+			}
+			size, err := p.length()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.bytes(int(size)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// index, the first entry being the dictionary
+	if _, err := p.length(); err != nil {
+		return nil, err
+	}
+	chunkHashType, err := p.compInt()
+	if err != nil {
+		return nil, err
+	}
+	h.chunkHashType = zckHashType(chunkHashType)
+	chunkHashSize, err := h.chunkHashType.size()
+	if err != nil {
+		return nil, err
+	}
+	count, err := p.compInt()
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 || count > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid zchunk chunk count %d", count)
+	}
+
+	var offset int64
+	h.chunks = make([]zckChunk, 0, count-1)
+	for i := uint64(0); i < count; i++ {
+		if h.flags&zckFlagStreams != 0 {
+			if _, err := p.compInt(); err != nil {
+				return nil, err
+			}
+		}
+
+		chunk := zckChunk{offset: offset}
+		if chunk.checksum, err = p.bytes(chunkHashSize); err != nil {
+			return nil, err
+		}
+		if chunk.length, err = p.length(); err != nil {
+			return nil, err
+		}
+		if chunk.uncompressedLength, err = p.length(); err != nil {
+			return nil, err
+		}
+		offset += chunk.length
+
+		if i == 0 {
+			h.dict = chunk
+		} else {
+			h.chunks = append(h.chunks, chunk)
+		}
+	}
+
+	// the signatures are not used, repomd.xml is the source of trust
+	return h, nil
+}
+
+// decompress writes the uncompressed content of the data section
+func (h *zckHeader) decompress(data []byte, w io.Writer) error {
+	if int64(len(data)) != h.dataSize() {
+		return fmt.Errorf("zchunk data size mismatch: expected %d, got %d", h.dataSize(), len(data))
+	}
+	if h.flags&zckFlagUncompressed != 0 {
+		return errors.New("zchunk files with uncompressed source are not supported")
+	}
+
+	chunkData := func(chunk zckChunk) []byte {
+		return data[chunk.offset : chunk.offset+chunk.length]
+	}
+
+	switch h.compression {
+	case zckCompressionNone:
+		for _, chunk := range h.chunks {
+			if _, err := w.Write(chunkData(chunk)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case zckCompressionZstd:
+	default:
+		return fmt.Errorf("unsupported zchunk compression type %d", h.compression)
+	}
+
+	var options []zstd.DOption
+	if h.dict.length > 0 {
+		dictDecoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return err
+		}
+		dict, err := dictDecoder.DecodeAll(chunkData(h.dict), nil)
+		dictDecoder.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decompress zchunk dictionary: %w", err)
+		}
+
+		// the dictionary is either a trained zstd dictionary or raw content
+		if _, err := zstd.InspectDictionary(dict); err == nil {
+			options = append(options, zstd.WithDecoderDicts(dict))
+		} else {
+			options = append(options, zstd.WithDecoderDictRaw(0, dict))
+		}
+	}
+
+	decoder, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	var buf []byte
+	for i, chunk := range h.chunks {
+		if chunk.length == 0 {
+			continue
+		}
+
+		buf, err = decoder.DecodeAll(chunkData(chunk), buf[:0])
+		if err != nil {
+			return fmt.Errorf("failed to decompress zchunk chunk %d: %w", i, err)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
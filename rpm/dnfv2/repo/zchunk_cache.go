@@ -0,0 +1,221 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/internal/utils"
+	"github.com/DataDog/nikos/rpm/dnfv2/types"
+)
+
+// zckMaxRangeGap is the largest gap between two missing chunks that is downloaded
+// anyway, to merge their range requests
+const zckMaxRangeGap = 64 << 10
+
+// metadataCacheDir returns the cache directory of the repository. Repositories sharing
+// a section name on different URLs get different directories.
+func (r *Repo) metadataCacheDir() string {
+	if r.CacheDir == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(r.BaseURL + "\n" + r.MirrorList + "\n" + r.MetaLink))
+	return filepath.Join(r.CacheDir, fmt.Sprintf("%s-%x", r.SectionName, sum[:8]))
+}
+
+func (r *Repo) zckCachePath() string {
+	return filepath.Join(r.metadataCacheDir(), "primary.xml.zck")
+}
+
+// hasCachedZck reports whether the cache holds a zchunk copy of the primary metadata
+func (r *Repo) hasCachedZck() bool {
+	_, err := os.Stat(r.zckCachePath())
+	return err == nil
+}
+
+// seedZckCache downloads the zchunk primary metadata into the cache, for the next runs
+// to only download the chunks that changed
+func (r *Repo) seedZckCache(ctx context.Context, httpClient *utils.HttpClient, zckURL string, zckData *types.RepomdData) error {
+	fetched, err := httpClient.GetWithChecksum(ctx, zckURL, &zckData.Checksum)
+	if err != nil {
+		return err
+	}
+	content, err := fetched.Data()
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(r.zckCachePath(), content)
+}
+
+// fetchPrimaryZck updates the cached zchunk primary metadata, downloading only the chunks
+// missing from it, or the whole file when they cannot be reused, and returns a function opening the uncompressed metadata. The chunks
+// are decompressed while being read, so that the metadata is never held in memory.
+func (r *Repo) fetchPrimaryZck(ctx context.Context, httpClient *utils.HttpClient, zckURL string, zckData *types.RepomdData) (func() (io.ReadCloser, error), error) {
+	cachePath := r.zckCachePath()
+	cached, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := fetchZckDelta(ctx, httpClient, zckURL, zckData, cached)
+	if err != nil {
+		fetched, err := httpClient.GetWithChecksum(ctx, zckURL, &zckData.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if content, err = fetched.Data(); err != nil {
+			return nil, err
+		}
+	}
+
+	header, err := parseZckHeader(content)
+	if err != nil {
+		return nil, err
+	}
+	data := content[len(header.raw):]
+	if int64(len(data)) != header.dataSize() {
+		return nil, fmt.Errorf("zchunk data size mismatch: expected %d, got %d", header.dataSize(), len(data))
+	}
+
+	openPrimary := func() (io.ReadCloser, error) {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(header.decompress(data, writer))
+		}()
+		return reader, nil
+	}
+
+	primary, err := openPrimary()
+	if err != nil {
+		return nil, err
+	}
+	err = utils.VerifyChecksum(primary, &zckData.OpenChecksum)
+	primary.Close()
+	if err != nil {
+		return nil, fmt.Errorf("zchunk content checksum mismatch for `%s`: %w", zckURL, err)
+	}
+
+	// the cache is best effort
+	if !bytes.Equal(content, cached) {
+		_ = writeCacheFile(cachePath, content)
+	}
+
+	return openPrimary, nil
+}
+
+// fetchZckDelta rebuilds the zchunk file described by the repomd.xml entry, reusing
+// the chunks of the cached file and downloading the others with range requests
+func fetchZckDelta(ctx context.Context, httpClient *utils.HttpClient, zckURL string, zckData *types.RepomdData, cached []byte) ([]byte, error) {
+	if zckData.HeaderSize <= 0 || zckData.HeaderChecksum.Hash == "" {
+		return nil, fmt.Errorf("missing zchunk header in repomd.xml")
+	}
+
+	cachedHeader, err := parseZckHeader(cached)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(cachedHeader.headerChecksum) == zckData.HeaderChecksum.Hash {
+		if err := utils.VerifyChecksum(bytes.NewReader(cached), &zckData.Checksum); err == nil {
+			return cached, nil
+		}
+	}
+
+	rawHeader, err := httpClient.GetRange(ctx, zckURL, 0, zckData.HeaderSize-1)
+	if err != nil {
+		return nil, err
+	}
+	header, err := parseZckHeader(rawHeader)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(header.headerChecksum) != zckData.HeaderChecksum.Hash {
+		return nil, fmt.Errorf("zchunk header checksum mismatch for `%s`", zckURL)
+	}
+
+	cachedData := cached[len(cachedHeader.raw):]
+	cachedChunks := make(map[string][]byte)
+	if cachedHeader.chunkHashType == header.chunkHashType && int64(len(cachedData)) == cachedHeader.dataSize() {
+		for _, chunk := range append([]zckChunk{cachedHeader.dict}, cachedHeader.chunks...) {
+			cachedChunks[string(chunk.checksum)] = cachedData[chunk.offset : chunk.offset+chunk.length]
+		}
+	}
+
+	dataStart := int64(len(header.raw))
+	content := make([]byte, dataStart+header.dataSize())
+	copy(content, header.raw)
+
+	var missing []zckChunk
+	for _, chunk := range append([]zckChunk{header.dict}, header.chunks...) {
+		if data, ok := cachedChunks[string(chunk.checksum)]; ok {
+			copy(content[dataStart+chunk.offset:], data)
+		} else if chunk.length > 0 {
+			missing = append(missing, chunk)
+		}
+	}
+
+	for _, rng := range mergeZckRanges(missing) {
+		data, err := httpClient.GetRange(ctx, zckURL, dataStart+rng.start, dataStart+rng.end-1)
+		if err != nil {
+			return nil, err
+		}
+		copy(content[dataStart+rng.start:], data)
+	}
+
+	for _, chunk := range missing {
+		chunkData := content[dataStart+chunk.offset : dataStart+chunk.offset+chunk.length]
+		if !bytes.Equal(header.chunkHashType.sum(chunkData), chunk.checksum) {
+			return nil, fmt.Errorf("zchunk chunk checksum mismatch for `%s`", zckURL)
+		}
+	}
+
+	if err := utils.VerifyChecksum(bytes.NewReader(content), &zckData.Checksum); err != nil {
+		return nil, fmt.Errorf("zchunk file checksum mismatch for `%s`: %w", zckURL, err)
+	}
+	return content, nil
+}
+
+type zckRange struct {
+	start, end int64
+}
+
+// mergeZckRanges returns the ranges to download for the chunks, in data offsets,
+// merging the chunks close to each other
+func mergeZckRanges(chunks []zckChunk) []zckRange {
+	var ranges []zckRange
+	for _, chunk := range chunks {
+		if n := len(ranges); n > 0 && chunk.offset-ranges[n-1].end <= zckMaxRangeGap {
+			ranges[n-1].end = chunk.offset + chunk.length
+			continue
+		}
+		ranges = append(ranges, zckRange{start: chunk.offset, end: chunk.offset + chunk.length})
+	}
+	return ranges
+}
+
+// writeCacheFile replaces the cached file atomically
+func writeCacheFile(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,279 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/internal/utils"
+	"github.com/DataDog/nikos/rpm/dnfv2/types"
+)
+
+func zckCompInt(v uint64) []byte {
+	var res []byte
+	for v > 127 {
+		res = append(res, byte(v&0x7f))
+		v >>= 7
+	}
+	return append(res, byte(v|0x80))
+}
+
+// buildZck builds a zchunk file with a raw zstd dictionary, and returns its repomd.xml entry
+func buildZck(t *testing.T, dict []byte, chunks []string) ([]byte, *types.RepomdData) {
+	plainEncoder, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	dictEncoder, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(0, dict))
+	require.NoError(t, err)
+
+	compressed := [][]byte{plainEncoder.EncodeAll(dict, nil)}
+	uncompressedLengths := []int{len(dict)}
+	for _, chunk := range chunks {
+		compressed = append(compressed, dictEncoder.EncodeAll([]byte(chunk), nil))
+		uncompressedLengths = append(uncompressedLengths, len(chunk))
+	}
+
+	var data, index []byte
+	index = append(index, zckCompInt(uint64(zckHashSHA512_128))...)
+	index = append(index, zckCompInt(uint64(len(compressed)))...)
+	for i, chunk := range compressed {
+		data = append(data, chunk...)
+		index = append(index, zckHashSHA512_128.sum(chunk)...)
+		index = append(index, zckCompInt(uint64(len(chunk)))...)
+		index = append(index, zckCompInt(uint64(uncompressedLengths[i]))...)
+	}
+
+	dataSum := sha256.Sum256(data)
+	header := append(dataSum[:], zckCompInt(0)...)
+	header = append(header, zckCompInt(zckCompressionZstd)...)
+	header = append(header, zckCompInt(uint64(len(index)))...)
+	header = append(header, index...)
+	header = append(header, zckCompInt(0)...)
+
+	lead := append(append([]byte{}, zckMagic...), zckCompInt(uint64(zckHashSHA256))...)
+	lead = append(lead, zckCompInt(uint64(len(header)))...)
+	headerSum := sha256.Sum256(append(append([]byte{}, lead...), header...))
+
+	file := append(append(append(lead, headerSum[:]...), header...), data...)
+	fileSum := sha256.Sum256(file)
+	openSum := sha256.Sum256([]byte(strings.Join(chunks, "")))
+
+	return file, &types.RepomdData{
+		Type:           "primary_zck",
+		Location:       types.Location{Href: "repodata/primary.xml.zck"},
+		Checksum:       types.Checksum{Type: "sha256", Hash: hex.EncodeToString(fileSum[:])},
+		OpenChecksum:   types.Checksum{Type: "sha256", Hash: hex.EncodeToString(openSum[:])},
+		HeaderChecksum: types.Checksum{Type: "sha256", Hash: hex.EncodeToString(headerSum[:])},
+		HeaderSize:     int64(len(lead) + len(headerSum) + len(header)),
+	}
+}
+
+// zckServer serves a zchunk file, recording the number of bytes sent
+type zckServer struct {
+	lock    sync.Mutex
+	content []byte
+	sent    int
+	ranges  bool
+}
+
+func (s *zckServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.ranges {
+		r.Header.Del("Range")
+	}
+	counter := &countingWriter{ResponseWriter: w}
+	http.ServeContent(counter, r, "primary.xml.zck", time.Time{}, bytes.NewReader(s.content))
+	s.sent += counter.written
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += n
+	return n, err
+}
+
+// chunkContents returns chunks that do not compress well, so that the data dominates the header
+func chunkContents(prefix string, count int) []string {
+	var chunks []string
+	for i := 0; i < count; i++ {
+		var description strings.Builder
+		for j := 0; j < 32; j++ {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", prefix, i, j)))
+			description.WriteString(hex.EncodeToString(sum[:]))
+		}
+		chunks = append(chunks, fmt.Sprintf("<package><name>%s-%d</name><description>%s</description></package>\n", prefix, i, description.String()))
+	}
+	return chunks
+}
+
+func TestZckDecompress(t *testing.T) {
+	chunks := chunkContents("pkg", 10)
+	file, _ := buildZck(t, []byte("<package><name></name></package>"), chunks)
+
+	header, err := parseZckHeader(file)
+	require.NoError(t, err)
+	assert.Len(t, header.chunks, 10)
+
+	var out bytes.Buffer
+	require.NoError(t, header.decompress(file[len(header.raw):], &out))
+	assert.Equal(t, strings.Join(chunks, ""), out.String())
+
+	_, err = parseZckHeader(file[:len(header.raw)-1])
+	assert.ErrorIs(t, err, errZckTruncated)
+}
+
+func TestZckDelta(t *testing.T) {
+	dict := []byte("<package><name></name></package>")
+	oldChunks := chunkContents("pkg", 200)
+	oldFile, _ := buildZck(t, dict, oldChunks)
+
+	// one package updated in the middle, and one added at the end
+	newChunks := append([]string{}, oldChunks...)
+	newChunks[100] = "<package><name>updated</name></package>\n"
+	newChunks = append(newChunks, "<package><name>added</name></package>\n")
+	newFile, zckData := buildZck(t, dict, newChunks)
+
+	testEntries := []struct {
+		name     string
+		ranges   bool
+		cached   []byte
+		maxBytes int
+	}{
+		{name: "delta", ranges: true, cached: oldFile, maxBytes: len(newFile) / 4},
+		{name: "up to date", ranges: true, cached: newFile, maxBytes: 0},
+		{name: "no range support", ranges: false, cached: oldFile, maxBytes: len(newFile) * 2},
+		{name: "corrupted cache", ranges: true, cached: oldFile[:100], maxBytes: len(newFile)},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			server := &zckServer{content: newFile, ranges: entry.ranges}
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+
+			r := &Repo{SectionName: "fedora", BaseURL: httpServer.URL, CacheDir: t.TempDir()}
+			cachePath := filepath.Join(r.metadataCacheDir(), "primary.xml.zck")
+			require.NoError(t, writeCacheFile(cachePath, entry.cached))
+
+			httpClient := utils.NewHttpClientFromInner(httpServer.Client())
+			openPrimary, err := r.fetchPrimaryZck(context.Background(), httpClient, httpServer.URL+"/repodata/primary.xml.zck", zckData)
+			require.NoError(t, err)
+			assert.Equal(t, strings.Join(newChunks, ""), readPrimary(t, openPrimary))
+			assert.LessOrEqual(t, server.sent, entry.maxBytes)
+
+			cached, err := os.ReadFile(cachePath)
+			require.NoError(t, err)
+			assert.Equal(t, newFile, cached)
+		})
+	}
+}
+
+func readPrimary(t *testing.T, openPrimary func() (io.ReadCloser, error)) string {
+	reader, err := openPrimary()
+	require.NoError(t, err)
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+type fetchPrimaryTestEntry struct {
+	name          string
+	cacheDisabled bool
+	cached        []byte
+	// primaryFetched is whether the usual primary metadata is downloaded
+	primaryFetched bool
+}
+
+func TestFetchPrimary(t *testing.T) {
+	dict := []byte("<package><name></name></package>")
+	oldChunks := chunkContents("pkg", 50)
+	oldFile, _ := buildZck(t, dict, oldChunks)
+	newChunks := append(append([]string{}, oldChunks...), "<package><name>added</name></package>\n")
+	newFile, zckData := buildZck(t, dict, newChunks)
+	primary := strings.Join(newChunks, "")
+	primaryData := &types.RepomdData{
+		Type:         "primary",
+		Location:     types.Location{Href: "repodata/primary.xml"},
+		OpenChecksum: zckData.OpenChecksum,
+	}
+
+	testEntries := []fetchPrimaryTestEntry{
+		{
+			name:           "cache disabled",
+			cacheDisabled:  true,
+			primaryFetched: true,
+		},
+		{
+			name:           "empty cache",
+			primaryFetched: true,
+		},
+		{
+			name:   "cached",
+			cached: oldFile,
+		},
+		{
+			name:   "corrupted cache",
+			cached: oldFile[:100],
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			zckServer := &zckServer{content: newFile, ranges: true}
+			primaryRequests := 0
+			mux := http.NewServeMux()
+			mux.Handle("/repodata/primary.xml.zck", zckServer)
+			mux.HandleFunc("/repodata/primary.xml", func(w http.ResponseWriter, r *http.Request) {
+				primaryRequests++
+				w.Write([]byte(primary))
+			})
+			httpServer := httptest.NewServer(mux)
+			defer httpServer.Close()
+
+			r := &Repo{SectionName: "fedora", BaseURL: httpServer.URL}
+			if !entry.cacheDisabled {
+				r.CacheDir = t.TempDir()
+			}
+			if entry.cached != nil {
+				require.NoError(t, writeCacheFile(r.zckCachePath(), entry.cached))
+			}
+
+			httpClient := utils.NewHttpClientFromInner(httpServer.Client())
+			openPrimary, err := r.fetchPrimary(context.Background(), httpClient, httpServer.URL, primaryData, zckData)
+			require.NoError(t, err)
+			assert.Equal(t, primary, readPrimary(t, openPrimary))
+			assert.Equal(t, entry.primaryFetched, primaryRequests > 0)
+
+			if entry.cacheDisabled {
+				assert.Zero(t, zckServer.sent)
+				return
+			}
+			// the cache holds the new zchunk file afterwards
+			cached, err := os.ReadFile(r.zckCachePath())
+			require.NoError(t, err)
+			assert.Equal(t, newFile, cached)
+		})
+	}
+}
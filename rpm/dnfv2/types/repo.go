@@ -11,6 +11,9 @@ type RepomdData struct {
 	Location     Location `xml:"location"`
 	Checksum     Checksum `xml:"checksum"`
 	OpenChecksum Checksum `xml:"open-checksum"`
+	// HeaderChecksum and HeaderSize describe the header of zchunk files
+	HeaderChecksum Checksum `xml:"header-checksum"`
+	HeaderSize     int64    `xml:"header-size"`
 }
 
 type Location struct {
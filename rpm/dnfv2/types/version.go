@@ -0,0 +1,145 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EVR formats the version as `[epoch:]version-release`
+func (v Version) EVR() string {
+	if v.Epoch != "" && v.Epoch != "0" {
+		return fmt.Sprintf("%s:%s-%s", v.Epoch, v.Ver, v.Rel)
+	}
+	return fmt.Sprintf("%s-%s", v.Ver, v.Rel)
+}
+
+// Compare compares two versions by epoch, version then release, as rpm does.
+// It returns -1, 0 or 1 if v is older, equal or newer than other.
+func (v Version) Compare(other Version) int {
+	if c := compareEpoch(v.Epoch, other.Epoch); c != 0 {
+		return c
+	}
+	if c := RpmVerCmp(v.Ver, other.Ver); c != 0 {
+		return c
+	}
+	return RpmVerCmp(v.Rel, other.Rel)
+}
+
+// a missing epoch is the same as a zero epoch
+func compareEpoch(a, b string) int {
+	ea, _ := strconv.Atoi(a)
+	eb, _ := strconv.Atoi(b)
+	switch {
+	case ea < eb:
+		return -1
+	case ea > eb:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// RpmVerCmp compares two version or release strings with the rpmvercmp algorithm:
+// strings are split in numeric and alphabetic segments, numeric segments are newer than
+// alphabetic ones, `~` sorts before anything, even the end of the string, and `^` sorts
+// after the end of the string but before anything else.
+func RpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		a = strings.TrimLeftFunc(a, isSeparator)
+		b = strings.TrimLeftFunc(b, isSeparator)
+
+		// tilde sorts before everything else
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		// caret sorts after the end of the string, but before anything else
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		numeric := isDigit(rune(a[0]))
+		segA, segB := a, b
+		if numeric {
+			a = strings.TrimLeftFunc(a, isDigit)
+			b = strings.TrimLeftFunc(b, isDigit)
+		} else {
+			a = strings.TrimLeftFunc(a, isAlpha)
+			b = strings.TrimLeftFunc(b, isAlpha)
+		}
+		segA, segB = segA[:len(segA)-len(a)], segB[:len(segB)-len(b)]
+
+		// segments of different types, numeric ones are newer
+		if len(segB) == 0 {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func isAlpha(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+func isSeparator(r rune) bool {
+	return !isDigit(r) && !isAlpha(r) && r != '~' && r != '^'
+}
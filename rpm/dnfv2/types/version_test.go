@@ -0,0 +1,56 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type rpmVerCmpTestEntry struct {
+	a        string
+	b        string
+	expected int
+}
+
+func TestRpmVerCmp(t *testing.T) {
+	// cases from the rpm test suite
+	testEntries := []rpmVerCmpTestEntry{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0.1", "2.0", 1},
+		{"2.0.1a", "2.0.1", 1},
+		{"5.5p1", "5.5p2", -1},
+		{"5.5p10", "5.5p1", 1},
+		{"10xyz", "10.1xyz", -1},
+		{"xyz10", "xyz10.1", -1},
+		{"xyz.4", "8", -1},
+		{"8", "xyz.4", 1},
+		{"1b.fc17", "1.fc17", -1},
+		{"1.0010", "1.9", 1},
+		{"1.05", "1.5", 0},
+		{"2_0", "2.0", 0},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~rc1~git123", "1.0~rc1", -1},
+		{"1.0^", "1.0", 1},
+		{"1.0^git1", "1.0^git2", -1},
+		{"1.0^git1", "1.01", -1},
+		{"1.0^20160101", "1.0.1", -1},
+		{"1.0~rc1^git1", "1.0~rc1", 1},
+		{"1.0^git1~pre", "1.0^git1", -1},
+		{"4.18.0-477.el8", "4.18.0-372.el8", 1},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.a+"_"+entry.b, func(t *testing.T) {
+			assert.Equal(t, entry.expected, RpmVerCmp(entry.a, entry.b))
+			assert.Equal(t, -entry.expected, RpmVerCmp(entry.b, entry.a))
+		})
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	assert.Equal(t, 1, Version{Epoch: "1", Ver: "1.0", Rel: "1"}.Compare(Version{Ver: "2.0", Rel: "1"}))
+	assert.Equal(t, 0, Version{Epoch: "0", Ver: "1.0", Rel: "1"}.Compare(Version{Ver: "1.0", Rel: "1"}))
+	assert.Equal(t, -1, Version{Ver: "5.14.0", Rel: "362.8.1.el9_3"}.Compare(Version{Ver: "5.14.0", Rel: "362.13.1.el9_3"}))
+}
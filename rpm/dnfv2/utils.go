@@ -11,14 +11,41 @@ import (
 	"github.com/DataDog/nikos/types"
 )
 
+// CacheDir is where the repository metadata is kept between runs, so that only the
+// changed chunks of the zchunk metadata are downloaded. The cache is disabled when empty.
+var CacheDir string
+
 func NewBackend(release string, reposDir string) (*backend.Backend, error) {
+	return NewBackendWithVars(release, reposDir, nil)
+}
+
+// NewBackendWithVars creates a backend with additional default DNF variables, such
+// as the $contentdir of the distribution. The variables of /etc/dnf/vars and of the
+// environment take precedence. A non-empty reposDir replaces the `reposdir` directories
+// of the configuration, as `--setopt=reposdir=` does with dnf.
+func NewBackendWithVars(release string, reposDir string, defaultVars map[string]string) (*backend.Backend, error) {
 	builtinVars, err := backend.ComputeBuiltinVariables(release)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compute DNF builting variables: %w", err)
 	}
+	for name, value := range defaultVars {
+		if _, ok := builtinVars[name]; !ok {
+			builtinVars[name] = value
+		}
+	}
+
+	mainConfig, err := repo.ReadMainConfig(repo.MainConfigPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package manager configuration: %w", err)
+	}
+	mainConfig.CacheDir = CacheDir
+	reposDirs := mainConfig.ReposDirs
+	if reposDir != "" {
+		reposDirs = []string{reposDir}
+	}
 
 	varsDir := []string{"/etc/dnf/vars/", "/etc/yum/vars/"}
-	b, err := backend.NewBackend(reposDir, varsDir, builtinVars)
+	b, err := backend.NewBackend(reposDirs, mainConfig, varsDir, builtinVars)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fedora dnf backend: %w", err)
 	}
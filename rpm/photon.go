@@ -0,0 +1,28 @@
+package rpm
+
+import (
+	"github.com/DataDog/nikos/types"
+)
+
+// NewPhotonBackend supports VMware Photon OS, whose kernel is named linux, with
+// flavours such as linux-esx or linux-secure
+func NewPhotonBackend(target *types.Target, reposDir string, logger types.Logger) (*TdnfBackend, error) {
+	release := target.OSRelease["VERSION_ID"]
+	if release == "" {
+		release = target.Distro.Release
+	}
+
+	// tdnf substitutes the variables as plain strings, so the repositories use
+	// names such as photon_updates_$releasever_$basearch
+	vars := map[string]string{"releasever_": release + "_"}
+
+	return newTdnfBackend(target, reposDir, logger, vars, photonPkgName)
+}
+
+// photonPkgName returns the devel package of a kernel flavour, e.g. linux-esx-devel
+func photonPkgName(flavour string) string {
+	if flavour == "" {
+		return "linux-devel"
+	}
+	return "linux-" + flavour + "-devel"
+}
@@ -0,0 +1,63 @@
+package rpm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/nikos/rpm/dnfv2"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+	"github.com/DataDog/nikos/types"
+)
+
+// rhelRebuild describes a RHEL rebuild whose older point releases are moved to a vault
+type rhelRebuild struct {
+	name string
+	// vaultURL returns the URL of a repository of the release in the vault
+	vaultURL func(release, repository string) string
+	// gpgKey returns the path of the signing key of the major version
+	gpgKey func(major int) string
+	// vars are the default DNF variables shipped in /etc/dnf/vars
+	vars map[string]string
+}
+
+// newRebuildBackend uses the repositories of the host, then falls back to the
+// BaseOS and AppStream repositories of the exact point release in the vault
+func newRebuildBackend(rebuild *rhelRebuild, target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	release, err := getRedhatRelease()
+	if err != nil {
+		logger.Debugf("failed to read redhat-release, using %s: %v", target.Distro.Release, err)
+		release = target.Distro.Release
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(release, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to detect %s release: %w", rebuild.name, err)
+	}
+
+	b, err := dnfv2.NewBackendWithVars(strconv.Itoa(major), reposDir, rebuild.vars)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(release, ".") {
+		gpgKey := rebuild.gpgKey(major)
+		for _, repository := range []string{"BaseOS", "AppStream"} {
+			name := fmt.Sprintf("%s-%s-%s-vault", strings.ToLower(rebuild.name), release, strings.ToLower(repository))
+			b.AppendRepository(repo.Repo{
+				SectionName: name,
+				Name:        name,
+				BaseURL:     rebuild.vaultURL(release, repository),
+				Enabled:     true,
+				GpgCheck:    true,
+				GpgKeys:     []string{gpgKey},
+			})
+		}
+	}
+
+	return &RedHatBackend{
+		target:     target,
+		logger:     logger,
+		dnfBackend: b,
+	}, nil
+}
@@ -2,23 +2,47 @@ package rpm
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/DataDog/nikos/rpm/dnfv2"
 	"github.com/DataDog/nikos/rpm/dnfv2/backend"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
 	"github.com/DataDog/nikos/types"
+	"github.com/hashicorp/go-multierror"
 )
 
 type RedHatBackend struct {
 	dnfBackend *backend.Backend
 	logger     types.Logger
 	target     *types.Target
+	// pkgNames are the names of the kernel-devel packages, kernel-devel when empty
+	pkgNames []string
+	// extendedRepos are the disabled repositories of the extended life cycle
+	// content sets, by content set, tried when the standard ones lack the package
+	extendedRepos [][]string
 }
 
 func (b *RedHatBackend) GetKernelHeaders(directory string) error {
-	pkgNevra := "kernel-devel"
-	pkgMatcher := dnfv2.DefaultPkgMatcher(pkgNevra, b.target.Uname.Kernel)
+	pkgNames := b.pkgNames
+	if len(pkgNames) == 0 {
+		pkgNames = []string{"kernel-devel"}
+	}
+	pkgNevra := strings.Join(pkgNames, "` or `")
+	pkgMatcher := anyPkgMatcher(pkgNames, b.target.Uname.Kernel)
 
 	pkg, data, err := b.dnfBackend.FetchPackage(pkgMatcher)
+	for i := 0; err != nil && i < len(b.extendedRepos); i++ {
+		b.logger.Infof("`%s` not found, trying repositories %s", pkgNevra, strings.Join(b.extendedRepos[i], ", "))
+
+		var extendedErr error
+		pkg, data, extendedErr = b.dnfBackend.FetchPackageFrom(b.extendedRepos[i], pkgMatcher)
+		if extendedErr != nil {
+			err = multierror.Append(err, extendedErr)
+		} else {
+			err = nil
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to fetch `%s` package: %w", pkgNevra, err)
 	}
@@ -26,18 +50,141 @@ func (b *RedHatBackend) GetKernelHeaders(directory string) error {
 	return dnfv2.ExtractPackage(pkg, data, directory, b.target, b.logger)
 }
 
+// anyPkgMatcher matches the packages of the running kernel with one of the names
+func anyPkgMatcher(pkgNames []string, kernel string) repo.PkgMatchFunc {
+	matchers := make([]repo.PkgMatchFunc, 0, len(pkgNames))
+	for _, pkgName := range pkgNames {
+		matchers = append(matchers, dnfv2.DefaultPkgMatcher(pkgName, kernel))
+	}
+
+	return func(pkg *repo.PkgInfoHeader) bool {
+		for _, matcher := range matchers {
+			if matcher(pkg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func (b *RedHatBackend) Close() {
 }
 
 func NewRedHatBackend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
-	b, err := dnfv2.NewBackend(target.Distro.Release, reposDir)
+	major, _ := strconv.Atoi(strings.SplitN(target.Distro.Release, ".", 2)[0])
+
+	pinned, err := readPinnedReleasever()
+	if err != nil {
+		logger.Warnf("failed to read the pinned RHEL release: %v", err)
+	}
+
+	releasever := pinned
+	if releasever == "" {
+		releasever = defaultRHELReleasever(major)
+	} else {
+		logger.Infof("using pinned RHEL release %s", releasever)
+	}
+
+	b, err := dnfv2.NewBackend(releasever, reposDir)
 	if err != nil {
 		return nil, err
 	}
 
-	return &RedHatBackend{
+	redhatBackend := &RedHatBackend{
 		target:     target,
 		logger:     logger,
 		dnfBackend: b,
-	}, nil
+	}
+
+	// the extended content sets are published by minor release
+	minorRelease := pinned
+	if !strings.Contains(minorRelease, ".") {
+		minorRelease = target.Distro.Release
+	}
+
+	if err := redhatBackend.setupEntitlement(major, minorRelease); err != nil {
+		logger.Warnf("failed to set up RHEL entitlement: %v", err)
+	}
+
+	return redhatBackend, nil
+}
+
+// defaultRHELReleasever returns the release version of the redhat-release package,
+// used by the repositories when the release is not pinned
+func defaultRHELReleasever(major int) string {
+	if major == 7 {
+		return "7Server"
+	}
+	return strconv.Itoa(major)
+}
+
+// setupEntitlement points the configured repositories at the current entitlement
+// certificate when theirs was rotated, adds the BaseOS and AppStream repositories
+// when none is entitled, e.g. when redhat.repo was not mounted, and prepares the
+// extended life cycle repositories of the minor release
+func (b *RedHatBackend) setupEntitlement(major int, minorRelease string) error {
+	ent, err := findEntitlement()
+	if err != nil {
+		return err
+	}
+	if ent == nil {
+		b.logger.Debug("no valid entitlement certificate found")
+		return nil
+	}
+	if major < 7 {
+		return nil
+	}
+
+	entitled := false
+	enabledSets := make(map[string]bool)
+	for i := range b.dnfBackend.Repositories {
+		r := &b.dnfBackend.Repositories[i]
+		if !isEntitlementCert(r.SSLClientCert) {
+			continue
+		}
+
+		entitled = true
+		if !entitlementExists(r.SSLClientCert) {
+			b.logger.Debugf("using entitlement certificate %s for repository %s", ent.cert, r.Name)
+			r.SSLClientCert, r.SSLClientKey = ent.cert, ent.key
+		}
+
+		for _, contentSet := range rhelContentSets {
+			if r.Enabled && strings.Contains(r.SectionName, "-"+contentSet+"-") {
+				enabledSets[contentSet] = true
+			}
+		}
+	}
+
+	config, err := readRHSMConfig()
+	if err != nil {
+		return err
+	}
+
+	if !entitled {
+		for _, r := range rhelRepositories(major, "dist", "$releasever", config, ent) {
+			b.logger.Infof("adding entitled repository %s", r.Name)
+			b.dnfBackend.AppendRepository(r)
+		}
+	}
+
+	if !strings.Contains(minorRelease, ".") {
+		return nil
+	}
+
+	for _, contentSet := range rhelContentSets {
+		// the repositories enabled on the host are already searched
+		if enabledSets[contentSet] {
+			continue
+		}
+
+		var sectionNames []string
+		for _, r := range rhelRepositories(major, contentSet, minorRelease, config, ent) {
+			r.Enabled = false
+			b.dnfBackend.AppendRepository(r)
+			sectionNames = append(sectionNames, r.SectionName)
+		}
+		b.extendedRepos = append(b.extendedRepos, sectionNames)
+	}
+	return nil
 }
@@ -0,0 +1,114 @@
+package rpm
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/backend"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+)
+
+type setupEntitlementTestEntry struct {
+	name         string
+	redhatRepo   string
+	noCert       bool
+	minorRelease string
+	// added are the section names of the repositories added for the standard content set
+	added    []string
+	extended [][]string
+	// clientCert is the certificate used by the repositories of redhat.repo
+	clientCert string
+}
+
+func TestSetupEntitlement(t *testing.T) {
+	const (
+		baseosEUS    = "rhel-8-for-$basearch-baseos-eus-rpms"
+		appstreamEUS = "rhel-8-for-$basearch-appstream-eus-rpms"
+		baseosE4S    = "rhel-8-for-$basearch-baseos-e4s-rpms"
+		appstreamE4S = "rhel-8-for-$basearch-appstream-e4s-rpms"
+		baseosAUS    = "rhel-8-for-$basearch-baseos-aus-rpms"
+		appstreamAUS = "rhel-8-for-$basearch-appstream-aus-rpms"
+	)
+	redhatRepo := func(section string, enabled int, cert string) string {
+		return fmt.Sprintf("[%s]\nbaseurl=https://cdn.redhat.com/content/\nenabled=%d\nsslclientcert=%s\nsslclientkey=/etc/pki/entitlement/1-key.pem\n\n", section, enabled, cert)
+	}
+
+	testEntries := []setupEntitlementTestEntry{
+		{
+			name:         "not entitled",
+			minorRelease: "8.6",
+			added:        []string{"rhel-8-for-$basearch-baseos-rpms", "rhel-8-for-$basearch-appstream-rpms"},
+			extended:     [][]string{{baseosEUS, appstreamEUS}, {baseosE4S, appstreamE4S}, {baseosAUS, appstreamAUS}},
+		},
+		{
+			name:         "no minor release",
+			minorRelease: "8",
+			added:        []string{"rhel-8-for-$basearch-baseos-rpms", "rhel-8-for-$basearch-appstream-rpms"},
+		},
+		{
+			name:         "no entitlement certificate",
+			noCert:       true,
+			minorRelease: "8.6",
+		},
+		{
+			name:         "entitled",
+			redhatRepo:   redhatRepo("rhel-8-for-x86_64-baseos-rpms", 1, "/etc/pki/entitlement/123.pem"),
+			minorRelease: "8.6",
+			extended:     [][]string{{baseosEUS, appstreamEUS}, {baseosE4S, appstreamE4S}, {baseosAUS, appstreamAUS}},
+			clientCert:   "/etc/pki/entitlement/123.pem",
+		},
+		{
+			name: "enabled content set skipped",
+			redhatRepo: redhatRepo("rhel-8-for-x86_64-baseos-eus-rpms", 1, "/etc/pki/entitlement/123.pem") +
+				redhatRepo("rhel-8-for-x86_64-baseos-e4s-rpms", 0, "/etc/pki/entitlement/123.pem"),
+			minorRelease: "8.6",
+			extended:     [][]string{{baseosE4S, appstreamE4S}, {baseosAUS, appstreamAUS}},
+			clientCert:   "/etc/pki/entitlement/123.pem",
+		},
+		{
+			name:         "rotated certificate",
+			redhatRepo:   redhatRepo("rhel-8-for-x86_64-baseos-rpms", 1, "/etc/pki/entitlement/1.pem"),
+			minorRelease: "8",
+			clientCert:   "/etc/pki/entitlement/123.pem",
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			hostEtc := t.TempDir()
+			t.Setenv("HOST_ETC", hostEtc)
+			writeHostFile(t, hostEtc, "yum.repos.d/redhat.repo", []byte(testEntry.redhatRepo))
+			if !testEntry.noCert {
+				now := time.Now()
+				writeHostFile(t, hostEtc, "pki/entitlement/123.pem", entitlementCert(t, now.Add(-time.Hour), now.Add(time.Hour)))
+				writeHostFile(t, hostEtc, "pki/entitlement/123-key.pem", []byte("key"))
+			}
+
+			dnfBackend, err := backend.NewBackend([]string{"/etc/yum.repos.d"}, repo.DefaultMainConfig(), nil, map[string]string{"basearch": "x86_64"})
+			require.NoError(t, err)
+			configured := len(dnfBackend.Repositories)
+
+			b := &RedHatBackend{dnfBackend: dnfBackend, logger: logrus.New()}
+			require.NoError(t, b.setupEntitlement(8, testEntry.minorRelease))
+			assert.Equal(t, testEntry.extended, b.extendedRepos)
+
+			var added []string
+			for _, r := range dnfBackend.Repositories[configured:] {
+				assert.True(t, r.Fallback)
+				if r.Enabled {
+					added = append(added, r.SectionName)
+				}
+			}
+			assert.Equal(t, testEntry.added, added)
+
+			for _, r := range dnfBackend.Repositories[:configured] {
+				assert.Equal(t, testEntry.clientCert, r.SSLClientCert)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package rpm
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+	"github.com/DataDog/nikos/types"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	defaultRHSMBaseURL   = "https://cdn.redhat.com"
+	defaultRHSMCACertDir = "/etc/rhsm/ca/"
+	defaultRHSMRepoCA    = "/etc/rhsm/ca/redhat-uep.pem"
+	entitlementDir       = "/etc/pki/entitlement/"
+	redhatGpgKey         = "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-redhat-release"
+)
+
+// rhsmConfig holds the content delivery settings of subscription-manager
+type rhsmConfig struct {
+	baseURL    string
+	repoCACert string
+}
+
+// readRHSMConfig reads the [rhsm] section of /etc/rhsm/rhsm.conf, falling back
+// to the defaults of subscription-manager for the missing options
+func readRHSMConfig() (*rhsmConfig, error) {
+	config := &rhsmConfig{
+		baseURL:    defaultRHSMBaseURL,
+		repoCACert: defaultRHSMRepoCA,
+	}
+
+	cfg, err := ini.Load(types.HostEtc("rhsm", "rhsm.conf"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, fmt.Errorf("failed to read rhsm.conf: %w", err)
+	}
+
+	section := cfg.Section("rhsm")
+	if baseURL := section.Key("baseurl").String(); baseURL != "" {
+		config.baseURL = strings.TrimRight(baseURL, "/")
+	}
+	if repoCACert := section.Key("repo_ca_cert").String(); repoCACert != "" {
+		// ini only interpolates the options present in the file
+		caCertDir := section.Key("ca_cert_dir").MustString(defaultRHSMCACertDir)
+		repoCACert = strings.ReplaceAll(repoCACert, "%(ca_cert_dir)s", caCertDir)
+		config.repoCACert = filepath.Clean(repoCACert)
+	}
+
+	return config, nil
+}
+
+// entitlement is a certificate and key pair of /etc/pki/entitlement, with the
+// paths used in .repo files
+type entitlement struct {
+	cert     string
+	key      string
+	notAfter time.Time
+}
+
+// findEntitlement returns the currently valid entitlement certificate expiring
+// last, or nil when there is none
+func findEntitlement() (*entitlement, error) {
+	certPaths, err := filepath.Glob(types.HostEtc("pki", "entitlement", "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var best *entitlement
+	for _, certPath := range certPaths {
+		if strings.HasSuffix(certPath, "-key.pem") {
+			continue
+		}
+
+		keyPath := strings.TrimSuffix(certPath, ".pem") + "-key.pem"
+		if _, err := os.Stat(keyPath); err != nil {
+			continue
+		}
+
+		cert, err := readCertificate(certPath)
+		if err != nil || now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			continue
+		}
+
+		if best == nil || cert.NotAfter.After(best.notAfter) {
+			best = &entitlement{
+				cert:     entitlementDir + filepath.Base(certPath),
+				key:      entitlementDir + filepath.Base(keyPath),
+				notAfter: cert.NotAfter,
+			}
+		}
+	}
+
+	return best, nil
+}
+
+// readCertificate parses the first certificate of a PEM file. Entitlement
+// certificates are followed by other blocks, such as the entitlement data.
+func readCertificate(path string) (*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// readPinnedReleasever returns the release set with `subscription-manager release --set`,
+// or an empty string when the release is not pinned
+func readPinnedReleasever() (string, error) {
+	content, err := os.ReadFile(types.HostVar("lib", "rhsm", "cache", "releasever.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	var releasever struct {
+		ReleaseVer string `json:"releaseVer"`
+	}
+	if err := json.Unmarshal(content, &releasever); err != nil {
+		return "", fmt.Errorf("failed to parse releasever.json: %w", err)
+	}
+	return strings.TrimSpace(releasever.ReleaseVer), nil
+}
+
+// isEntitlementCert returns whether the client certificate of a repository is
+// managed by subscription-manager
+func isEntitlementCert(path string) bool {
+	return strings.HasPrefix(path, entitlementDir)
+}
+
+// entitlementExists checks the presence of a certificate referenced by a repository
+func entitlementExists(path string) bool {
+	_, err := os.Stat(types.HostEtc(strings.TrimPrefix(path, "/etc/")))
+	return err == nil
+}
+
+// rhelContentSets are the extended life cycle content sets, in the order they are tried:
+// Extended Update Support, Update Services for SAP Solutions and Advanced Update Support
+var rhelContentSets = []string{"eus", "e4s", "aus"}
+
+// rhelRepositories returns the BaseOS and AppStream repositories of a content set,
+// as generated by subscription-manager in redhat.repo. The standard "dist" content
+// set follows $releasever, the extended ones are pinned to a minor release.
+func rhelRepositories(major int, contentSet, release string, config *rhsmConfig, ent *entitlement) []repo.Repo {
+	type rhelRepo struct {
+		name string
+		path string
+	}
+
+	suffix := "-rpms"
+	if contentSet != "dist" {
+		suffix = "-" + contentSet + suffix
+	}
+
+	var repos []rhelRepo
+	if major >= 8 {
+		for _, content := range []string{"baseos", "appstream"} {
+			repos = append(repos, rhelRepo{
+				name: fmt.Sprintf("rhel-%d-for-$basearch-%s%s", major, content, suffix),
+				path: fmt.Sprintf("/content/%s/rhel%d/%s/$basearch/%s/os", contentSet, major, release, content),
+			})
+		}
+	} else {
+		repos = append(repos, rhelRepo{
+			name: fmt.Sprintf("rhel-%d-server%s", major, suffix),
+			path: fmt.Sprintf("/content/%s/rhel/server/%d/%s/$basearch/os", contentSet, major, release),
+		})
+	}
+
+	res := make([]repo.Repo, 0, len(repos))
+	for _, r := range repos {
+		res = append(res, repo.Repo{
+			SectionName:   r.name,
+			Name:          r.name,
+			BaseURL:       config.baseURL + r.path,
+			Enabled:       true,
+			GpgCheck:      true,
+			GpgKeys:       []string{redhatGpgKey},
+			SSLVerify:     true,
+			SSLCaCert:     config.repoCACert,
+			SSLClientCert: ent.cert,
+			SSLClientKey:  ent.key,
+		})
+	}
+	return res
+}
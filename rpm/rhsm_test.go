@@ -0,0 +1,317 @@
+package rpm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeHostFile writes a file under a temporary host root, creating its directory
+func writeHostFile(t *testing.T, root string, path string, content []byte) {
+	path = filepath.Join(root, path)
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, content, 0644))
+}
+
+// entitlementCert returns a PEM certificate valid between notBefore and notAfter, followed
+// by an entitlement data block as in the certificates of subscription-manager
+func entitlementCert(t *testing.T, notBefore, notAfter time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "entitlement"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(content, pem.EncodeToMemory(&pem.Block{Type: "ENTITLEMENT DATA", Bytes: []byte("data")})...)
+}
+
+type rhsmConfigTestEntry struct {
+	name     string
+	content  string
+	expected *rhsmConfig
+}
+
+func TestReadRHSMConfig(t *testing.T) {
+	testEntries := []rhsmConfigTestEntry{
+		{
+			name:     "missing file",
+			expected: &rhsmConfig{baseURL: defaultRHSMBaseURL, repoCACert: defaultRHSMRepoCA},
+		},
+		{
+			name:     "empty section",
+			content:  "[rhsm]\n",
+			expected: &rhsmConfig{baseURL: defaultRHSMBaseURL, repoCACert: defaultRHSMRepoCA},
+		},
+		{
+			name:     "default ca_cert_dir",
+			content:  "[rhsm]\nbaseurl = https://satellite.example.com/pulp/content/\nrepo_ca_cert = %(ca_cert_dir)sredhat-uep.pem\n",
+			expected: &rhsmConfig{baseURL: "https://satellite.example.com/pulp/content", repoCACert: "/etc/rhsm/ca/redhat-uep.pem"},
+		},
+		{
+			name:     "custom ca_cert_dir",
+			content:  "[rhsm]\nca_cert_dir = /etc/rhsm/custom-ca/\nrepo_ca_cert = %(ca_cert_dir)skatello-server-ca.pem\n",
+			expected: &rhsmConfig{baseURL: defaultRHSMBaseURL, repoCACert: "/etc/rhsm/custom-ca/katello-server-ca.pem"},
+		},
+		{
+			name:     "absolute repo_ca_cert",
+			content:  "[server]\nhostname = subscription.rhsm.redhat.com\n\n[rhsm]\nrepo_ca_cert = /etc/pki/ca-trust/satellite.pem\n",
+			expected: &rhsmConfig{baseURL: defaultRHSMBaseURL, repoCACert: "/etc/pki/ca-trust/satellite.pem"},
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			hostEtc := t.TempDir()
+			t.Setenv("HOST_ETC", hostEtc)
+			if testEntry.content != "" {
+				writeHostFile(t, hostEtc, "rhsm/rhsm.conf", []byte(testEntry.content))
+			}
+
+			config, err := readRHSMConfig()
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, config)
+		})
+	}
+}
+
+// entitlementFile is a certificate of /etc/pki/entitlement, valid between
+// the given offsets from now
+type entitlementFile struct {
+	name      string
+	notBefore time.Duration
+	notAfter  time.Duration
+	noKey     bool
+	invalid   bool
+}
+
+type findEntitlementTestEntry struct {
+	name     string
+	files    []entitlementFile
+	expected string
+}
+
+func TestFindEntitlement(t *testing.T) {
+	const day = 24 * time.Hour
+
+	testEntries := []findEntitlementTestEntry{
+		{
+			name: "no certificate",
+		},
+		{
+			name:     "valid",
+			files:    []entitlementFile{{name: "123", notBefore: -day, notAfter: day}},
+			expected: "123",
+		},
+		{
+			name:  "missing key",
+			files: []entitlementFile{{name: "123", notBefore: -day, notAfter: day, noKey: true}},
+		},
+		{
+			name:  "expired",
+			files: []entitlementFile{{name: "123", notBefore: -2 * day, notAfter: -day}},
+		},
+		{
+			name:  "not yet valid",
+			files: []entitlementFile{{name: "123", notBefore: day, notAfter: 2 * day}},
+		},
+		{
+			name:  "invalid certificate",
+			files: []entitlementFile{{name: "123", invalid: true}},
+		},
+		{
+			name: "expires last",
+			files: []entitlementFile{
+				{name: "111", notBefore: -day, notAfter: day},
+				{name: "222", notBefore: -day, notAfter: 30 * day},
+				{name: "333", notBefore: -day, notAfter: 10 * day},
+				{name: "444", notBefore: -day, notAfter: 60 * day, noKey: true},
+				{name: "555", notBefore: day, notAfter: 90 * day},
+			},
+			expected: "222",
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			hostEtc := t.TempDir()
+			t.Setenv("HOST_ETC", hostEtc)
+			require.NoError(t, os.MkdirAll(filepath.Join(hostEtc, "pki", "entitlement"), 0755))
+
+			now := time.Now()
+			for _, file := range testEntry.files {
+				cert := []byte("not a certificate")
+				if !file.invalid {
+					cert = entitlementCert(t, now.Add(file.notBefore), now.Add(file.notAfter))
+				}
+				writeHostFile(t, hostEtc, "pki/entitlement/"+file.name+".pem", cert)
+				if !file.noKey {
+					writeHostFile(t, hostEtc, "pki/entitlement/"+file.name+"-key.pem", []byte("key"))
+				}
+			}
+
+			ent, err := findEntitlement()
+			require.NoError(t, err)
+			if testEntry.expected == "" {
+				assert.Nil(t, ent)
+				return
+			}
+			require.NotNil(t, ent)
+			assert.Equal(t, "/etc/pki/entitlement/"+testEntry.expected+".pem", ent.cert)
+			assert.Equal(t, "/etc/pki/entitlement/"+testEntry.expected+"-key.pem", ent.key)
+		})
+	}
+}
+
+type pinnedReleaseverTestEntry struct {
+	name     string
+	content  string
+	expected string
+	err      bool
+}
+
+func TestReadPinnedReleasever(t *testing.T) {
+	testEntries := []pinnedReleaseverTestEntry{
+		{
+			name: "not pinned",
+		},
+		{
+			name:     "pinned",
+			content:  `{"releaseVer": "8.6"}`,
+			expected: "8.6",
+		},
+		{
+			name:     "pinned major",
+			content:  `{"releaseVer": " 9\n", "source": "manual"}`,
+			expected: "9",
+		},
+		{
+			name:    "unset",
+			content: `{"releaseVer": ""}`,
+		},
+		{
+			name:    "invalid",
+			content: `releaseVer=8.6`,
+			err:     true,
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			hostVar := t.TempDir()
+			t.Setenv("HOST_VAR", hostVar)
+			if testEntry.content != "" {
+				writeHostFile(t, hostVar, "lib/rhsm/cache/releasever.json", []byte(testEntry.content))
+			}
+
+			releasever, err := readPinnedReleasever()
+			if testEntry.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testEntry.expected, releasever)
+		})
+	}
+}
+
+type rhelRepositoriesTestEntry struct {
+	name       string
+	major      int
+	contentSet string
+	release    string
+	// expected maps the section names to the base URLs
+	expected map[string]string
+}
+
+func TestRHELRepositories(t *testing.T) {
+	config := &rhsmConfig{baseURL: "https://cdn.redhat.com", repoCACert: defaultRHSMRepoCA}
+	ent := &entitlement{cert: "/etc/pki/entitlement/123.pem", key: "/etc/pki/entitlement/123-key.pem"}
+
+	testEntries := []rhelRepositoriesTestEntry{
+		{
+			name:       "rhel 7 dist",
+			major:      7,
+			contentSet: "dist",
+			release:    "$releasever",
+			expected: map[string]string{
+				"rhel-7-server-rpms": "https://cdn.redhat.com/content/dist/rhel/server/7/$releasever/$basearch/os",
+			},
+		},
+		{
+			name:       "rhel 7 eus",
+			major:      7,
+			contentSet: "eus",
+			release:    "7.7",
+			expected: map[string]string{
+				"rhel-7-server-eus-rpms": "https://cdn.redhat.com/content/eus/rhel/server/7/7.7/$basearch/os",
+			},
+		},
+		{
+			name:       "rhel 8 dist",
+			major:      8,
+			contentSet: "dist",
+			release:    "$releasever",
+			expected: map[string]string{
+				"rhel-8-for-$basearch-baseos-rpms":    "https://cdn.redhat.com/content/dist/rhel8/$releasever/$basearch/baseos/os",
+				"rhel-8-for-$basearch-appstream-rpms": "https://cdn.redhat.com/content/dist/rhel8/$releasever/$basearch/appstream/os",
+			},
+		},
+		{
+			name:       "rhel 9 e4s",
+			major:      9,
+			contentSet: "e4s",
+			release:    "9.2",
+			expected: map[string]string{
+				"rhel-9-for-$basearch-baseos-e4s-rpms":    "https://cdn.redhat.com/content/e4s/rhel9/9.2/$basearch/baseos/os",
+				"rhel-9-for-$basearch-appstream-e4s-rpms": "https://cdn.redhat.com/content/e4s/rhel9/9.2/$basearch/appstream/os",
+			},
+		},
+		{
+			name:       "rhel 8 aus",
+			major:      8,
+			contentSet: "aus",
+			release:    "8.4",
+			expected: map[string]string{
+				"rhel-8-for-$basearch-baseos-aus-rpms":    "https://cdn.redhat.com/content/aus/rhel8/8.4/$basearch/baseos/os",
+				"rhel-8-for-$basearch-appstream-aus-rpms": "https://cdn.redhat.com/content/aus/rhel8/8.4/$basearch/appstream/os",
+			},
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.name, func(t *testing.T) {
+			repos := rhelRepositories(testEntry.major, testEntry.contentSet, testEntry.release, config, ent)
+
+			baseURLs := make(map[string]string)
+			for _, r := range repos {
+				baseURLs[r.SectionName] = r.BaseURL
+				assert.Equal(t, r.SectionName, r.Name)
+				assert.True(t, r.Enabled)
+				assert.True(t, r.GpgCheck)
+				assert.Equal(t, []string{redhatGpgKey}, r.GpgKeys)
+				assert.Equal(t, defaultRHSMRepoCA, r.SSLCaCert)
+				assert.Equal(t, ent.cert, r.SSLClientCert)
+				assert.Equal(t, ent.key, r.SSLClientKey)
+			}
+			assert.Equal(t, testEntry.expected, baseURLs)
+		})
+	}
+}
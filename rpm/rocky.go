@@ -0,0 +1,28 @@
+package rpm
+
+import (
+	"fmt"
+
+	"github.com/DataDog/nikos/types"
+)
+
+var rockyLinux = &rhelRebuild{
+	name: "Rocky",
+	vaultURL: func(release, repository string) string {
+		return fmt.Sprintf("https://dl.rockylinux.org/vault/rocky/%s/%s/$basearch/os/", release, repository)
+	},
+	gpgKey: func(major int) string {
+		if major == 8 {
+			return "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-rockyofficial"
+		}
+		return fmt.Sprintf("file:///etc/pki/rpm-gpg/RPM-GPG-KEY-Rocky-%d", major)
+	},
+	vars: map[string]string{
+		"contentdir": "pub/rocky",
+		"rltype":     "",
+	},
+}
+
+func NewRockyBackend(target *types.Target, reposDir string, logger types.Logger) (*RedHatBackend, error) {
+	return newRebuildBackend(rockyLinux, target, reposDir, logger)
+}
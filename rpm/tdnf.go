@@ -0,0 +1,71 @@
+package rpm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DataDog/nikos/rpm/dnfv2"
+	"github.com/DataDog/nikos/rpm/dnfv2/backend"
+	"github.com/DataDog/nikos/rpm/dnfv2/repo"
+	"github.com/DataDog/nikos/types"
+)
+
+// TdnfBackend supports the distributions managed by tdnf, whose kernel releases
+// have no architecture and end with the flavour of the kernel, e.g. 6.1.75-1.ph5-esx
+type TdnfBackend struct {
+	dnfBackend *backend.Backend
+	target     *types.Target
+	logger     types.Logger
+	// pkgName returns the name of the devel package of a kernel flavour
+	pkgName func(flavour string) string
+}
+
+func (b *TdnfBackend) GetKernelHeaders(directory string) error {
+	verRel, flavour := splitKernelFlavour(b.target.Uname.Kernel)
+	pkgNevra := b.pkgName(flavour)
+
+	pkg, data, err := b.dnfBackend.FetchPackage(func(pkg *repo.PkgInfoHeader) bool {
+		return pkg.Name == pkgNevra && pkg.Ver+"-"+pkg.Rel == verRel
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch `%s` package: %w", pkgNevra, err)
+	}
+
+	return dnfv2.ExtractPackage(pkg, data, directory, b.target, b.logger)
+}
+
+func (b *TdnfBackend) Close() {
+}
+
+// splitKernelFlavour splits a kernel release into the version and release of the
+// package and the flavour, empty for the default kernel
+func splitKernelFlavour(kernel string) (string, string) {
+	ver, rel, found := strings.Cut(kernel, "-")
+	if !found {
+		return kernel, ""
+	}
+
+	rel, flavour, _ := strings.Cut(rel, "-")
+	return ver + "-" + rel, flavour
+}
+
+// newTdnfBackend uses the repositories of /etc/yum.repos.d, with the release
+// of os-release as $releasever, e.g. 2.0 or 5.0
+func newTdnfBackend(target *types.Target, reposDir string, logger types.Logger, vars map[string]string, pkgName func(string) string) (*TdnfBackend, error) {
+	release := target.OSRelease["VERSION_ID"]
+	if release == "" {
+		release = target.Distro.Release
+	}
+
+	b, err := dnfv2.NewBackendWithVars(release, reposDir, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TdnfBackend{
+		dnfBackend: b,
+		target:     target,
+		logger:     logger,
+		pkgName:    pkgName,
+	}, nil
+}
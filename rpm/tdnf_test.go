@@ -0,0 +1,63 @@
+package rpm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tdnfPkgTestEntry struct {
+	kernel  string
+	pkgName func(string) string
+	name    string
+	verRel  string
+}
+
+func TestTdnfKernelPackage(t *testing.T) {
+	testEntries := []tdnfPkgTestEntry{
+		{
+			kernel:  "6.1.75-1.ph5",
+			pkgName: photonPkgName,
+			name:    "linux-devel",
+			verRel:  "6.1.75-1.ph5",
+		},
+		{
+			kernel:  "6.1.75-1.ph5-esx",
+			pkgName: photonPkgName,
+			name:    "linux-esx-devel",
+			verRel:  "6.1.75-1.ph5",
+		},
+		{
+			kernel:  "6.1.75-1.ph5-secure",
+			pkgName: photonPkgName,
+			name:    "linux-secure-devel",
+			verRel:  "6.1.75-1.ph5",
+		},
+		{
+			kernel:  "6.1.75-1.ph5-rt",
+			pkgName: photonPkgName,
+			name:    "linux-rt-devel",
+			verRel:  "6.1.75-1.ph5",
+		},
+		{
+			kernel:  "5.15.158.2-1.cm2",
+			pkgName: azureLinuxPkgName,
+			name:    "kernel-devel",
+			verRel:  "5.15.158.2-1.cm2",
+		},
+		{
+			kernel:  "6.6.47.1-1.azl3",
+			pkgName: azureLinuxPkgName,
+			name:    "kernel-devel",
+			verRel:  "6.6.47.1-1.azl3",
+		},
+	}
+
+	for _, testEntry := range testEntries {
+		t.Run(testEntry.kernel, func(t *testing.T) {
+			verRel, flavour := splitKernelFlavour(testEntry.kernel)
+			assert.Equal(t, testEntry.verRel, verRel)
+			assert.Equal(t, testEntry.name, testEntry.pkgName(flavour))
+		})
+	}
+}
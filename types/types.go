@@ -65,6 +65,15 @@ func NewTarget() (Target, error) {
 		target.Distro.Display, target.Distro.Family = id, id
 	}
 
+	// derivatives unknown to gopsutil, such as AlmaLinux, get the family they are like,
+	// the other distributions are their own family, such as Azure Linux or Photon OS
+	if target.Distro.Family == "" {
+		target.Distro.Family = familyFromIDLike(target.OSRelease["ID_LIKE"])
+	}
+	if target.Distro.Family == "" {
+		target.Distro.Family = target.Distro.Display
+	}
+
 	return target, nil
 }
 
@@ -81,6 +90,20 @@ func isWSL(kernel string) bool {
 	return false
 }
 
+func familyFromIDLike(idLike string) string {
+	for _, id := range strings.Fields(idLike) {
+		switch id {
+		case "rhel", "centos", "fedora":
+			return "rhel"
+		case "debian", "ubuntu":
+			return "debian"
+		case "suse", "opensuse":
+			return "suse"
+		}
+	}
+	return ""
+}
+
 func getOSRelease() map[string]string {
 	osReleasePaths := []string{
 		osrelease.EtcOsRelease,
@@ -140,3 +163,11 @@ func GetEnv(key string, dfault string, combineWith ...string) string {
 func HostEtc(combineWith ...string) string {
 	return GetEnv("HOST_ETC", "/etc", combineWith...)
 }
+
+func HostRoot(combineWith ...string) string {
+	return GetEnv("HOST_ROOT", "/", combineWith...)
+}
+
+func HostVar(combineWith ...string) string {
+	return GetEnv("HOST_VAR", "/var", combineWith...)
+}
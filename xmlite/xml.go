@@ -6,8 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"unicode/utf8"
 )
 
+// Handler receives the tokens of the document. The slices are only valid until the next call.
+// Character data between two tags is reported in a single call, comments and processing
+// instructions in the middle of it are skipped.
 type Handler interface {
 	StartTag(name []byte)
 	EndTag(name []byte)
@@ -15,13 +19,19 @@ type Handler interface {
 	CharData(value []byte)
 }
 
+// LiteDecoder is a streaming XML decoder that does not allocate per token. It decodes the
+// predefined entities, character references and CDATA sections, and skips comments,
+// processing instructions and directives such as `<!DOCTYPE>`. Unlike encoding/xml, it does
+// not check that the document is well formed, and names keep their namespace prefix.
 type LiteDecoder struct {
 	reader    io.ByteReader
 	handler   Handler
 	peekStore int
-	nameBuff  bytes.Buffer
-	attrBuff  bytes.Buffer
-	buff      bytes.Buffer
+	// tagOpen is set when the `<` starting the next tag has already been read
+	tagOpen  bool
+	nameBuff bytes.Buffer
+	attrBuff bytes.Buffer
+	buff     bytes.Buffer
 }
 
 func NewLiteDecoder(reader io.Reader, handler Handler) *LiteDecoder {
@@ -63,10 +73,12 @@ func (lt *LiteDecoder) clearPeek() {
 	lt.peekStore = -1
 }
 
+// Parse reads the whole document. A document ending in the middle of a token
+// fails with io.ErrUnexpectedEOF.
 func (lt *LiteDecoder) Parse() error {
 	for {
 		if err := lt.NextToken(); err != nil {
-			if errors.Is(err, io.EOF) {
+			if err == io.EOF {
 				return nil
 			}
 			return err
@@ -74,102 +86,422 @@ func (lt *LiteDecoder) Parse() error {
 	}
 }
 
+// NextToken reads the next character data or tag, and returns io.EOF at the end of the document
 func (lt *LiteDecoder) NextToken() error {
-	for {
-		curr, err := lt.peekc()
-		if err != nil {
-			return err
+	emitted, err := lt.text()
+	if err != nil || emitted {
+		return err
+	}
+
+	if err := lt.tag(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
 		}
+		return err
+	}
+	return nil
+}
+
+// tag reads a start or end tag, whose `<` has already been read
+func (lt *LiteDecoder) tag() error {
+	lt.tagOpen = false
+
+	// possibly </
+	curr, err := lt.peekc()
+	if err != nil {
+		return err
+	}
+
+	isEnd := false
+	if curr == '/' {
+		isEnd = true
+		lt.clearPeek()
+	}
+
+	// handle name
+	name, err := lt.name(false)
+	if err != nil {
+		return err
+	}
+	if isEnd {
+		lt.handler.EndTag(name)
+	} else {
+		lt.handler.StartTag(name)
+	}
+
+	lt.space()
 
-		if curr != '<' {
-			cd, err := lt.charData()
+	// handle attributes
+	if !isEnd {
+		for !lt.isNextSlashOrRightOrErr() {
+			attrName, err := lt.name(true)
 			if err != nil {
 				return err
 			}
-			lt.handler.CharData(cd)
-			return nil
+			lt.space()
+			if err := lt.eat('='); err != nil {
+				return err
+			}
+			lt.space()
+
+			attrValue, err := lt.quote()
+			if err != nil {
+				return err
+			}
+			lt.handler.Attr(attrName, attrValue)
+
+			lt.space()
+		}
+	}
+
+	// end tag
+	autoclose, err := lt.skipUntilEndTag('/')
+	if err != nil {
+		return err
+	}
+	if autoclose {
+		// name is still valid since we use a different buffer
+		lt.handler.EndTag(name)
+	}
+
+	return nil
+}
+
+// text reads the character data up to the next tag, and reports it if not empty. Comments,
+// processing instructions and directives are skipped, CDATA sections are part of the data.
+// The `<` of the next tag is read.
+func (lt *LiteDecoder) text() (bool, error) {
+	lt.buff.Reset()
+	for {
+		if !lt.tagOpen {
+			err := lt.readText('<')
+			if err == io.EOF {
+				if lt.buff.Len() == 0 {
+					return false, io.EOF
+				}
+				lt.handler.CharData(lt.buff.Bytes())
+				return true, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			lt.tagOpen = true
+		}
+
+		next, err := lt.peekc()
+		if err != nil {
+			return false, unexpectedEOF(err)
+		}
+		if next != '!' && next != '?' {
+			break
 		}
 
-		// handle tag
 		lt.clearPeek()
+		lt.tagOpen = false
+		if next == '?' {
+			err = lt.skipProcInst()
+		} else {
+			err = lt.markup()
+		}
+		if err != nil {
+			return false, unexpectedEOF(err)
+		}
+	}
+
+	if lt.buff.Len() == 0 {
+		return false, nil
+	}
+	lt.handler.CharData(lt.buff.Bytes())
+	return true, nil
+}
 
-		// possibly </ or <?
-		curr1, err := lt.peekc()
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readText appends the text up to the delimiter to the buffer, decoding the entities
+// and normalizing line endings to `\n`. The delimiter is read.
+func (lt *LiteDecoder) readText(delim byte) error {
+	prevCR := false
+	for {
+		curr, err := lt.getc()
 		if err != nil {
 			return err
 		}
 
-		isEnd := false
-		if curr1 == '/' {
-			isEnd = true
-			lt.clearPeek()
-		} else if curr1 == '?' {
-			lt.skipUntilEndTag('?')
-			continue
+		switch {
+		case curr == delim:
+			return nil
+		case curr == '&':
+			if err := lt.entity(); err != nil {
+				return unexpectedEOF(err)
+			}
+		case curr == '\r':
+			lt.buff.WriteByte('\n')
+		case curr == '\n' && prevCR:
+			// already written for the \r
+		default:
+			lt.buff.WriteByte(curr)
 		}
+		prevCR = curr == '\r'
+	}
+}
 
-		// handle name
-		name, err := lt.name(false)
-		if err != nil {
+// entity decodes the predefined entity or the character reference following a `&`
+func (lt *LiteDecoder) entity() error {
+	curr, err := lt.getc()
+	if err != nil {
+		return err
+	}
+	if curr == '#' {
+		return lt.charRef()
+	}
+
+	// the longest predefined entities are `apos` and `quot`
+	var name [4]byte
+	n := 0
+	for ; curr != ';'; n++ {
+		if n == len(name) || !isNameChar(curr) {
+			return fmt.Errorf("invalid entity `&%s%c`", string(name[:n]), curr)
+		}
+		name[n] = curr
+
+		if curr, err = lt.getc(); err != nil {
 			return err
 		}
-		if isEnd {
-			lt.handler.EndTag(name)
-		} else {
-			lt.handler.StartTag(name)
+	}
+
+	switch string(name[:n]) {
+	case "amp":
+		lt.buff.WriteByte('&')
+	case "lt":
+		lt.buff.WriteByte('<')
+	case "gt":
+		lt.buff.WriteByte('>')
+	case "apos":
+		lt.buff.WriteByte('\'')
+	case "quot":
+		lt.buff.WriteByte('"')
+	default:
+		return fmt.Errorf("unknown entity `&%s;`", string(name[:n]))
+	}
+	return nil
+}
+
+// charRef decodes a `&#65;` or `&#x41;` character reference, following the `&#`
+func (lt *LiteDecoder) charRef() error {
+	curr, err := lt.getc()
+	if err != nil {
+		return err
+	}
+
+	base := uint64(10)
+	if curr == 'x' {
+		base = 16
+		if curr, err = lt.getc(); err != nil {
+			return err
 		}
+	}
 
-		lt.space()
+	var value uint64
+	digits := 0
+	for ; curr != ';'; digits++ {
+		digit, ok := digitValue(curr, base)
+		if !ok {
+			return fmt.Errorf("invalid character reference, unexpected `%c`", curr)
+		}
+		value = value*base + digit
+		if value > utf8.MaxRune {
+			return errors.New("invalid character reference, out of range")
+		}
 
-		// handle attributes
-		if !isEnd {
-			for !lt.isNextSlashOrRightOrErr() {
-				attrName, err := lt.name(true)
-				if err != nil {
-					return err
-				}
-				if err := lt.eat('='); err != nil {
-					return err
-				}
+		if curr, err = lt.getc(); err != nil {
+			return err
+		}
+	}
+	if digits == 0 {
+		return errors.New("empty character reference")
+	}
 
-				attrValue, err := lt.quote()
-				if err != nil {
-					return err
-				}
-				lt.handler.Attr(attrName, attrValue)
+	// surrogates are written as the replacement character, as encoding/xml does
+	r := rune(value)
+	if !utf8.ValidRune(r) {
+		r = utf8.RuneError
+	}
+	if !isInCharacterRange(r) {
+		return fmt.Errorf("illegal character reference %U", r)
+	}
+	lt.buff.WriteRune(r)
+	return nil
+}
+
+func digitValue(c byte, base uint64) (uint64, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return uint64(c - '0'), true
+	case base == 16 && 'a' <= c && c <= 'f':
+		return uint64(c-'a') + 10, true
+	case base == 16 && 'A' <= c && c <= 'F':
+		return uint64(c-'A') + 10, true
+	default:
+		return 0, false
+	}
+}
+
+// isInCharacterRange reports whether the character is allowed by the XML specification
+func isInCharacterRange(r rune) bool {
+	return r == 0x09 ||
+		r == 0x0A ||
+		r == 0x0D ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// markup handles what follows a `<!`: comments and directives are skipped,
+// the content of CDATA sections is appended to the buffer
+func (lt *LiteDecoder) markup() error {
+	curr, err := lt.getc()
+	if err != nil {
+		return err
+	}
 
-				lt.space()
+	switch curr {
+	case '-':
+		if err := lt.eat('-'); err != nil {
+			return err
+		}
+		return lt.skipComment()
+	case '[':
+		for i := 0; i < len("CDATA["); i++ {
+			if err := lt.eat("CDATA["[i]); err != nil {
+				return err
 			}
 		}
+		return lt.readCDATA()
+	default:
+		// like encoding/xml, the first character is not interpreted
+		return lt.skipDirective()
+	}
+}
 
-		// end tag
-		autoclose, err := lt.skipUntilEndTag('/')
+// skipComment skips a comment up to its `-->`, the `<!--` being read
+func (lt *LiteDecoder) skipComment() error {
+	dashes := 0
+	for {
+		curr, err := lt.getc()
 		if err != nil {
 			return err
 		}
-		if autoclose {
-			// name is still valid since we use a different buffer
-			lt.handler.EndTag(name)
+
+		if curr == '>' && dashes >= 2 {
+			return nil
 		}
+		if curr == '-' {
+			dashes++
+		} else {
+			dashes = 0
+		}
+	}
+}
 
-		return nil
+// readCDATA appends the content of a CDATA section up to its `]]>` to the buffer
+func (lt *LiteDecoder) readCDATA() error {
+	brackets := 0
+	prevCR := false
+	for {
+		curr, err := lt.getc()
+		if err != nil {
+			return err
+		}
+
+		if curr == '>' && brackets >= 2 {
+			lt.buff.Truncate(lt.buff.Len() - 2)
+			return nil
+		}
+		if curr == ']' {
+			brackets++
+		} else {
+			brackets = 0
+		}
+
+		switch {
+		case curr == '\r':
+			lt.buff.WriteByte('\n')
+		case curr == '\n' && prevCR:
+		default:
+			lt.buff.WriteByte(curr)
+		}
+		prevCR = curr == '\r'
 	}
 }
 
-func (lt *LiteDecoder) charData() ([]byte, error) {
-	lt.buff.Reset()
+// skipDirective skips a directive such as `<!DOCTYPE ...>`, after its first character.
+// Like encoding/xml, it handles quoted strings, nested markup declarations and comments.
+func (lt *LiteDecoder) skipDirective() error {
+	depth := 0
+	var quote byte
 	for {
-		curr, err := lt.peekc()
+		curr, err := lt.getc()
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if curr == '<' {
-			return lt.buff.Bytes(), nil
+		switch {
+		case quote != 0:
+			if curr == quote {
+				quote = 0
+			}
+		case curr == '\'' || curr == '"':
+			quote = curr
+		case curr == '>':
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		case curr == '<':
+			isComment, err := lt.skipNestedComment()
+			if err != nil {
+				return err
+			}
+			if !isComment {
+				depth++
+			}
 		}
+	}
+}
 
+// skipNestedComment skips the comment following a `<` in a directive, if any
+func (lt *LiteDecoder) skipNestedComment() (bool, error) {
+	for i := 0; i < len("!--"); i++ {
+		next, err := lt.peekc()
+		if err != nil {
+			return false, err
+		}
+		if next != "!--"[i] {
+			return false, nil
+		}
 		lt.clearPeek()
-		lt.buff.WriteByte(curr)
+	}
+	return true, lt.skipComment()
+}
+
+// skipProcInst skips a processing instruction up to its `?>`, the `<?` being read
+func (lt *LiteDecoder) skipProcInst() error {
+	prev := byte(0)
+	for {
+		curr, err := lt.getc()
+		if err != nil {
+			return err
+		}
+
+		if curr == '>' && prev == '?' {
+			return nil
+		}
+		prev = curr
 	}
 }
 
@@ -237,18 +569,10 @@ func (lt *LiteDecoder) quote() ([]byte, error) {
 	}
 
 	lt.buff.Reset()
-	for {
-		curr, err := lt.getc()
-		if err != nil {
-			return nil, err
-		}
-
-		if curr != delim {
-			lt.buff.WriteByte(curr)
-		} else {
-			return lt.buff.Bytes(), nil
-		}
+	if err := lt.readText(delim); err != nil {
+		return nil, err
 	}
+	return lt.buff.Bytes(), nil
 }
 
 func (lt *LiteDecoder) space() error {
@@ -267,6 +591,10 @@ func (lt *LiteDecoder) space() error {
 	}
 }
 
+// isNameChar matches the bytes of names as encoding/xml reads them, non-ASCII
+// bytes being part of UTF-8 encoded characters
 func isNameChar(c byte) bool {
-	return c == ':' || c == '-' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+	return c >= utf8.RuneSelf ||
+		c == ':' || c == '-' || c == '_' || c == '.' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
 }
@@ -0,0 +1,236 @@
+package xmlite
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingHandler records the tokens, merging consecutive character data
+type recordingHandler struct {
+	tokens []string
+}
+
+func (h *recordingHandler) StartTag(name []byte) {
+	h.tokens = append(h.tokens, "start "+string(name))
+}
+
+func (h *recordingHandler) EndTag(name []byte) {
+	h.tokens = append(h.tokens, "end "+string(name))
+}
+
+func (h *recordingHandler) Attr(name, value []byte) {
+	h.tokens = append(h.tokens, fmt.Sprintf("attr %s=%q", name, value))
+}
+
+func (h *recordingHandler) CharData(value []byte) {
+	h.charData(string(value))
+}
+
+func (h *recordingHandler) charData(value string) {
+	if value == "" {
+		return
+	}
+	if n := len(h.tokens); n > 0 && strings.HasPrefix(h.tokens[n-1], "data ") {
+		h.tokens[n-1] += value
+		return
+	}
+	h.tokens = append(h.tokens, "data "+value)
+}
+
+type xmliteTestEntry struct {
+	name     string
+	input    string
+	expected []string
+}
+
+func TestLiteDecoder(t *testing.T) {
+	testEntries := []xmliteTestEntry{
+		{
+			name:  "elements and attributes",
+			input: `<?xml version="1.0" encoding="UTF-8"?><package type="rpm"><name>kernel</name><rpm:entry name='a' /></package>`,
+			expected: []string{
+				"start package", `attr type="rpm"`,
+				"start name", "data kernel", "end name",
+				"start rpm:entry", `attr name="a"`, "end rpm:entry",
+				"end package",
+			},
+		},
+		{
+			name:  "entities",
+			input: `<location href="a&amp;b&lt;&gt;&quot;&apos;&#65;&#x42;&#xe9;.rpm">&lt;tag&gt; &amp; &#x1F600;</location>`,
+			expected: []string{
+				"start location", `attr href="a&b<>\"'ABé.rpm"`,
+				"data <tag> & 😀", "end location",
+			},
+		},
+		{
+			name:  "comments and doctype",
+			input: "<!DOCTYPE metadata [<!ENTITY x \"<>\"><!-- > -->]>\n<metadata><!-- <fake/> -->a<!---->b<?pi x?>c</metadata>",
+			expected: []string{
+				"data \n", "start metadata", "data abc", "end metadata",
+			},
+		},
+		{
+			name:  "cdata",
+			input: "<description><![CDATA[<not a tag> & ]] ]]>]]></description>",
+			expected: []string{
+				"start description", "data <not a tag> & ]] ]]>", "end description",
+			},
+		},
+		{
+			name:  "digits, underscores and dots in names",
+			input: `<sha256_sum v1.x="1"><h2>x</h2></sha256_sum>`,
+			expected: []string{
+				"start sha256_sum", `attr v1.x="1"`, "start h2", "data x", "end h2", "end sha256_sum",
+			},
+		},
+		{
+			name:     "line endings",
+			input:    "<a b=\"1\r\n2\">x\r\ny\rz</a>",
+			expected: []string{"start a", "attr b=\"1\\n2\"", "data x\ny\nz", "end a"},
+		},
+		{
+			name:     "spaces around equal sign",
+			input:    `<a b = "1"/>`,
+			expected: []string{"start a", `attr b="1"`, "end a"},
+		},
+		{
+			name:     "trailing data",
+			input:    "<a/>\n",
+			expected: []string{"start a", "end a", "data \n"},
+		},
+	}
+
+	for _, entry := range testEntries {
+		t.Run(entry.name, func(t *testing.T) {
+			handler := &recordingHandler{}
+			err := NewLiteDecoder(strings.NewReader(entry.input), handler).Parse()
+			assert.NoError(t, err)
+			assert.Equal(t, entry.expected, handler.tokens)
+		})
+	}
+}
+
+func TestLiteDecoderErrors(t *testing.T) {
+	testEntries := []string{
+		"<a>&unknown;</a>",
+		"<a>&amp</a>",
+		"<a>&#;</a>",
+		"<a>&#0;</a>",
+		"<a>&#x110000;</a>",
+		"<a><!-- unterminated",
+		"<a><![CDATA[ unterminated",
+		"<a b=\"unterminated",
+		"<a",
+	}
+
+	for _, input := range testEntries {
+		t.Run(input, func(t *testing.T) {
+			err := NewLiteDecoder(strings.NewReader(input), &recordingHandler{}).Parse()
+			assert.Error(t, err)
+		})
+	}
+}
+
+type nopHandler struct{}
+
+func (nopHandler) StartTag([]byte)       {}
+func (nopHandler) EndTag([]byte)         {}
+func (nopHandler) Attr([]byte, []byte)   {}
+func (nopHandler) CharData(value []byte) {}
+
+func TestLiteDecoderAllocations(t *testing.T) {
+	pkg := `<!-- package --><package type="rpm"><name>kernel&amp;co</name><version epoch="0" ver="5.14.0" rel="1"/>` +
+		`<description><![CDATA[headers]]> &#x41;</description></package>`
+
+	allocs := func(count int) float64 {
+		doc := []byte("<metadata>" + strings.Repeat(pkg, count) + "</metadata>")
+		return testing.AllocsPerRun(10, func() {
+			if err := NewLiteDecoder(bytes.NewReader(doc), nopHandler{}).Parse(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// only the decoder and its buffers are allocated, regardless of the document size
+	assert.Equal(t, allocs(1), allocs(1000))
+}
+
+// stdTokens returns the tokens of encoding/xml in the format of recordingHandler
+func stdTokens(input []byte) ([]string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(input))
+	handler := &recordingHandler{}
+
+	fullName := func(name xml.Name) string {
+		if name.Space != "" {
+			return name.Space + ":" + name.Local
+		}
+		return name.Local
+	}
+
+	for {
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			return handler.tokens, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			handler.tokens = append(handler.tokens, "start "+fullName(token.Name))
+			for _, attr := range token.Attr {
+				handler.tokens = append(handler.tokens, fmt.Sprintf("attr %s=%q", fullName(attr.Name), attr.Value))
+			}
+		case xml.EndElement:
+			handler.tokens = append(handler.tokens, "end "+fullName(token.Name))
+		case xml.CharData:
+			handler.charData(string(token))
+		}
+	}
+}
+
+// FuzzLiteDecoder checks that the documents accepted by encoding/xml are decoded the same way
+func FuzzLiteDecoder(f *testing.F) {
+	seeds := []string{
+		`<?xml version="1.0" encoding="UTF-8"?><metadata xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="1">` +
+			`<package type="rpm"><name>kernel-devel</name><arch>x86_64</arch>` +
+			`<version epoch="0" ver="5.14.0" rel="362.8.1.el9_3"/><location href="Packages/k/kernel&amp;devel.rpm"/>` +
+			`<format><rpm:provides><rpm:entry name="kernel-devel" flags="EQ"/></rpm:provides></format></package></metadata>`,
+		"<!DOCTYPE a [<!ENTITY b 'c'>]><a>x<!-- y -->z</a>",
+		"<!\"x><a/>",
+		"<a><![CDATA[<b>]]>&#x41;&#66;&lt;</a>",
+		"<a\r\nb='1\r2'>\r\n</a>",
+		"<a_1 b.2 = \"3\"/>",
+		"text",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		expected, stdErr := stdTokens(input)
+
+		handler := &recordingHandler{}
+		err := NewLiteDecoder(bytes.NewReader(input), handler).Parse()
+		if stdErr != nil {
+			// the decoder is more lenient than encoding/xml, it only has to not panic
+			return
+		}
+
+		if err != nil {
+			t.Fatalf("failed to decode %q accepted by encoding/xml: %v", input, err)
+		}
+		if !assert.Equal(t, expected, handler.tokens) {
+			t.Fatalf("different tokens for %q", input)
+		}
+	})
+}